@@ -1,3 +1,5 @@
+//go:build !gitdiff
+
 // Go script for releasing or deploying grafana dashboards.
 // This script expects to run within a gitlab ci pod.
 package main
@@ -5,364 +7,9936 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/formatter"
+	"github.com/google/go-jsonnet/linter"
+	"github.com/itchyny/gojq"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/google/externalaccount"
+	"gopkg.in/yaml.v3"
 )
 
-// Helper method to return environment depending on the branch.
-// To be used by the main deploy script to choose which grafana server to target
-func SelectGrafanaServer(branch string) string {
+// Pipeline configuration, read from grafana-pipeline.yaml in the repository root.
+// Every setting is optional so repositories without a config file keep the original behaviour.
+type Config struct {
+	// Directories containing dashboard sources. Entries may contain globs, e.g. teams/*/grafana
+	Sources []string `yaml:"sources"`
 
-	// If this is a project branch return ses, otherwise return dev
-	if strings.Contains(branch, "project/") {
-		return "tst"
-	} else {
-		return "dev"
-	}
-}
+	// Grafana servers that can be deployed to, keyed by environment name
+	Environments map[string]*Environment `yaml:"environments"`
 
-// Helper method to load a file into a string array of lines.
-func FileToArray(file string) ([]string, error) {
+	// Ordered rules mapping branches or tags to environments, the first match wins
+	Routes []Route `yaml:"routes"`
 
-	// Open the git diff file. This file is in .gitignore so it won't be commited.
-	in_file, err := os.Open(file)
-	if err != nil {
-		panic("Failed to open: " + file)
-		log.Fatal(err)
-	}
+	// Glob of tags that release the dashboards, e.g. v*. Tag pipelines matching it render every dashboard and
+	// deploy them to the environment the tag routes to. Defaults to v*.
+	ReleaseTags string `yaml:"release_tags"`
 
-	defer in_file.Close()
+	// Prefix dashboard titles with the branch slug on non-default branches. Defaults to true.
+	BranchTitlePrefix *bool `yaml:"branch_title_prefix"`
 
-	// Read in the lines of file
-	var lines []string
-	scanner := bufio.NewScanner(in_file)
+	// Template for grafana folder titles, e.g. "{{project}} – {{branch}} ({{env}})". Defaults to the cleaned branch name.
+	FolderTitle string `yaml:"folder_title"`
 
-	// Add the next line to the array, trimming any new line character if it exists
-	for scanner.Scan() {
-		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\n"))
-	}
+	// Extra values available to title templates
+	TemplateVariables map[string]string `yaml:"template_variables"`
 
-	return lines, scanner.Err()
+	// How dashboards on the default branch are grouped into folders: branch (one folder) or project (one per project)
+	FolderMode string `yaml:"folder_mode"`
+
+	// Prefix for folder uids so repositories sharing a grafana don't collide, e.g. ${CI_PROJECT_PATH_SLUG}
+	Namespace string `yaml:"namespace"`
+
+	// Prefix of generated dashboard uids, counted in grafanas 40 character limit. May be empty. Defaults to uid-.
+	UIDPrefix *string `yaml:"uid_prefix"`
+
+	// Committed file mapping dashboard sources to fixed uids, e.g. uids.yaml, so every environment uses the same uid.
+	// New dashboards are added when they are first rendered. Off when empty.
+	UIDManifest string `yaml:"uid_manifest"`
+
+	// Globs of dashboard sources deployed to grafanas root General folder on the default branch
+	GeneralFolder []string `yaml:"general_folder"`
+
+	// Title of a folder to create the default branch folders in, created if missing. Needs grafana 11 nested folders.
+	ParentFolder string `yaml:"parent_folder"`
+
+	// Title of a folder to create branch preview folders in, e.g. "CI Previews". Defaults to parent_folder.
+	PreviewParentFolder string `yaml:"preview_parent_folder"`
+
+	// Monitoring mixins whose dashboards are deployed alongside the repositories own
+	Mixins []Mixin `yaml:"mixins"`
+
+	// Directory of playlist definitions. Defaults to playlists.
+	Playlists string `yaml:"playlists"`
+
+	// Directory of per environment json patches applied to rendered dashboards. Defaults to patches.
+	Patches string `yaml:"patches"`
+
+	// Directory of dashboard templates for go run build.go new dashboard. Defaults to templates.
+	Templates string `yaml:"templates"`
+
+	// jq expressions applied to every rendered dashboard, in order
+	Transforms []Transform `yaml:"transforms"`
+
+	// The only values ${NAME} placeholders in dashboards may be replaced with. Values can reference environment variables.
+	Interpolate map[string]string `yaml:"interpolate"`
+
+	// Checks run over rendered dashboards by the validate command
+	Policies Policies `yaml:"policies"`
+
+	// Grafana teams to create, with members synced from gitlab groups
+	Teams []Team `yaml:"teams"`
+
+	// Team permissions applied to every folder the pipeline deploys into
+	FolderPermissions []FolderPermission `yaml:"folder_permissions"`
+
+	// Commands and webhooks run before rendering, after rendering and after deploying
+	Hooks Hooks `yaml:"hooks"`
+
+	// Webhook told the outcome of every deploy, for deployment tracking and other downstream automation
+	CompletionWebhook *CompletionWebhook `yaml:"completion_webhook"`
 }
 
-// Helper function to compute the md5 of a string
-func GetMD5Hash(text string) string {
-	hasher := md5.New()
-	hasher.Write([]byte(text))
-	return hex.EncodeToString(hasher.Sum(nil))
+// Where to post the outcome of a deploy. The url may reference environment variables.
+// Secret names a variable holding a key to sign the payload with, sent as X-Signature-256: sha256=<hex hmac>.
+type CompletionWebhook struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
 }
 
-// Render a dashboard into the dist folder
-func Render(dashboard string, branch string) bool {
+// Site specific checks and notifications, run in order at each point of a deploy
+type Hooks struct {
+	PreRender  []Hook `yaml:"pre_render"`
+	PostRender []Hook `yaml:"post_render"`
+	PostDeploy []Hook `yaml:"post_deploy"`
+}
 
-	dashboard_name_split := strings.Split(dashboard, "/")
-	project_name := dashboard_name_split[1]
-	dashboard_name := dashboard_name_split[len(dashboard_name_split)-1]
+// A command run with sh -c, or a url posted to. Either way it receives a HookContext as json, on stdin for commands.
+// A failing hook fails the run unless AllowFailure is set.
+type Hook struct {
+	Command      string `yaml:"command"`
+	URL          string `yaml:"url"`
+	AllowFailure bool   `yaml:"allow_failure"`
+}
 
-	// Generate a dashboard uid based on filename
-	// Need to respect grafanas 40 char uid length limit
-	// Include an element of chars unique to the branchname via md5
-	ComputeMd5 := GetMD5Hash(strings.Replace(branch, "/", "", -1))[0:7]
-	dashboard_uid := "uid-" + ComputeMd5 + strings.Replace(dashboard_name, ".json", "", -1)
-	if len(dashboard_uid) >= 40 {
-		dashboard_uid = dashboard_uid[0:39]
-	}
+// Policy settings. Severities are error, warn or off.
+type Policies struct {
+	// Datasources referenced by literal uid or name instead of through a template variable. Defaults to off.
+	HardcodedDatasources string `yaml:"hardcoded_datasources"`
 
-	// If the dashboard file no longer exists for some reason then skip
-	if _, err := os.Stat(dashboard); errors.Is(err, os.ErrNotExist) {
-		fmt.Println("Dashboard file doesnt exist, skipping")
-		return false
-	}
+	// The template variable datasources should be referenced through. Defaults to datasource.
+	DatasourceVariable string `yaml:"datasource_variable"`
 
-	// Ensure a subfolder exists for the project
-	os.Mkdir("dist/"+project_name, 0755)
+	// Naming conventions for dashboard titles and tags
+	Naming []NamingRule `yaml:"naming"`
 
-	// Render dashboards built with jsonnet
-	if strings.HasSuffix(dashboard_name, "jsonnet") {
+	// Directory of rego policies in package grafana. Defaults to policies.
+	Rego string `yaml:"rego"`
+}
 
-		fmt.Println("Rendering jsonnet: " + dashboard_name)
+// A naming convention. Every condition set must hold for dashboards in Projects, or every dashboard if none are listed.
+type NamingRule struct {
+	Name           string   `yaml:"name"`
+	Projects       []string `yaml:"projects"`
+	TitlePattern   string   `yaml:"title_pattern"`
+	TitlePrefix    string   `yaml:"title_prefix"`
+	MaxTitleLength int      `yaml:"max_title_length"`
+	RequiredTags   []string `yaml:"required_tags"`
 
-		cmd := exec.Command("jsonnet", "-J", "vendor", dashboard, "--ext-str", "uid="+dashboard_uid)
+	// error or warn. Defaults to error.
+	Severity string `yaml:"severity"`
 
-		// Create the json file in the dist folder (dashboard is a string of the jsonnet file)
-		outfile, err := os.Create("dist/" + project_name + "/" + dashboard_name[:len(dashboard_name)-3])
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Compiled by LoadConfig
+	title_pattern *regexp.Regexp
+}
 
-		fmt.Println(cmd.String())
+// A jq expression applied to rendered dashboards, e.g. .refresh = "1m".
+// It can be limited to some projects or environments, otherwise it applies everywhere.
+type Transform struct {
+	Expression   string   `yaml:"expression"`
+	Projects     []string `yaml:"projects"`
+	Environments []string `yaml:"environments"`
 
-		cmd.Stdout = outfile
+	// Compiled by LoadConfig
+	code *gojq.Code
+}
 
-		if err := cmd.Run(); err != nil {
-			log.Fatal(err)
-		}
+// A grafana team. Members of GitLabGroup (by username) are synced into it, along with any extra Members listed.
+type Team struct {
+	Name        string   `yaml:"name"`
+	GitLabGroup string   `yaml:"gitlab_group"`
+	Members     []string `yaml:"members"`
+}
 
-	}
+// A teams permission on a folder: view, edit or admin
+type FolderPermission struct {
+	Team       string `yaml:"team"`
+	Permission string `yaml:"permission"`
+}
 
-	// Render dashboards built with json
-	if strings.HasSuffix(dashboard_name, "json") {
+// Grafana's numeric permission levels
+var permission_levels = map[string]int{"view": 1, "edit": 2, "admin": 4}
 
-		fmt.Println("Rendering json: " + dashboard_name)
+// An upstream style monitoring mixin, a mixin.libsonnet producing grafanaDashboards, prometheusRules and prometheusAlerts.
+// Its dashboards are rendered as the project Name, with Config merged into the mixins _config.
+type Mixin struct {
+	Name   string                 `yaml:"name"`
+	Path   string                 `yaml:"path"`
+	Config map[string]interface{} `yaml:"config"`
 
-		// Check if the dashboard already has an id defined
-		jsonfile, err := os.Open(dashboard)
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Config overrides for individual environments, keyed by environment name
+	EnvironmentConfig map[string]map[string]interface{} `yaml:"environment_config"`
+}
 
-		// Defer the closing of our jsonFile so that we can parse it later on
-		defer jsonfile.Close()
+// A grafana server dashboards can be deployed to.
+// The url may reference environment variables, e.g. url: ${GRAFANA_SERVER_PROD}
+type Environment struct {
+	Name        string      `yaml:"-"`
+	URL         string      `yaml:"url"`
+	URLs        []string    `yaml:"urls"`
+	Credentials Credentials `yaml:"credentials"`
 
-		// Read our opened jsonfile as a byte array then parse the content.
-		bytes, _ := ioutil.ReadAll(jsonfile)
-		var parsed_dashboard map[string]interface{}
-		json.Unmarshal([]byte(bytes), &parsed_dashboard)
+	// Protected environments need --confirm <name> or GRAFANA_CONFIRM=<name> before deploying
+	Protected bool `yaml:"protected"`
 
-		// Update dashboads uid to prevent clashes
-		parsed_dashboard["uid"] = dashboard_uid
+	// Default values for named template variables, applied while rendering
+	Variables map[string]string `yaml:"variables"`
 
-		fmt.Println(parsed_dashboard["uid"])
+	// Where recording and alerting rules rendered alongside the dashboards are deployed, if anywhere
+	Rules *RulerConfig `yaml:"rules"`
 
-		// To create a new dashboard we need to ensure the id is set to null
-		parsed_dashboard["id"] = nil
+	// Extra headers sent with every grafana request, e.g. for an access proxy in front of grafana.
+	// Values may reference environment variables, e.g. CF-Access-Client-Secret: ${CF_ACCESS_CLIENT_SECRET}
+	Headers map[string]string `yaml:"headers"`
 
-		// Write the file out to directory
-		out_file, _ := json.MarshalIndent(parsed_dashboard, "", "   ")
-		_ = ioutil.WriteFile("dist/"+project_name+"/"+dashboard_name, out_file, 0644)
-	}
+	// Resolved by ResolveCredentials at startup
+	token    string
+	user     string
+	password string
+}
 
-	fmt.Println("Rendered: " + dashboard_name)
-	return true
+// Names of the environment variables holding an environments credentials.
+// When nothing is declared GRAFANA_TOKEN_<ENV>, then GRAFANA_USER_<ENV> and GRAFANA_PASSWORD_<ENV>,
+// then the shared GRAFANA_USER and GRAFANA_PASSWORD are tried in that order.
+type Credentials struct {
+	Token    string `yaml:"token"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+
+	// Program that prints the credentials instead, run as "<helper> get <environment>", e.g. ./bin/vault-grafana-creds
+	Helper string `yaml:"helper"`
+
+	// Cloud secrets holding the credentials instead, read with the cloud sdks using the jobs own credentials or its gitlab id token.
+	// The secret is json like a helpers output, or a plain token.
+	// e.g. arn:aws:secretsmanager:eu-west-1:123456789012:secret:grafana-prod or projects/ops/secrets/grafana-prod
+	AWSSecret string `yaml:"aws_secret"`
+	GCPSecret string `yaml:"gcp_secret"`
+
+	// Files holding the credentials instead, e.g. kubernetes secrets mounted into the runner. Either a token or a user and password.
+	TokenFile    string `yaml:"token_file"`
+	UserFile     string `yaml:"user_file"`
+	PasswordFile string `yaml:"password_file"`
 }
 
-// Find the changed files in a branch and renders them
-// Returns true based on if a dashboard was rendered or not
-func RenderChanged(branch string) bool {
+// Credentials as a helper prints them on stdout, e.g. {"token": "..."} or {"user": "...", "password": "..."}
+type CredentialValues struct {
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
 
-	fmt.Println("Rendering changed dashboards")
+// A Prometheus compatible ruler to deploy rule groups to.
+// Mimir and Cortex rulers receive each group over their api. Prometheus can't, so rule files are copied into
+// Directory (e.g. a shared volume) and ReloadURL is posted to make it pick them up.
+type RulerConfig struct {
+	Type      string `yaml:"type"`
+	URL       string `yaml:"url"`
+	Tenant    string `yaml:"tenant"`
+	Directory string `yaml:"directory"`
+	ReloadURL string `yaml:"reload_url"`
 
-	// Convert the git-diff file to an array
-	changed, err := FileToArray("git-diff")
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Name of the environment variable holding a bearer token for the ruler, if it needs one
+	Token string `yaml:"token"`
+}
 
-	// Print the array of changed files
-	fmt.Println("Changed Files: ")
-	fmt.Println(changed)
+// A routing rule. Branch and Tag are regular expressions, a rule with neither matches everything.
+type Route struct {
+	Branch      string `yaml:"branch"`
+	Tag         string `yaml:"tag"`
+	Environment string `yaml:"environment"`
+}
 
-	files_to_deploy := false
+// The loaded pipeline configuration
+var config Config
 
-	for _, file := range changed {
+// The environment selected for this run, used for credentials on every grafana request
+var environment *Environment
 
-		// If the changed file is in the dashboards directory
-		if strings.HasPrefix(file, "dashboards") {
+// Helper method to load the pipeline config, falling back to defaults when the file doesn't exist
+func LoadConfig(file string) (Config, error) {
 
-			// Render the dashboard file
-			Render(file, branch)
+	loaded := Config{}
 
-			files_to_deploy = true
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return loaded, err
+	}
+
+	if err == nil {
+		Info("Loading config: " + file)
+		if err := yaml.Unmarshal(bytes, &loaded); err != nil {
+			return loaded, errors.New("Failed to parse " + file + ": " + err.Error())
 		}
 	}
 
-	return files_to_deploy
-}
+	// Dashboards live in the dashboards directory unless configured otherwise
+	if len(loaded.Sources) == 0 {
+		loaded.Sources = []string{"dashboards"}
+	}
 
-// Helper method for printing httprequest debug data
-func debug(data []byte, err error) {
-	if err == nil {
-		fmt.Printf("%s\n\n", data)
-	} else {
-		log.Fatalf("%s\n\n", err)
+	if loaded.ReleaseTags == "" {
+		loaded.ReleaseTags = "v*"
 	}
-}
 
-// Helper method to do all the api requests to grafana
-func DoPOST(url string, payload string) {
+	if loaded.Playlists == "" {
+		loaded.Playlists = "playlists"
+	}
 
-	// Retrieve authentication details from pipeline
-	GRAFANA_USER, ok := os.LookupEnv("GRAFANA_USER")
-	if !ok {
-		panic("GRAFANA_USER env not set")
+	if loaded.Patches == "" {
+		loaded.Patches = "patches"
 	}
-	GRAFANA_PASSWORD, ok := os.LookupEnv("GRAFANA_PASSWORD")
-	if !ok {
-		panic("GRAFANA_PASSWORD env not set")
+
+	if loaded.Templates == "" {
+		loaded.Templates = "templates"
 	}
 
-	body := strings.NewReader(payload)
+	if loaded.Policies.HardcodedDatasources == "" {
+		loaded.Policies.HardcodedDatasources = "off"
+	}
+	if loaded.Policies.DatasourceVariable == "" {
+		loaded.Policies.DatasourceVariable = "datasource"
+	}
+	if loaded.Policies.Rego == "" {
+		loaded.Policies.Rego = "policies"
+	}
+	if !contains([]string{"error", "warn", "off"}, loaded.Policies.HardcodedDatasources) {
+		return loaded, errors.New("Unknown hardcoded_datasources severity " + loaded.Policies.HardcodedDatasources + ", expected error, warn or off")
+	}
 
-	var response_body []byte
-	var response *http.Response
-	var request *http.Request
+	for i, rule := range loaded.Policies.Naming {
+		if rule.Name == "" {
+			return loaded, errors.New("Naming rules need a name")
+		}
+		if rule.Severity == "" {
+			loaded.Policies.Naming[i].Severity = "error"
+		} else if rule.Severity != "error" && rule.Severity != "warn" {
+			return loaded, errors.New("Unknown severity for naming rule " + rule.Name + ": " + rule.Severity)
+		}
+		if rule.TitlePattern != "" {
+			pattern, err := regexp.Compile(rule.TitlePattern)
+			if err != nil {
+				return loaded, errors.New("Invalid title_pattern for naming rule " + rule.Name + ": " + err.Error())
+			}
+			loaded.Policies.Naming[i].title_pattern = pattern
+		}
+	}
 
-	request, err := http.NewRequest("POST", url, body)
+	// Without configured environments project branches go to test and everything else to dev
+	if len(loaded.Environments) == 0 {
+		loaded.Environments = map[string]*Environment{
+			"dev": {URL: "${GRAFANA_SERVER_DEV}"},
+			"tst": {URL: "${GRAFANA_SERVER_TEST}"},
+		}
+		loaded.Routes = []Route{
+			{Branch: "project/", Environment: "tst"},
+			{Environment: "dev"},
+		}
+	}
 
-	if err == nil {
+	for name, env := range loaded.Environments {
+		env.Name = name
 
-		request.Header.Add("Content-Type", "application/json")
-		request.SetBasicAuth(os.ExpandEnv(GRAFANA_USER), os.ExpandEnv(GRAFANA_PASSWORD))
+		if env.Rules != nil {
+			switch env.Rules.Type {
+			case "":
+				env.Rules.Type = "mimir"
+			case "mimir", "cortex", "prometheus":
+			default:
+				return loaded, errors.New("Unknown rules type for " + name + ": " + env.Rules.Type)
+			}
+		}
+	}
 
-		// Uncomment this to debug requests
-		//debug(httputil.DumpRequestOut(request, true))
+	if loaded.FolderMode != "" && loaded.FolderMode != "branch" && loaded.FolderMode != "project" {
+		return loaded, errors.New("Unknown folder_mode: " + loaded.FolderMode)
+	}
 
-		response, err = (&http.Client{}).Do(request)
+	for _, route := range loaded.Routes {
+		if _, ok := loaded.Environments[route.Environment]; !ok {
+			return loaded, errors.New("Route refers to unknown environment: " + route.Environment)
+		}
+		for _, expression := range []string{route.Branch, route.Tag} {
+			if _, err := regexp.Compile(expression); err != nil {
+				return loaded, errors.New("Invalid route expression " + expression + ": " + err.Error())
+			}
+		}
 	}
 
-	if err == nil {
+	teams := map[string]bool{}
+	for _, team := range loaded.Teams {
+		teams[team.Name] = true
+	}
+	for _, permission := range loaded.FolderPermissions {
+		if !teams[permission.Team] {
+			return loaded, errors.New("Folder permission refers to unknown team: " + permission.Team)
+		}
+		if _, ok := permission_levels[permission.Permission]; !ok {
+			return loaded, errors.New("Unknown folder permission " + permission.Permission + ", expected view, edit or admin")
+		}
+	}
 
-		defer response.Body.Close()
+	for i, transform := range loaded.Transforms {
+		query, err := gojq.Parse(transform.Expression)
+		if err != nil {
+			return loaded, errors.New("Invalid transform " + transform.Expression + ": " + err.Error())
+		}
+		code, err := gojq.Compile(query)
+		if err != nil {
+			return loaded, errors.New("Invalid transform " + transform.Expression + ": " + err.Error())
+		}
+		loaded.Transforms[i].code = code
+	}
 
-		// Uncomment this to debug responses
-		debug(httputil.DumpResponse(response, true))
+	for _, mixin := range loaded.Mixins {
+		if mixin.Name == "" || mixin.Path == "" {
+			return loaded, errors.New("Mixins need both a name and a path")
+		}
+	}
 
-		response_body, err = ioutil.ReadAll(response.Body)
+	for _, source := range loaded.Sources {
+		if _, err := path.Match(source, ""); err != nil {
+			return loaded, errors.New("Invalid source pattern " + source + ": " + err.Error())
+		}
 	}
 
-	if err == nil {
-		fmt.Printf("%s", response_body)
-	} else {
-		log.Fatalf("ERROR: %s", err)
+	if err := LoadUIDManifest(loaded.UIDManifest); err != nil {
+		return loaded, err
 	}
+
+	return loaded, nil
 }
 
-// Post to create a grafana folder for the dashboards
-func CreateGrafanaFolder(folder_uid string, folder_name string, grafana_server string) {
+// Fixed uids from the uid manifest, keyed by dashboard source
+var uid_manifest = map[string]string{}
 
-	fmt.Println("Creating grafana folder: " + folder_name + ", uid: " + folder_uid)
+// Whether rendering added dashboards to the uid manifest that still need writing out
+var uid_manifest_changed = false
 
-	payload := `{"uid": "` + folder_uid + `", "title": "` + folder_name + `", "overwrite": true}`
-	//fmt.Println(payload) // Uncomment to debug payload
+// Helper method to load the uid manifest, starting empty when it doesn't exist yet
+func LoadUIDManifest(file string) error {
 
-	if grafana_server == "tst" {
-		// test
-    DoPOST("${GRAFANA_SERVER_TEST}/api/folders", payload)
-	} else {
-		// dev
-		DoPOST("${GRAFANA_SERVER_DEV}/api/folders", payload)
+	uid_manifest = map[string]string{}
+	if file == "" {
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(bytes, &uid_manifest); err != nil {
+		return errors.New("Failed to parse " + file + ": " + err.Error())
+	}
+	if uid_manifest == nil {
+		uid_manifest = map[string]string{}
 	}
+
+	return nil
 }
 
-// Deploy an individual dashboard to a given folder on given grafana server
-func DeployDashboard(dashboard string, folder_uid string, grafana_server string) {
+// Helper method to write the uid manifest back out if rendering added dashboards to it
+func SaveUIDManifest() error {
 
-	fmt.Println("Deploying: " + dashboard)
+	if config.UIDManifest == "" || !uid_manifest_changed {
+		return nil
+	}
 
-	dashboard_command, err := exec.Command("jq", "-c", ".", dashboard).Output()
+	// yaml sorts the keys, so the file diffs cleanly
+	bytes, err := yaml.Marshal(uid_manifest)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := ioutil.WriteFile(config.UIDManifest, bytes, 0644); err != nil {
+		return err
 	}
 
-	dashboard_string := strings.TrimSuffix(string(dashboard_command), "\n")
+	fmt.Println("WARNING: new dashboards were added to " + config.UIDManifest + ", commit it so their uids stay fixed")
+	uid_manifest_changed = false
+	return nil
+}
 
-	payload := `{"dashboard": ` + dashboard_string + `, "folderUid": "` + folder_uid + `", "overwrite": true}`
-	//fmt.Println(payload) // Uncomment to debug payloads
+// Helper method to find the configured source root a file lives under.
+// Returns the matched root and the path of the file relative to it.
+func MatchSource(file string) (string, string, bool) {
 
-	if grafana_server == "ses" {
-		// test
-		DoPOST("${GRAFANA_SERVER_TEST}/api/dashboards/db", payload)
+	file_segments := strings.Split(file, "/")
 
-	} else {
-		// dev
-		DoPOST("${GRAFANA_SERVER_DEV}/api/dashboards/db", payload)
-	}
-}
+	for _, source := range config.Sources {
 
-// Helper recursive method to go through generated dashboards and deploy each one
-func DeployAllDashboards(path string, folder_uid string, grafana_server string) {
+		source_segments := strings.Split(strings.Trim(source, "/"), "/")
 
-	fmt.Println("Deploying Dashboards")
+		// The file must sit below the root, not be the root itself
+		if len(file_segments) <= len(source_segments) {
+			continue
+		}
 
-	// Loop over each file in path
-	items, _ := ioutil.ReadDir(path)
-	for _, item := range items {
+		root := strings.Join(file_segments[:len(source_segments)], "/")
+		if matched, _ := path.Match(strings.Join(source_segments, "/"), root); matched {
+			return root, strings.Join(file_segments[len(source_segments):], "/"), true
+		}
+	}
 
-		if item.IsDir() && !strings.Contains(item.Name(), "rlt") {
+	return "", "", false
+}
 
-			// If the item is a directory and does not relate to realtime drill down to that level
-			DeployAllDashboards(path+"/"+item.Name(), folder_uid, grafana_server)
+// Helper method to check if a changed file is a dashboard source.
+// Overlays live alongside the sources but are only ever applied to their base dashboard.
+func IsDashboardSource(file string) bool {
+	_, _, ok := MatchSource(file)
+	return ok && !IsOverlay(file) && !IsProjectTooling(file)
+}
 
-		} else {
+// Libraries, jsonnet-bundler manifests and the libraries they vendor can sit in a project directory but aren't dashboards
+func IsProjectTooling(file string) bool {
+	name := path.Base(file)
+	return strings.HasSuffix(name, ".libsonnet") || name == "jsonnetfile.json" || name == "jsonnetfile.lock.json" ||
+		strings.Contains("/"+file, "/vendor/")
+}
 
-			// Otherwise if it's an ordinary dashboard file deploy it
-			DeployDashboard(path+"/"+item.Name(), folder_uid, grafana_server)
+// Helper method to build the jsonnet -J arguments for a source. A project with its own jsonnetfile.json vendors
+// its libraries next to it, and those win over the repositories vendor directory (the right-most -J wins).
+func JsonnetPathArgs(file string) []string {
+
+	args := []string{"-J", "vendor"}
+
+	root, relative, ok := MatchSource(file)
+	if ok && strings.Contains(relative, "/") {
+		project_vendor := root + "/" + relative[:strings.Index(relative, "/")] + "/vendor"
+		if info, err := os.Stat(project_vendor); err == nil && info.IsDir() {
+			args = append(args, "-J", project_vendor)
 		}
 	}
+
+	return args
 }
 
-func main() {
+// Helper method to work out which project a dashboard belongs to.
+// This is the first directory below the source root, or for dashboards directly in a root
+// the last wildcard segment of the root (e.g. payments for teams/payments/grafana).
+func DashboardProject(file string) string {
 
-	fmt.Println("Pipeline build script started")
+	root, relative, _ := MatchSource(file)
 
-	// Command Line Flags
-	// These are pointers, not the actual values. Access by using *varname.
-	projectPointer := flag.String("project", "", "Set project name for long lived branches.")
-	deployPointer := flag.Bool("deploy", false, "Turn on flag to deploy rendered dashboards to grafana.")
-  
-	// Parse Command Line flags
-	flag.Parse()
+	if strings.Contains(relative, "/") {
+		return relative[:strings.Index(relative, "/")]
+	}
 
-	// Retrieve branch name from environment
-	branch, ok := os.LookupEnv("CI_COMMIT_BRANCH")
-	if !ok {
-		panic("CI_COMMIT_BRANCH env not set")
+	root_segments := strings.Split(root, "/")
+	for _, source := range config.Sources {
+
+		source_segments := strings.Split(strings.Trim(source, "/"), "/")
+		if len(source_segments) != len(root_segments) {
+			continue
+		}
+
+		if matched, _ := path.Match(strings.Join(source_segments, "/"), root); !matched {
+			continue
+		}
+
+		for i := len(source_segments) - 1; i >= 0; i-- {
+			if strings.ContainsAny(source_segments[i], "*?[") {
+				return root_segments[i]
+			}
+		}
 	}
 
-	// Create folder to render Dashboards to. This folder is in .gitignore so it won't be commited.
-	fmt.Println("Creating dist Folder")
-	os.Mkdir("dist/", 0755)
+	return root_segments[len(root_segments)-1]
+}
 
-	// If we are doing a deployment
-	if *deployPointer {
+// A repeatable command line flag, values may also be comma separated
+type stringList []string
 
-		fmt.Println("Running grafana deploy")
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
 
-		if *projectPointer == "" {
-			panic("Project has not been specified. This should be set by pipeline.")
+func (list *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item != "" {
+			*list = append(*list, item)
 		}
+	}
+	return nil
+}
 
-		// Clean the branch name to remove slashes
-		clean_branch := strings.Replace(branch, "/", "", -1)
-		fmt.Println("Project: " + clean_branch)
+// Helper method to match a slash separated path against a glob.
+// Supports the usual path.Match syntax per segment plus ** to match any number of directories.
+func MatchGlob(pattern string, file string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
 
-		// Identify any files that have changed
-		files_to_deploy := RenderChanged(clean_branch)
+func matchSegments(pattern []string, file []string) bool {
 
-		// If renderchanged returned true, then there are dashboards to deploy
-		if files_to_deploy {
+	for len(pattern) > 0 {
 
-			// We base our grafana folder uid on the branch name limited to 40 chars.
-			// Grafana has a limit of 40 characters for folder uids
-			folder_uid := clean_branch
-			if len(clean_branch) >= 40 {
-				folder_uid = clean_branch[0:39]
+		if pattern[0] == "**" {
+			// Try every possible number of directories for the ** segment
+			for i := 0; i <= len(file); i++ {
+				if matchSegments(pattern[1:], file[i:]) {
+					return true
+				}
 			}
+			return false
+		}
+
+		if len(file) == 0 {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern[0], file[0]); !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		file = file[1:]
+	}
+
+	return len(file) == 0
+}
+
+// Helper method to keep only the changes selected by the --only and --exclude globs.
+// A directory pattern without globs also selects everything below it.
+func FilterChanges(changed []FileChange, only []string, exclude []string) []FileChange {
 
-			// Identify the grafana server based on branch
-			grafana_server := SelectGrafanaServer(branch)
+	matches := func(patterns []string, file string) bool {
+		for _, pattern := range patterns {
+			pattern = strings.TrimSuffix(pattern, "/")
+			if MatchGlob(pattern, file) || MatchGlob(pattern+"/**", file) {
+				return true
+			}
+		}
+		return false
+	}
 
-			// Create a folder on that server for the dashboards
-			CreateGrafanaFolder(folder_uid, clean_branch, grafana_server)
+	var filtered []FileChange
+	for _, change := range changed {
 
-			// Deploy the dashboards to that folder
-			DeployAllDashboards("dist", folder_uid, grafana_server)
+		if len(only) > 0 && !matches(only, change.Path) {
+			continue
+		}
 
-			// Report success
-			fmt.Println(" ")
-			fmt.Println(" ")
-			fmt.Println("Dashboards deployed to " + grafana_server + "/grafana/dashboards/")
+		if matches(exclude, change.Path) {
+			Info("Excluded: " + change.Path)
+			continue
 		}
+
+		filtered = append(filtered, change)
 	}
+
+	return filtered
+}
+
+// Helper method to list every dashboard source in the repository as if it had been modified
+func ListDashboardSources() ([]FileChange, error) {
+
+	var sources []FileChange
+
+	err := filepath.WalkDir(".", func(file string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Never descend into git metadata
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		file = filepath.ToSlash(file)
+		if !entry.IsDir() && IsDashboardSource(file) && (strings.HasSuffix(file, ".json") || strings.HasSuffix(file, ".jsonnet") || IsRuleSource(file)) {
+			sources = append(sources, FileChange{Path: file, Status: "M"})
+		}
+
+		return nil
+	})
+
+	return sources, err
+}
+
+// Helper method to return environment depending on the branch or tag.
+// To be used by the main deploy script to choose which grafana server to target
+func SelectGrafanaServer(branch string, tag string) (*Environment, error) {
+
+	for _, route := range config.Routes {
+
+		// Tag rules only apply to tag pipelines and branch rules only to branch pipelines
+		if route.Tag != "" {
+			if tag != "" && regexp.MustCompile(route.Tag).MatchString(tag) {
+				return config.Environments[route.Environment], nil
+			}
+			continue
+		}
+
+		if tag != "" && route.Branch != "" {
+			continue
+		}
+
+		if regexp.MustCompile(route.Branch).MatchString(branch) {
+			return config.Environments[route.Environment], nil
+		}
+	}
+
+	return nil, errors.New("No route matches branch " + branch + " or tag " + tag)
+}
+
+// Helper method to build an environment variable name with an environment suffix, e.g. GRAFANA_TOKEN_PROD
+func EnvVarName(prefix string, env *Environment) string {
+	suffix := regexp.MustCompile("[^A-Z0-9]+").ReplaceAllString(strings.ToUpper(env.Name), "_")
+	return prefix + "_" + suffix
+}
+
+// Look up the credentials for an environment, returning an error that lists every missing variable
+func ResolveCredentials(env *Environment) error {
+
+	if err := CheckHeaders(env); err != nil {
+		return err
+	}
+
+	var missing []string
+
+	// Helper to look up a variable, recording it as missing when unset
+	lookup := func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	}
+
+	declared := env.Credentials
+
+	// A helper can fetch the credentials from any secret store
+	if declared.Helper != "" {
+		return RunCredentialHelper(env)
+	}
+	if declared.AWSSecret != "" && declared.GCPSecret != "" {
+		return errors.New("Environment " + env.Name + " must declare only one of aws_secret and gcp_secret")
+	}
+	if declared.AWSSecret != "" || declared.GCPSecret != "" {
+		return ReadCloudSecret(env)
+	}
+	if declared.TokenFile != "" || declared.UserFile != "" || declared.PasswordFile != "" {
+		return ReadCredentialFiles(env)
+	}
+
+	// Explicitly declared variables must all be present
+	if declared.Token != "" {
+		env.token = lookup(declared.Token)
+	} else if declared.User != "" || declared.Password != "" {
+		if declared.User == "" || declared.Password == "" {
+			return errors.New("Environment " + env.Name + " must declare both user and password credentials")
+		}
+		env.user = lookup(declared.User)
+		env.password = lookup(declared.Password)
+	} else {
+
+		// Otherwise try the conventional names in order of preference
+		token_var := EnvVarName("GRAFANA_TOKEN", env)
+		user_var := EnvVarName("GRAFANA_USER", env)
+		password_var := EnvVarName("GRAFANA_PASSWORD", env)
+
+		if token, ok := os.LookupEnv(token_var); ok && token != "" {
+			env.token = token
+		} else if os.Getenv(user_var) != "" || os.Getenv(password_var) != "" {
+			env.user = lookup(user_var)
+			env.password = lookup(password_var)
+		} else if os.Getenv("GRAFANA_USER") != "" || os.Getenv("GRAFANA_PASSWORD") != "" {
+			env.user = lookup("GRAFANA_USER")
+			env.password = lookup("GRAFANA_PASSWORD")
+		} else {
+			return errors.New("No credentials found for environment " + env.Name + ". Set " + token_var +
+				", or " + user_var + " and " + password_var + ", or GRAFANA_USER and GRAFANA_PASSWORD")
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New("Missing credentials for environment " + env.Name + ", variables not set: " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Check every variable an environments headers reference is set.
+// Headers for an access proxy are as much credentials as the token, so missing ones fail before anything is sent.
+func CheckHeaders(env *Environment) error {
+
+	for name, value := range env.Headers {
+
+		var missing []string
+		os.Expand(value, func(variable string) string {
+			value, ok := os.LookupEnv(variable)
+			if !ok || value == "" {
+				missing = append(missing, variable)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return errors.New("Missing header " + name + " for environment " + env.Name + ", variables not set: " + strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+// How long a credential helper gets to print the credentials
+const CredentialHelperTimeout = 30 * time.Second
+
+// Helper method to run an environments credential helper and use the credentials it prints.
+// Like git and docker credential helpers it is run with "get", followed here by the environment name.
+// Its stderr is passed through so helpers can explain what went wrong.
+func RunCredentialHelper(env *Environment) error {
+
+	args := strings.Fields(env.Credentials.Helper)
+	if len(args) == 0 {
+		return errors.New("Credential helper for environment " + env.Name + " is blank")
+	}
+
+	// A helper waiting on a prompt or a hung secret store would otherwise hold the job until gitlab times it out
+	ctx, cancel := context.WithTimeout(context.Background(), CredentialHelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], "get", env.Name)...)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("Credential helper for environment " + env.Name + " didn't finish within " + CredentialHelperTimeout.String())
+	}
+	if err != nil {
+		return errors.New("Credential helper for environment " + env.Name + " failed: " + err.Error())
+	}
+
+	var values CredentialValues
+	if err := json.Unmarshal(output, &values); err != nil {
+		return errors.New("Credential helper for environment " + env.Name + " didn't print credentials as json: " + err.Error())
+	}
+
+	return UseCredentials(env, values, "credential helper")
+}
+
+// How long reading a cloud secret gets, including exchanging the job's id token for cloud credentials
+const CloudSecretTimeout = time.Minute
+
+// Helper method to read an environments credentials from AWS Secrets Manager or GCP Secret Manager.
+// The secret holds the same json a credential helper prints, or just the token.
+func ReadCloudSecret(env *Environment) error {
+
+	declared := env.Credentials
+
+	ctx, cancel := context.WithTimeout(context.Background(), CloudSecretTimeout)
+	defer cancel()
+
+	var secret string
+	var source string
+	var err error
+
+	if declared.AWSSecret != "" {
+		source = "aws secret " + declared.AWSSecret
+		secret, err = ReadAWSSecret(ctx, declared.AWSSecret)
+	} else {
+		source = "gcp secret " + declared.GCPSecret
+		secret, err = ReadGCPSecret(ctx, declared.GCPSecret)
+	}
+	if err != nil {
+		return errors.New("Reading " + source + " for environment " + env.Name + " failed: " + err.Error())
+	}
+
+	// Anything that isn't json is the token itself
+	secret = strings.TrimSpace(secret)
+	var values CredentialValues
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		values = CredentialValues{Token: secret}
+	}
+
+	return UseCredentials(env, values, source)
+}
+
+// The id token gitlab gives a job, e.g. id_tokens: GITLAB_OIDC_TOKEN, handed to the cloud sdks as is
+type GitLabIDToken string
+
+// Satisfies the aws sdk's stscreds.IdentityTokenRetriever
+func (token GitLabIDToken) GetIdentityToken() ([]byte, error) {
+	return []byte(token), nil
+}
+
+// Satisfies the google oauth2 externalaccount.SubjectTokenSupplier
+func (token GitLabIDToken) SubjectToken(ctx context.Context, options externalaccount.SupplierOptions) (string, error) {
+	return string(token), nil
+}
+
+// Helper method to read a secret string from AWS Secrets Manager.
+// The sdk uses whatever credentials the job has. With AWS_ROLE_ARN set the gitlab id token in GITLAB_OIDC_TOKEN is
+// exchanged for the role's credentials, as the sdk would only read it from AWS_WEB_IDENTITY_TOKEN_FILE.
+func ReadAWSSecret(ctx context.Context, secret_id string) (string, error) {
+
+	var options []func(*awsconfig.LoadOptions) error
+
+	// The sdk builds its own client so AWS_CA_BUNDLE keeps working, which it can't add to ours.
+	// Recordings still need to see its requests.
+	if _, recording := http_client.Transport.(*Cassette); recording {
+		options = append(options, awsconfig.WithHTTPClient(http_client))
+	}
+
+	// An arn names its region, which may not be the jobs default
+	if parts := strings.Split(secret_id, ":"); len(parts) > 3 && parts[0] == "arn" {
+		options = append(options, awsconfig.WithRegion(parts[3]))
+	}
+
+	aws_config, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return "", err
+	}
+
+	if role := os.Getenv("AWS_ROLE_ARN"); role != "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") == "" && os.Getenv("GITLAB_OIDC_TOKEN") != "" {
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(aws_config), role, GitLabIDToken(os.Getenv("GITLAB_OIDC_TOKEN")), func(options *stscreds.WebIdentityRoleOptions) {
+			options.RoleSessionName = "grafana-pipeline-" + os.Getenv("CI_JOB_ID")
+		})
+		aws_config.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	output, err := secretsmanager.NewFromConfig(aws_config).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secret_id)})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString != nil {
+		return *output.SecretString, nil
+	}
+
+	return string(output.SecretBinary), nil
+}
+
+// Helper method to read a secret version from GCP Secret Manager, the latest unless the name includes a version.
+// With GCP_WORKLOAD_IDENTITY_PROVIDER set the gitlab id token in GITLAB_OIDC_TOKEN is exchanged for google credentials,
+// impersonating GCP_SERVICE_ACCOUNT when it is set. Otherwise the jobs application default credentials are used.
+func ReadGCPSecret(ctx context.Context, name string) (string, error) {
+
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	// The oauth2 package finds the shared client in the context, so token exchanges can be recorded and replayed too
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, http_client)
+	scope := "https://www.googleapis.com/auth/cloud-platform"
+
+	var tokens oauth2.TokenSource
+	if provider := os.Getenv("GCP_WORKLOAD_IDENTITY_PROVIDER"); provider != "" {
+
+		if os.Getenv("GITLAB_OIDC_TOKEN") == "" {
+			return "", errors.New("GCP_WORKLOAD_IDENTITY_PROVIDER is set but GITLAB_OIDC_TOKEN isn't, add it to the job's id_tokens")
+		}
+
+		federation := externalaccount.Config{
+			Audience:             "//iam.googleapis.com/" + strings.TrimPrefix(provider, "//iam.googleapis.com/"),
+			SubjectTokenType:     "urn:ietf:params:oauth:token-type:jwt",
+			TokenURL:             "https://sts.googleapis.com/v1/token",
+			Scopes:               []string{scope},
+			SubjectTokenSupplier: GitLabIDToken(os.Getenv("GITLAB_OIDC_TOKEN")),
+		}
+		if account := os.Getenv("GCP_SERVICE_ACCOUNT"); account != "" {
+			federation.ServiceAccountImpersonationURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + account + ":generateAccessToken"
+		}
+
+		var err error
+		tokens, err = externalaccount.NewTokenSource(ctx, federation)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		credentials, err := google.FindDefaultCredentials(ctx, scope)
+		if err != nil {
+			return "", err
+		}
+		tokens = credentials.TokenSource
+	}
+
+	token, err := tokens.Token()
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	token.SetAuthHeader(request)
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("secret manager returned " + response.Status + ": " + string(body))
+	}
+
+	var version struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		return "", errors.New("Unexpected secret manager response: " + err.Error())
+	}
+
+	return string(version.Payload.Data), nil
+}
+
+// Helper method to read an environments credentials from the files it declares
+func ReadCredentialFiles(env *Environment) error {
+
+	declared := env.Credentials
+
+	if declared.TokenFile == "" && (declared.UserFile == "" || declared.PasswordFile == "") {
+		return errors.New("Environment " + env.Name + " must declare token_file, or both user_file and password_file")
+	}
+
+	var values CredentialValues
+	for file, value := range map[string]*string{declared.TokenFile: &values.Token, declared.UserFile: &values.User, declared.PasswordFile: &values.Password} {
+		if file == "" {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.New("Reading credentials for environment " + env.Name + ": " + err.Error())
+		}
+		*value = strings.TrimSpace(string(bytes))
+	}
+
+	return UseCredentials(env, values, "credential files")
+}
+
+// Helper method to re-read an environments credential files, returning true if they now hold different credentials.
+// Mounted secrets are rotated in place, so a request rejected with the old credentials is worth retrying.
+func RefreshCredentialFiles(env *Environment) bool {
+
+	declared := env.Credentials
+	if declared.TokenFile == "" && declared.UserFile == "" && declared.PasswordFile == "" {
+		return false
+	}
+
+	token, user, password := env.token, env.user, env.password
+	if err := ReadCredentialFiles(env); err != nil {
+		fmt.Println("WARNING: " + err.Error())
+		env.token, env.user, env.password = token, user, password
+		return false
+	}
+
+	if env.token == token && env.user == user && env.password == password {
+		return false
+	}
+
+	Info("Credentials for environment " + env.Name + " changed on disk, retrying with the new ones")
+	return true
+}
+
+// Helper method to set an environments credentials, which must be a token or both a user and password
+func UseCredentials(env *Environment, values CredentialValues, source string) error {
+
+	if values.Token == "" && (values.User == "" || values.Password == "") {
+		return errors.New("The " + source + " for environment " + env.Name + " returned neither a token nor a user and password")
+	}
+
+	env.token = values.Token
+	env.user = values.User
+	env.password = values.Password
+
+	return nil
+}
+
+// Helper method to check a protected environment has been explicitly confirmed.
+// The confirmation can come from the --confirm flag or the GRAFANA_CONFIRM variable set by a manual job.
+func CheckConfirmation(env *Environment, confirm string) error {
+
+	if !env.Protected {
+		return nil
+	}
+
+	if confirm == "" {
+		confirm = os.Getenv("GRAFANA_CONFIRM")
+	}
+
+	if confirm != env.Name {
+		return errors.New("Environment " + env.Name + " is protected. Re-run with --confirm " + env.Name +
+			" or set GRAFANA_CONFIRM=" + env.Name + " to deploy")
+	}
+
+	Info("Deploy to protected environment " + env.Name + " confirmed")
+	return nil
+}
+
+// Helper method to return the base url of an environments grafana server
+func GrafanaURL(env *Environment) (string, error) {
+
+	url := strings.TrimSuffix(os.ExpandEnv(env.URL), "/")
+	if url == "" {
+		return "", errors.New("No grafana url set for environment " + env.Name + " (" + env.URL + ")")
+	}
+
+	return url, nil
+}
+
+// Helper method to return the base urls of every grafana server in an environment.
+// Environments with several servers that must stay in sync list the extra ones under urls.
+func GrafanaURLs(env *Environment) ([]string, error) {
+
+	var urls []string
+
+	if env.URL != "" || len(env.URLs) == 0 {
+		url, err := GrafanaURL(env)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	for _, configured := range env.URLs {
+		url := strings.TrimSuffix(os.ExpandEnv(configured), "/")
+		if url == "" {
+			return nil, errors.New("Empty grafana url set for environment " + env.Name + " (" + configured + ")")
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// The version of a grafana server, used to adapt api payloads
+type ServerVersion struct {
+	Version string
+	Major   int
+	Minor   int
+}
+
+// Versions of the grafana servers seen this run, keyed by server url
+var server_versions = map[string]ServerVersion{}
+
+// Helper method to parse a grafana version string such as 11.2.0 or 8.5.27-beta1
+func ParseServerVersion(version string) ServerVersion {
+
+	parsed := ServerVersion{Version: version}
+
+	parts := strings.SplitN(version, ".", 3)
+	parsed.Major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		parsed.Minor, _ = strconv.Atoi(parts[1])
+	}
+
+	return parsed
+}
+
+// Helper method to return the version of a grafana server, asking /api/health the first time
+func GetServerVersion(grafana_server string) ServerVersion {
+
+	if version, ok := server_versions[grafana_server]; ok {
+		return version
+	}
+
+	request, err := NewGrafanaRequest("GET", grafana_server+"/api/health", nil)
+	if err != nil {
+		Fatal(err)
+	}
+
+	var health struct {
+		Version string `json:"version"`
+	}
+
+	response, err := http_client.Do(request)
+	if err == nil {
+		json.NewDecoder(response.Body).Decode(&health)
+		response.Body.Close()
+	}
+
+	// Assume a current grafana when the version can't be determined
+	version := ParseServerVersion(health.Version)
+	if version.Major == 0 {
+		fmt.Println("WARNING: could not detect version of " + grafana_server + ", assuming a current release")
+		version.Major = 11
+	}
+
+	server_versions[grafana_server] = version
+	return version
+}
+
+// Grafana 8 and earlier identify folders by numeric id in dashboard and search apis
+func UsesFolderIDs(grafana_server string) bool {
+	return GetServerVersion(grafana_server).Major < 9
+}
+
+// Nested folders (parentUid) are generally available from grafana 11
+func SupportsNestedFolders(grafana_server string) bool {
+	return GetServerVersion(grafana_server).Major >= 11
+}
+
+// A grafana folder as returned by the folders api
+type GrafanaFolder struct {
+	ID        int    `json:"id"`
+	UID       string `json:"uid"`
+	Title     string `json:"title"`
+	Version   int    `json:"version"`
+	ParentUID string `json:"parentUid"`
+	URL       string `json:"url"`
+}
+
+// Folders looked up during the run, keyed by server then uid. Nil records a folder that doesn't exist.
+var folder_cache = map[string]map[string]*GrafanaFolder{}
+
+// Helper method to look up a folder by uid, only asking grafana the first time. Returns nil when there is no such folder.
+func LookupFolder(folder_uid string, grafana_server string) (*GrafanaFolder, error) {
+
+	if folder, ok := folder_cache[grafana_server][folder_uid]; ok {
+		return folder, nil
+	}
+
+	response, err := DoRequest("GET", grafana_server+"/api/folders/"+folder_uid, "")
+	if IsGrafanaStatus(err, http.StatusNotFound) {
+		CacheFolder(folder_uid, nil, grafana_server)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	folder := &GrafanaFolder{}
+	if err := json.Unmarshal(response, folder); err != nil {
+		return nil, errors.New("Unexpected folder response: " + err.Error())
+	}
+
+	CacheFolder(folder_uid, folder, grafana_server)
+	return folder, nil
+}
+
+// Helper method to record a folder after creating, renaming or deleting it, nil when it no longer exists
+func CacheFolder(folder_uid string, folder *GrafanaFolder, grafana_server string) {
+
+	if folder_cache[grafana_server] == nil {
+		folder_cache[grafana_server] = map[string]*GrafanaFolder{}
+	}
+
+	folder_cache[grafana_server][folder_uid] = folder
+}
+
+// Helper method to look up the numeric id of a folder from its uid
+func FolderID(folder_uid string, grafana_server string) (int, error) {
+
+	// The General folder is id 0
+	if folder_uid == "" {
+		return 0, nil
+	}
+
+	folder, err := LookupFolder(folder_uid, grafana_server)
+	if err != nil {
+		return 0, err
+	}
+	if folder == nil || folder.ID == 0 {
+		return 0, errors.New("Could not find id of folder " + folder_uid + " on " + grafana_server)
+	}
+
+	return folder.ID, nil
+}
+
+// Confirm a grafana server is up and accepts the environments credentials before doing any work
+func CheckServer(grafana_server string) error {
+
+	Info("Checking grafana server: " + grafana_server)
+
+	request, err := NewGrafanaRequest("GET", grafana_server+"/api/health", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return errors.New("Grafana server " + grafana_server + " is unreachable, check the url for environment " + environment.Name + ": " + err.Error())
+	}
+
+	var health struct {
+		Database string `json:"database"`
+		Version  string `json:"version"`
+	}
+	json.NewDecoder(response.Body).Decode(&health)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || health.Database != "ok" {
+		return errors.New("Grafana server " + grafana_server + " is unhealthy (" + response.Status + ", database " + health.Database + "), try again once it has recovered")
+	}
+
+	// Remember the version so payloads can be adapted without asking again
+	if version := ParseServerVersion(health.Version); version.Major > 0 {
+		server_versions[grafana_server] = version
+	}
+
+	// Any authenticated endpoint will do, the current org is the cheapest
+	request, err = NewGrafanaRequest("GET", grafana_server+"/api/org", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err = http_client.Do(request)
+	if err != nil {
+		return errors.New("Grafana server " + grafana_server + " is unreachable: " + err.Error())
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		Info("Grafana " + health.Version + " is healthy and credentials are valid")
+		return nil
+	case http.StatusUnauthorized:
+		return errors.New("Grafana server " + grafana_server + " rejected the credentials for environment " + environment.Name + ", check they are current")
+	case http.StatusForbidden:
+		return errors.New("Credentials for environment " + environment.Name + " are valid but lack permission on " + grafana_server + ", they need at least the Editor role")
+	default:
+		return errors.New("Unexpected " + response.Status + " checking credentials on " + grafana_server)
+	}
+}
+
+// Helper method to load a file into a string array of lines.
+func FileToArray(file string) ([]string, error) {
+
+	// Open the git diff file. This file is in .gitignore so it won't be commited.
+	in_file, err := os.Open(file)
+	if err != nil {
+		Fatalf("Failed to open %s: %v", file, err)
+	}
+
+	defer in_file.Close()
+
+	// Read in the lines of file
+	var lines []string
+	scanner := bufio.NewScanner(in_file)
+
+	// Add the next line to the array, trimming any new line character if it exists
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\n"))
+	}
+
+	return lines, scanner.Err()
+}
+
+// Helper function to compute the md5 of a string
+func GetMD5Hash(text string) string {
+	hasher := md5.New()
+	hasher.Write([]byte(text))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Generate a dashboard uid based on filename
+// Need to respect grafanas 40 char uid length limit
+// Include an element of chars unique to the branchname via md5
+func DashboardUID(dashboard_name string, branch string) string {
+
+	ComputeMd5 := GetMD5Hash(strings.Replace(branch, "/", "", -1))[0:7]
+	dashboard_uid := UIDPrefix() + ComputeMd5 + strings.Replace(dashboard_name, ".json", "", -1)
+
+	return ShortenUID(dashboard_uid)
+}
+
+// Helper method to return the configured prefix of generated dashboard uids
+func UIDPrefix() string {
+
+	if config.UIDPrefix == nil {
+		return "uid-"
+	}
+
+	return *config.UIDPrefix
+}
+
+// Grafanas uid length limit
+const MaxUIDLength = 40
+
+// Shorten a uid to fit grafanas limit.
+// Uids that already fit are returned unchanged. Longer ones keep a readable prefix and end with a hash
+// of the full uid, so two long names sharing a prefix no longer collide.
+func ShortenUID(uid string) string {
+
+	// The old truncation left uids of up to 39 characters alone, so those stay untouched and existing uids stay stable
+	if len(uid) < MaxUIDLength {
+		return uid
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte(uid))
+	suffix := "-" + hex.EncodeToString(hasher.Sum(nil))[0:10]
+
+	// Cut on a rune boundary so the prefix is never left with half a character
+	prefix := ""
+	for _, character := range uid {
+		if len(prefix)+len(string(character))+len(suffix) > MaxUIDLength {
+			break
+		}
+		prefix += string(character)
+	}
+
+	return prefix + suffix
+}
+
+// Render a dashboard into the dist folder
+func Render(dashboard string, branch string, out_dir string) bool {
+
+	dashboard_name_split := strings.Split(dashboard, "/")
+	project_name := DashboardProject(dashboard)
+	dashboard_name := dashboard_name_split[len(dashboard_name_split)-1]
+
+	// If the dashboard file no longer exists for some reason then skip
+	if _, err := os.Stat(dashboard); errors.Is(err, os.ErrNotExist) {
+		Info("Dashboard file doesnt exist, skipping")
+		return false
+	}
+
+	Emit(Event{Event: "render-start", Dashboard: dashboard})
+	started := time.Now()
+
+	metadata, err := LoadMetadata(dashboard)
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Dashboards can limit which environments they are deployed to
+	if len(metadata.Environments) > 0 && environment != nil && !contains(metadata.Environments, environment.Name) {
+		Info("Not rendering " + dashboard_name + ", it isn't deployed to " + environment.Name)
+		return false
+	}
+
+	// New dashboards join the uid manifest with the uid the default branch has always given them
+	if config.UIDManifest != "" && metadata.UID == "" && !IsRuleSource(dashboard_name) && uid_manifest[dashboard] == "" {
+		uid_manifest[dashboard] = DashboardUID(dashboard_name, DefaultBranch())
+		uid_manifest_changed = true
+	}
+
+	// A fixed uid keeps links to the canonical dashboard stable, previews still get their own
+	dashboard_uid := MetadataUID(dashboard, metadata, branch)
+
+	// Ensure a subfolder exists for the project
+	os.Mkdir(out_dir+"/"+project_name, 0755)
+
+	// Rule files are rendered next to the dashboards that depend on them
+	if IsRuleSource(dashboard_name) {
+		if err := RenderRules(dashboard, out_dir+"/"+project_name); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+		return true
+	}
+
+	// Render dashboards built with jsonnet
+	if strings.HasSuffix(dashboard_name, "jsonnet") {
+
+		Verbose("Rendering jsonnet: " + dashboard_name)
+
+		cmd := exec.Command("jsonnet", append(JsonnetPathArgs(dashboard), dashboard, "--ext-str", "uid="+dashboard_uid)...)
+		cmd.Stderr = os.Stderr
+
+		Verbose(cmd.String())
+
+		rendered, err := cmd.Output()
+		if err != nil {
+			Fatal(err)
+		}
+
+		var parsed_dashboard map[string]interface{}
+		if err := json.Unmarshal(rendered, &parsed_dashboard); err != nil {
+			Fatalf("ERROR: %s did not render to a json object: %s", dashboard, err)
+		}
+
+		// Create the json file in the dist folder (dashboard is a string of the jsonnet file)
+		WriteDashboard(parsed_dashboard, dashboard, metadata, branch, out_dir+"/"+project_name+"/"+dashboard_name[:len(dashboard_name)-3])
+	}
+
+	// Render dashboards built with json
+	if strings.HasSuffix(dashboard_name, "json") {
+
+		Verbose("Rendering json: " + dashboard_name)
+
+		// Check if the dashboard already has an id defined
+		jsonfile, err := os.Open(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		// Defer the closing of our jsonFile so that we can parse it later on
+		defer jsonfile.Close()
+
+		// Read our opened jsonfile as a byte array then parse the content.
+		bytes, _ := ioutil.ReadAll(jsonfile)
+		var parsed_dashboard map[string]interface{}
+		json.Unmarshal([]byte(bytes), &parsed_dashboard)
+
+		// Compose the environments overlays onto the base dashboard
+		parsed_dashboard, err = ApplyOverlays(parsed_dashboard, dashboard)
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		// Update dashboads uid to prevent clashes
+		parsed_dashboard["uid"] = dashboard_uid
+
+		Verbose(parsed_dashboard["uid"])
+
+		// To create a new dashboard we need to ensure the id is set to null
+		parsed_dashboard["id"] = nil
+
+		// Write the file out to directory
+		WriteDashboard(parsed_dashboard, dashboard, metadata, branch, out_dir+"/"+project_name+"/"+dashboard_name)
+	}
+
+	Info("Rendered: " + dashboard_name)
+	Emit(Event{Event: "render-done", Dashboard: dashboard})
+
+	row := SummaryRowFor(out_dir + "/" + project_name + "/" + strings.TrimSuffix(dashboard_name, "net"))
+	row.Rendered = true
+	row.Duration += time.Since(started)
+	return true
+}
+
+// Helper method to check if a file is an environment overlay for a json dashboard,
+// e.g. dashboards/payments/overlays/prod/api.json or dashboards/payments/overlays/prod/api.patch.json
+func IsOverlay(file string) bool {
+	return strings.Contains("/"+file, "/overlays/")
+}
+
+// Helper method to return the base dashboard an overlay applies to
+func OverlayBase(file string) string {
+
+	index := strings.LastIndex("/"+file, "/overlays/")
+	name := strings.TrimSuffix(strings.TrimSuffix(path.Base(file), ".json"), ".patch")
+
+	if index == 0 {
+		return name + ".json"
+	}
+	return file[:index-1] + "/" + name + ".json"
+}
+
+// Apply the selected environments overlays to a json dashboard.
+// overlays/<env>/<name>.json is strategically merged into the dashboard, then overlays/<env>/<name>.patch.json
+// is applied as an RFC 6902 json patch. Either may be missing.
+func ApplyOverlays(parsed_dashboard map[string]interface{}, dashboard string) (map[string]interface{}, error) {
+
+	if environment == nil {
+		return parsed_dashboard, nil
+	}
+
+	overlay_dir := path.Dir(dashboard) + "/overlays/" + environment.Name + "/"
+	name := strings.TrimSuffix(path.Base(dashboard), ".json")
+
+	if overlay, err := ioutil.ReadFile(overlay_dir + name + ".json"); err == nil {
+
+		Verbose("Merging overlay: " + overlay_dir + name + ".json")
+
+		var parsed_overlay map[string]interface{}
+		if err := json.Unmarshal(overlay, &parsed_overlay); err != nil {
+			return nil, errors.New(overlay_dir + name + ".json is not valid json: " + err.Error())
+		}
+		parsed_dashboard = StrategicMerge(parsed_dashboard, parsed_overlay).(map[string]interface{})
+
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if patch_file, err := ioutil.ReadFile(overlay_dir + name + ".patch.json"); err == nil {
+
+		Verbose("Applying patch overlay: " + overlay_dir + name + ".patch.json")
+
+		patch, err := jsonpatch.DecodePatch(patch_file)
+		if err != nil {
+			return nil, errors.New(overlay_dir + name + ".patch.json is not a valid json patch: " + err.Error())
+		}
+
+		document, _ := json.Marshal(parsed_dashboard)
+		patched, err := patch.Apply(document)
+		if err != nil {
+			return nil, errors.New(overlay_dir + name + ".patch.json doesn't apply to " + dashboard + ": " + err.Error())
+		}
+
+		parsed_dashboard = map[string]interface{}{}
+		json.Unmarshal(patched, &parsed_dashboard)
+
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return parsed_dashboard, nil
+}
+
+// Merge an overlay into a base value the way kustomize strategic merges do.
+// Objects merge recursively and a null removes a key. Lists of objects with an id (panels) or
+// name (template variables) merge item by item, appending new items. Any other value is replaced.
+func StrategicMerge(base interface{}, overlay interface{}) interface{} {
+
+	switch overlay_value := overlay.(type) {
+
+	case map[string]interface{}:
+		base_map, ok := base.(map[string]interface{})
+		if !ok {
+			return overlay
+		}
+
+		merged := map[string]interface{}{}
+		for key, value := range base_map {
+			merged[key] = value
+		}
+		for key, value := range overlay_value {
+			if value == nil {
+				delete(merged, key)
+			} else {
+				merged[key] = StrategicMerge(base_map[key], value)
+			}
+		}
+		return merged
+
+	case []interface{}:
+		base_list, ok := base.([]interface{})
+		if !ok {
+			return overlay
+		}
+
+		key := MergeKey(overlay_value)
+		if key == "" || MergeKey(base_list) != key {
+			return overlay
+		}
+
+		merged := append([]interface{}{}, base_list...)
+		for _, item := range overlay_value {
+
+			item_map := item.(map[string]interface{})
+			found := false
+			for i, base_item := range merged {
+				if base_item.(map[string]interface{})[key] == item_map[key] {
+					merged[i] = StrategicMerge(base_item, item)
+					found = true
+				}
+			}
+
+			if !found {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+
+	return overlay
+}
+
+// Helper method to find the key list items can be merged on, id or name, if every item is an object that has it
+func MergeKey(list []interface{}) string {
+
+	for _, key := range []string{"id", "name"} {
+
+		usable := len(list) > 0
+		for _, item := range list {
+			item_map, ok := item.(map[string]interface{})
+			if !ok || item_map[key] == nil {
+				usable = false
+				break
+			}
+		}
+
+		if usable {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// Run the configured jq transforms that apply to a rendered dashboard.
+// Each transform must produce exactly one object, which replaces the dashboard.
+func ApplyTransforms(parsed_dashboard map[string]interface{}, out_path string) (map[string]interface{}, error) {
+
+	// Rendered dashboards sit in a directory named after their project
+	project := path.Base(path.Dir(out_path))
+
+	for _, transform := range config.Transforms {
+
+		if len(transform.Projects) > 0 && !contains(transform.Projects, project) {
+			continue
+		}
+		if len(transform.Environments) > 0 && (environment == nil || !contains(transform.Environments, environment.Name)) {
+			continue
+		}
+
+		result, ok := transform.code.Run(parsed_dashboard).Next()
+		if !ok {
+			return nil, errors.New("Transform " + transform.Expression + " produced nothing for " + out_path)
+		}
+		if err, ok := result.(error); ok {
+			return nil, errors.New("Transform " + transform.Expression + " failed on " + out_path + ": " + err.Error())
+		}
+
+		transformed, ok := result.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Transform " + transform.Expression + " didn't produce an object for " + out_path)
+		}
+		parsed_dashboard = transformed
+	}
+
+	return parsed_dashboard, nil
+}
+
+// Helper method to return the json patch file for a rendered dashboard in the selected environment, or "" if it has none.
+// Patches are patches/<env>/<dashboard>.patch.json, or patches/<env>/<project>/<dashboard>.patch.json to patch
+// one of several dashboards with the same name in different projects.
+func EnvironmentPatchFile(out_path string) (string, error) {
+
+	patch_dir := config.Patches + "/" + environment.Name
+	name := strings.TrimSuffix(path.Base(out_path), ".json") + ".patch.json"
+
+	for _, patch_path := range []string{patch_dir + "/" + path.Base(path.Dir(out_path)) + "/" + name, patch_dir + "/" + name} {
+		_, err := os.Stat(patch_path)
+		if err == nil {
+			return patch_path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// Apply a dashboards environment patch to it, printing each operation applied.
+// A patch that doesn't apply cleanly is an error rather than being skipped.
+func ApplyEnvironmentPatch(parsed_dashboard map[string]interface{}, out_path string) (map[string]interface{}, error) {
+
+	if environment == nil {
+		return parsed_dashboard, nil
+	}
+
+	patch_path, err := EnvironmentPatchFile(out_path)
+	if err != nil || patch_path == "" {
+		return parsed_dashboard, err
+	}
+	patch_file, err := ioutil.ReadFile(patch_path)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := jsonpatch.DecodePatch(patch_file)
+	if err != nil {
+		return nil, errors.New(patch_path + " is not a valid json patch: " + err.Error())
+	}
+
+	document, _ := json.Marshal(parsed_dashboard)
+	patched, err := patch.Apply(document)
+	if err != nil {
+		return nil, errors.New(patch_path + " doesn't apply cleanly: " + err.Error())
+	}
+
+	Infof("Applied %s (%d operation(s)):\n", patch_path, len(patch))
+	for _, operation := range patch {
+		operation_path, _ := operation.Path()
+		Info("  " + operation.Kind() + " " + operation_path)
+	}
+
+	patched_dashboard := map[string]interface{}{}
+	if err := json.Unmarshal(patched, &patched_dashboard); err != nil {
+		return nil, errors.New(patch_path + " didn't leave a json object: " + err.Error())
+	}
+
+	return patched_dashboard, nil
+}
+
+// Check every patch for the selected environment belongs to a dashboard, so a renamed dashboard
+// doesn't silently lose its patch, and that a patch named only by dashboard matches just one.
+// Runs after rendering so mixin dashboards are known by name. Returns a description of each problem.
+func ValidateEnvironmentPatches(out_dir string) ([]string, error) {
+
+	patch_dir := config.Patches + "/" + environment.Name
+	if _, err := os.Stat(patch_dir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	// The projects rendering each dashboard name, whether or not they were rendered in this run
+	sources, err := ListDashboardSources()
+	if err != nil {
+		return nil, err
+	}
+
+	projects := map[string]map[string]bool{}
+	add := func(project string, name string) {
+		if projects[name] == nil {
+			projects[name] = map[string]bool{}
+		}
+		projects[name][project] = true
+	}
+	for _, source := range sources {
+		if !IsRuleSource(source.Path) {
+			add(DashboardProject(source.Path), strings.TrimSuffix(strings.TrimSuffix(path.Base(source.Path), ".jsonnet"), ".json"))
+		}
+	}
+
+	// Mixin dashboard names are only known once rendered
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dashboard := range dashboards {
+		add(path.Base(path.Dir(dashboard)), strings.TrimSuffix(path.Base(dashboard), ".json"))
+	}
+
+	// A mixin that wasn't rendered in this run can't be checked
+	unrendered := map[string]bool{}
+	for _, mixin := range config.Mixins {
+		if _, err := os.Stat(out_dir + "/" + mixin.Name); errors.Is(err, os.ErrNotExist) {
+			unrendered[mixin.Name] = true
+		}
+	}
+
+	var problems []string
+	err = filepath.WalkDir(patch_dir, func(file string, entry os.DirEntry, err error) error {
+
+		if err != nil || entry.IsDir() || !strings.HasSuffix(file, ".patch.json") {
+			return err
+		}
+
+		file = filepath.ToSlash(file)
+		relative := strings.TrimSuffix(strings.TrimPrefix(file, patch_dir+"/"), ".patch.json")
+
+		// A patch named only by dashboard applies in every project, so two projects sharing the name need it in a project directory
+		if !strings.Contains(relative, "/") {
+			var matched []string
+			for project := range projects[relative] {
+				matched = append(matched, project)
+			}
+			sort.Strings(matched)
+
+			switch {
+			case len(matched) > 1:
+				problems = append(problems, file+" matches "+relative+" in projects "+strings.Join(matched, ", ")+", move it to "+patch_dir+"/<project>/"+path.Base(file))
+			case len(matched) == 0 && len(unrendered) == 0:
+				problems = append(problems, file+" doesn't match any dashboard")
+			}
+			return nil
+		}
+
+		project := relative[:strings.Index(relative, "/")]
+		if !unrendered[project] && !projects[relative[len(project)+1:]][project] {
+			problems = append(problems, file+" doesn't match any dashboard")
+		}
+
+		return nil
+	})
+
+	return problems, err
+}
+
+// Helper method to check if a source file holds prometheus rules rather than a dashboard
+func IsRuleSource(file string) bool {
+	return strings.HasSuffix(file, ".rules.jsonnet") || strings.HasSuffix(file, ".rules.yaml") || strings.HasSuffix(file, ".rules.yml")
+}
+
+// Render a rule source into the project directory as <name>.rules.yaml.
+// Jsonnet rules are evaluated, yaml rules are copied as they are.
+func RenderRules(rules string, project_dir string) error {
+
+	name := filepath.Base(rules)
+	for _, suffix := range []string{".rules.jsonnet", ".rules.yaml", ".rules.yml"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	out_path := project_dir + "/" + name + ".rules.yaml"
+
+	Verbose("Rendering rules: " + rules)
+
+	if !strings.HasSuffix(rules, ".jsonnet") {
+		contents, err := ioutil.ReadFile(rules)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(out_path, contents, 0644)
+	}
+
+	cmd := exec.Command("jsonnet", append(JsonnetPathArgs(rules), rules)...)
+	cmd.Stderr = os.Stderr
+
+	rendered, err := cmd.Output()
+	if err != nil {
+		return errors.New("Failed to render " + rules + ": " + err.Error())
+	}
+
+	var parsed_rules interface{}
+	if err := json.Unmarshal(rendered, &parsed_rules); err != nil {
+		return errors.New(rules + " did not render to json: " + err.Error())
+	}
+
+	out_file, err := yaml.Marshal(parsed_rules)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(out_path, out_file, 0644)
+}
+
+// Apply branch and environment specific settings to a rendered dashboard and write it to the dist folder.
+// The caller passes the metadata it already loaded for the source.
+func WriteDashboard(parsed_dashboard map[string]interface{}, dashboard string, metadata DashboardMetadata, branch string, out_path string) {
+
+	// Unknown placeholders would deploy a broken dashboard, so they stop the render
+	if err := InterpolateVariables(parsed_dashboard); err != nil {
+		Fatalf("ERROR: %s: %s", dashboard, err)
+	}
+
+	ProcessDashboard(parsed_dashboard, dashboard, branch)
+
+	// Tags from metadata are added to any the dashboard already has
+	if len(metadata.Tags) > 0 {
+		tags, _ := parsed_dashboard["tags"].([]interface{})
+		for _, tag := range metadata.Tags {
+			if !containsValue(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		parsed_dashboard["tags"] = tags
+	}
+
+	if metadata.Folder != "" && IsDefaultBranch(branch) {
+		folder_overrides[out_path] = metadata.Folder
+		folder_parents[out_path] = metadata.ParentFolder
+	}
+	if len(config.GeneralFolder) > 0 && IsDefaultBranch(branch) && len(FilterChanges([]FileChange{{Path: dashboard}}, config.GeneralFolder, nil)) > 0 {
+		folder_overrides[out_path] = GeneralFolder
+	}
+
+	parsed_dashboard, err := ApplyTransforms(parsed_dashboard, out_path)
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Environment patches apply to the final rendered output
+	parsed_dashboard, err = ApplyEnvironmentPatch(parsed_dashboard, out_path)
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Two sources with the same uid would keep overwriting each other in grafana
+	if dashboard_uid, _ := parsed_dashboard["uid"].(string); dashboard_uid != "" {
+		if other, ok := rendered_uids[dashboard_uid]; ok && other != dashboard {
+			Fatalf("ERROR: %s and %s both render to uid %s, rename one or give it a uid in its metadata", other, dashboard, dashboard_uid)
+		}
+		rendered_uids[dashboard_uid] = dashboard
+	}
+
+	out_file, _ := json.MarshalIndent(parsed_dashboard, "", "   ")
+	if err := ioutil.WriteFile(out_path, out_file, 0644); err != nil {
+		Fatal(err)
+	}
+
+	rendered_from[out_path] = dashboard
+}
+
+// Matches ${name} and ${name:format} placeholders
+var placeholder_pattern = regexp.MustCompile(`\$\{([^}:]+)(:[^}]*)?\}`)
+
+// Replace ${NAME} placeholders in every string of a dashboard with the values allowed by the interpolate config.
+// Grafana uses the same syntax for its own variables, so placeholders naming a dashboard template variable or a
+// built in __ variable are left for grafana. Anything else is an error.
+func InterpolateVariables(parsed_dashboard map[string]interface{}) error {
+
+	grafana_variables := map[string]bool{}
+	templating, _ := parsed_dashboard["templating"].(map[string]interface{})
+	variables, _ := templating["list"].([]interface{})
+
+	// Dashboards exported for sharing declare their datasource inputs, e.g. ${DS_PROMETHEUS}
+	inputs, _ := parsed_dashboard["__inputs"].([]interface{})
+
+	for _, item := range append(variables, inputs...) {
+		if variable, ok := item.(map[string]interface{}); ok {
+			if name, ok := variable["name"].(string); ok {
+				grafana_variables[name] = true
+			}
+		}
+	}
+
+	unknown := map[string]bool{}
+
+	var interpolate func(node interface{}) interface{}
+	interpolate = func(node interface{}) interface{} {
+		switch value := node.(type) {
+		case map[string]interface{}:
+			for key, child := range value {
+				value[key] = interpolate(child)
+			}
+		case []interface{}:
+			for i, child := range value {
+				value[i] = interpolate(child)
+			}
+		case string:
+			return placeholder_pattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+				name := placeholder_pattern.FindStringSubmatch(placeholder)[1]
+				if replacement, ok := config.Interpolate[name]; ok {
+					return os.ExpandEnv(replacement)
+				}
+				if !grafana_variables[name] && !strings.HasPrefix(name, "__") {
+					unknown[name] = true
+				}
+				return placeholder
+			})
+		}
+		return node
+	}
+
+	interpolate(parsed_dashboard)
+
+	if len(unknown) > 0 {
+		var names []string
+		for name := range unknown {
+			names = append(names, "${"+name+"}")
+		}
+		sort.Strings(names)
+		return errors.New("unknown placeholder(s) " + strings.Join(names, ", ") + ", add them to interpolate in the config")
+	}
+
+	return nil
+}
+
+// Apply the branch and selected environments settings to a rendered dashboard
+func ProcessDashboard(parsed_dashboard map[string]interface{}, dashboard string, branch string) {
+
+	// Preview copies on feature branches are titled so they stand out from the canonical dashboards
+	if (config.BranchTitlePrefix == nil || *config.BranchTitlePrefix) && !IsDefaultBranch(branch) {
+		if title, ok := parsed_dashboard["title"].(string); ok {
+			parsed_dashboard["title"] = "[" + BranchSlug(branch) + "] " + title
+		}
+	}
+
+	// Rendering without a target environment leaves dashboards untouched
+	if environment == nil {
+		return
+	}
+
+	ApplyVariableDefaults(parsed_dashboard, environment.Variables)
+}
+
+// Helper method to check if a list contains a string
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper method to check if a decoded json array contains a string
+func containsValue(list []interface{}, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper method to return the repository default branch
+func DefaultBranch() string {
+
+	default_branch := os.Getenv("CI_DEFAULT_BRANCH")
+	if default_branch == "" {
+		default_branch = "master"
+	}
+
+	return default_branch
+}
+
+// Helper method to check if a (cleaned) branch name is the repository default branch
+func IsDefaultBranch(branch string) bool {
+	return branch == strings.Replace(DefaultBranch(), "/", "", -1)
+}
+
+// Helper method to return the uid a dashboard source deploys with on a (cleaned) branch.
+// A uid from its metadata or the uid manifest is used as is on the default branch, and previews derive theirs from it.
+func SourceUID(source string, branch string) string {
+
+	metadata, err := LoadMetadata(source)
+	if err != nil {
+		metadata = DashboardMetadata{}
+	}
+	return MetadataUID(source, metadata, branch)
+}
+
+// Helper method to return the uid a dashboard source deploys with on a (cleaned) branch, given its already loaded metadata
+func MetadataUID(source string, metadata DashboardMetadata, branch string) string {
+
+	fixed := metadata.UID
+	if fixed == "" {
+		fixed = uid_manifest[source]
+	}
+
+	if fixed == "" {
+		return DashboardUID(path.Base(source), branch)
+	}
+	if IsDefaultBranch(branch) {
+		return fixed
+	}
+	return DashboardUID(fixed, branch)
+}
+
+// Helper method to return a short readable slug for a branch, e.g. feature-x for feature/X
+// Gitlabs own slug is used when available as it keeps the separators the cleaned branch name loses
+func BranchSlug(branch string) string {
+
+	if slug := os.Getenv("CI_COMMIT_REF_SLUG"); slug != "" {
+		return slug
+	}
+
+	return Slugify(branch)
+}
+
+// Set the selected value of named template variables, so dashboards open with sensible defaults per environment
+func ApplyVariableDefaults(parsed_dashboard map[string]interface{}, defaults map[string]string) {
+
+	if len(defaults) == 0 {
+		return
+	}
+
+	templating, _ := parsed_dashboard["templating"].(map[string]interface{})
+	variables, _ := templating["list"].([]interface{})
+
+	for _, item := range variables {
+
+		variable, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := variable["name"].(string)
+		value, ok := defaults[name]
+		if !ok {
+			continue
+		}
+
+		Verbose("Setting default for variable " + name + ": " + value)
+		variable["current"] = map[string]interface{}{"selected": true, "text": value, "value": value}
+
+		// Keep the option list consistent with the new selection
+		if options, ok := variable["options"].([]interface{}); ok {
+			for _, item := range options {
+				if option, ok := item.(map[string]interface{}); ok {
+					option["selected"] = option["value"] == value
+				}
+			}
+		}
+	}
+}
+
+// A changed file and how it changed, as written to git-diff.json by git-diff.go.
+// Status is one of A (added), M (modified), D (deleted) or R (renamed). OldPath is only set for renames.
+type FileChange struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldPath string `json:"old_path,omitempty"`
+}
+
+// Helper method to load the structured change list produced by git-diff.go
+func LoadChanges(file string) ([]FileChange, error) {
+
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Changes []FileChange `json:"changes"`
+	}
+	if err := json.Unmarshal(bytes, &document); err != nil {
+		return nil, errors.New("Failed to parse " + file + ": " + err.Error())
+	}
+
+	return document.Changes, nil
+}
+
+// Helper method to add the dashboards affected by changes to files they import, such as shared libsonnet libraries.
+// Every jsonnet dashboard's imports are followed transitively, and dashboards depending on a changed file are added as modified.
+func AddAffectedDashboards(changed []FileChange) ([]FileChange, error) {
+
+	// Only changes outside the dashboard sources can affect other dashboards this way
+	changed_files := map[string]bool{}
+	listed := map[string]bool{}
+	for _, change := range changed {
+		listed[change.Path] = true
+		if !IsDashboardSource(change.Path) {
+			absolute, err := filepath.Abs(change.Path)
+			if err != nil {
+				return nil, err
+			}
+			changed_files[absolute] = true
+		}
+	}
+
+	if len(changed_files) == 0 {
+		return changed, nil
+	}
+
+	sources, err := ListDashboardSources()
+	if err != nil {
+		return nil, err
+	}
+
+	// Imports resolve the same way as when rendering
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.FileImporter{JPaths: []string{"vendor"}})
+
+	for _, source := range sources {
+
+		if listed[source.Path] || !strings.HasSuffix(source.Path, ".jsonnet") {
+			continue
+		}
+
+		dependencies, err := vm.FindDependencies("", []string{source.Path})
+		if err != nil {
+			return nil, errors.New("Failed to follow imports of " + source.Path + ": " + err.Error())
+		}
+
+		for _, dependency := range dependencies {
+			if changed_files[filepath.Clean(dependency)] {
+				Info("Affected by an imported change: " + source.Path)
+				changed = append(changed, FileChange{Path: source.Path, Status: "M"})
+				break
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// Find the changed files in a branch and renders them
+// Returns true based on if a dashboard was rendered or not
+func RenderChanged(changed []FileChange, branch string, out_dir string) bool {
+
+	Info("Rendering changed dashboards")
+
+	// Print the array of changed files
+	Verbose("Changed Files: ")
+	for _, change := range changed {
+		Verbose(change.Status + " " + change.Path)
+	}
+
+	files_to_deploy := false
+	rendered := map[string]bool{}
+
+	for _, change := range changed {
+
+		file := change.Path
+
+		// Deleted dashboards have nothing to render, they are cleaned up after deploy
+		if change.Status == "D" {
+			continue
+		}
+
+		// A renamed or moved dashboard takes its fixed uid with it
+		if change.Status == "R" && uid_manifest[change.OldPath] != "" && uid_manifest[change.Path] == "" {
+			uid_manifest[change.Path] = uid_manifest[change.OldPath]
+			delete(uid_manifest, change.OldPath)
+			uid_manifest_changed = true
+		}
+
+		// A changed metadata file or overlay re-renders the dashboard it belongs to
+		if strings.HasSuffix(file, ".meta.yaml") {
+			file = MetadataSource(file)
+		} else if IsOverlay(file) {
+			file = OverlayBase(file)
+		}
+
+		if file == "" || rendered[file] {
+			continue
+		}
+		rendered[file] = true
+
+		// If the changed file is in one of the dashboard source directories
+		if IsDashboardSource(file) {
+
+			// Render the dashboard file
+			Render(file, branch, out_dir)
+
+			files_to_deploy = true
+		}
+	}
+
+	return files_to_deploy
+}
+
+// Render the dashboards and rules of any mixin that changed, or of every mixin when rendering everything.
+// Returns true if a mixin was rendered.
+func RenderMixins(changed []FileChange, branch string, out_dir string, all bool) bool {
+
+	rendered := false
+
+	for _, mixin := range config.Mixins {
+
+		render := all
+		for _, change := range changed {
+			if strings.HasPrefix(change.Path, strings.TrimSuffix(mixin.Path, "/")+"/") {
+				render = true
+			}
+		}
+
+		if !render {
+			continue
+		}
+
+		if err := RenderMixin(mixin, branch, out_dir); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+		rendered = true
+	}
+
+	return rendered
+}
+
+// Render one mixin with the go-jsonnet vm. Dashboards are processed like any other dashboard,
+// and the rule and alert groups are written next to them as <name>.rules.yaml.
+func RenderMixin(mixin Mixin, branch string, out_dir string) error {
+
+	Info("Rendering mixin: " + mixin.Name)
+
+	// Environment specific settings win over the shared ones
+	mixin_config := map[string]interface{}{}
+	for key, value := range mixin.Config {
+		mixin_config[key] = value
+	}
+	if environment != nil {
+		for key, value := range mixin.EnvironmentConfig[environment.Name] {
+			mixin_config[key] = value
+		}
+	}
+
+	config_json, err := json.Marshal(mixin_config)
+	if err != nil {
+		return errors.New("Invalid config for mixin " + mixin.Name + ": " + err.Error())
+	}
+
+	// Mixin fields are hidden and any of them may be missing
+	snippet := `local mixin = (import 'mixin.libsonnet') + { _config+:: ` + string(config_json) + ` };
+local field(name, default) = if std.objectHasAll(mixin, name) then mixin[name] else default;
+{
+  dashboards: field('grafanaDashboards', {}),
+  groups: field('prometheusRules', { groups: [] }).groups + field('prometheusAlerts', { groups: [] }).groups,
+}`
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.FileImporter{JPaths: []string{"vendor"}})
+
+	// Imports are resolved relative to the snippet, so it is evaluated as if it lived in the mixin directory
+	rendered, err := vm.EvaluateAnonymousSnippet(filepath.Join(mixin.Path, "pipeline-mixin.jsonnet"), snippet)
+	if err != nil {
+		return errors.New("Failed to render mixin " + mixin.Name + ": " + err.Error())
+	}
+
+	var output struct {
+		Dashboards map[string]map[string]interface{} `json:"dashboards"`
+		Groups     []interface{}                     `json:"groups"`
+	}
+	if err := json.Unmarshal([]byte(rendered), &output); err != nil {
+		return errors.New("Unexpected output from mixin " + mixin.Name + ": " + err.Error())
+	}
+
+	os.Mkdir(out_dir+"/"+mixin.Name, 0755)
+	source := strings.TrimSuffix(mixin.Path, "/") + "/mixin.libsonnet"
+	metadata, err := LoadMetadata(source)
+	if err != nil {
+		return err
+	}
+
+	for name, parsed_dashboard := range output.Dashboards {
+
+		if !strings.HasSuffix(name, ".json") {
+			name = name + ".json"
+		}
+
+		// Mixin dashboards get branch specific uids like every other dashboard
+		parsed_dashboard["uid"] = DashboardUID(name, branch)
+		parsed_dashboard["id"] = nil
+
+		WriteDashboard(parsed_dashboard, source, metadata, branch, out_dir+"/"+mixin.Name+"/"+name)
+		Info("Rendered: " + name)
+	}
+
+	if len(output.Groups) > 0 {
+		rules, err := yaml.Marshal(map[string]interface{}{"groups": output.Groups})
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out_dir+"/"+mixin.Name+"/"+mixin.Name+".rules.yaml", rules, 0644); err != nil {
+			return err
+		}
+		Infof("Rendered %d rule group(s) for %s\n", len(output.Groups), mixin.Name)
+	}
+
+	return nil
+}
+
+// Remove and recreate the render output directory so stale dashboards from a previous run are never deployed.
+// Refuses anything that isn't a subdirectory of the working directory or that contains sources or the git repo.
+func CleanOutputDir(out_dir string) error {
+
+	working_dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	out_path, err := filepath.Abs(out_dir)
+	if err != nil {
+		return err
+	}
+
+	relative, err := filepath.Rel(working_dir, out_path)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return errors.New("Refusing to clean output directory outside the working directory: " + out_dir)
+	}
+
+	if _, err := os.Stat(filepath.Join(out_path, ".git")); err == nil {
+		return errors.New("Refusing to clean output directory containing a git repository: " + out_dir)
+	}
+
+	// Nothing the repository manages may be inside the output directory, nor the output directory inside it.
+	// --out dashboards/payments would otherwise delete the payments dashboards.
+	managed := append([]string{".git", "vendor", config.Patches, config.Templates, config.Playlists, config.Policies.Rego, config.UIDManifest}, config.Sources...)
+	for _, mixin := range config.Mixins {
+		managed = append(managed, mixin.Path)
+	}
+	for _, root := range managed {
+		if root != "" && PathsOverlap(filepath.ToSlash(relative), root) {
+			return errors.New("Refusing to clean output directory " + out_dir + " as it overlaps " + root)
+		}
+	}
+
+	if err := os.RemoveAll(out_path); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(out_path, 0755)
+}
+
+// Helper method to check if one path is the same as, inside or contains another, which may be a glob like teams/*/grafana
+func PathsOverlap(file string, root string) bool {
+
+	file_segments := strings.Split(path.Clean(file), "/")
+	root_segments := strings.Split(path.Clean(strings.Trim(root, "/")), "/")
+
+	for i := 0; i < len(file_segments) && i < len(root_segments); i++ {
+		if matched, _ := path.Match(root_segments[i], file_segments[i]); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Helper method for printing httprequest debug data
+func debug(data []byte, err error) {
+
+	// Full request and response dumps are only wanted with --debug
+	if verbosity < LevelDebug {
+		return
+	}
+
+	if err == nil {
+		fmt.Printf("%s\n\n", data)
+	} else {
+		Fatalf("%s\n\n", err)
+	}
+}
+
+// How much is printed. Warnings, errors and the final summary are always printed.
+const (
+	LevelQuiet = iota
+	LevelNormal
+	LevelVerbose
+	LevelDebug
+)
+
+// The selected output level, set by --quiet, --verbose and --debug
+var verbosity = LevelNormal
+
+// Helper method to print progress in normal output
+func Info(a ...interface{}) {
+	if verbosity >= LevelNormal {
+		fmt.Println(a...)
+	}
+}
+
+func Infof(format string, a ...interface{}) {
+	if verbosity >= LevelNormal {
+		fmt.Printf(format, a...)
+	}
+}
+
+// Helper method to print details only wanted with --verbose
+func Verbose(a ...interface{}) {
+	if verbosity >= LevelVerbose {
+		fmt.Println(a...)
+	}
+}
+
+func Verbosef(format string, a ...interface{}) {
+	if verbosity >= LevelVerbose {
+		fmt.Printf(format, a...)
+	}
+}
+
+// Ansi colors for dashboard results
+const (
+	ColorRed    = "31"
+	ColorGreen  = "32"
+	ColorYellow = "33"
+	ColorGrey   = "90"
+)
+
+// Whether output is colored, set in main from --no-color, NO_COLOR and whether stdout is a terminal
+var color = false
+
+// Helper method to wrap text in an ansi color when color output is on
+func Colorize(code string, text string) string {
+	if !color {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// Helper method to decide whether to color output. Gitlab job logs render ansi colors even though they are not a terminal.
+func UseColor(no_color bool) bool {
+
+	if no_color || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	if os.Getenv("GITLAB_CI") != "" {
+		return true
+	}
+
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// The phase of the run, named when --run-timeout ends it
+var run_phase = "setup"
+var run_phase_lock sync.Mutex
+
+// Helper method to record the phase the run has reached
+func EnterPhase(phase string) {
+	run_phase_lock.Lock()
+	defer run_phase_lock.Unlock()
+	run_phase = phase
+}
+
+// Set once --run-timeout has passed, so the run winds down like a cancelled one but exits with ExitTimeout
+var timed_out int32
+
+// Helper method to end the run once the timeout has passed, so it fails inside the jobs own time limit
+// with an error naming what it was doing rather than being killed by gitlab.
+// The run stops like a cancelled job, so the summary and state still record what it deployed.
+func StartRunDeadline(timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		run_phase_lock.Lock()
+		phase := run_phase
+		run_phase_lock.Unlock()
+
+		log.Printf("ERROR: deadline exceeded in %s phase, the run took longer than --run-timeout %s", phase, timeout)
+		atomic.StoreInt32(&timed_out, 1)
+		atomic.StoreInt32(&interrupted, 1)
+		Emit(Event{Event: "interrupted"})
+
+		// The request in flight is already past the deadline, so it doesn't get a grace period
+		abort_grafana_requests()
+
+		// A run stuck somewhere other than a grafana request still ends before the job does
+		time.Sleep(InterruptGrace)
+		log.Printf("ERROR: the run didn't stop within %s of the deadline, exiting without saving the state", InterruptGrace)
+		os.Exit(ExitTimeout)
+	})
+}
+
+// Helper method to return the exit code of a run stopped early, by a signal or by --run-timeout
+func InterruptedExitCode() int {
+
+	if atomic.LoadInt32(&timed_out) == 1 {
+		return ExitTimeout
+	}
+
+	return ExitInterrupted
+}
+
+// Set once the job is cancelled, after which no new dashboards are started
+var interrupted int32
+
+// Exit codes. They are kept stable so pipelines can act on them, e.g. allow_failure: exit_codes: [6]
+const (
+	ExitError       = 1   // Anything unexpected
+	ExitConfig      = 2   // Bad flags, config or credentials. Go's flag parsing exits with 2 as well.
+	ExitValidation  = 3   // Lint, policy, formatting or pre-deploy checks failed
+	ExitRender      = 4   // A dashboard failed to render
+	ExitDeploy      = 5   // The deploy failed, nothing or not everything was deployed
+	ExitPartial     = 6   // Some dashboards deployed and others failed, with --continue-on-error
+	ExitTimeout     = 7   // --run-timeout expired
+	ExitInterrupted = 143 // Stopped by a signal, 128 + SIGTERM as a shell would report it
+)
+
+// The exit code for failures during each phase of a run
+var phase_exit_codes = map[string]int{
+	"setup":    ExitConfig,
+	"render":   ExitRender,
+	"validate": ExitValidation,
+	"snapshot": ExitDeploy,
+	"deploy":   ExitDeploy,
+	"cleanup":  ExitDeploy,
+}
+
+// Helper method to log an error and exit with the exit code of the phase the run is in
+func Fatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(PhaseExitCode())
+}
+
+// Helper method to log a formatted error and exit with the exit code of the phase the run is in
+func Fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(PhaseExitCode())
+}
+
+// Helper method to return the exit code for a deploy that had failures, telling a partial deploy from one that deployed nothing
+func DeployExitCode() int {
+
+	if len(deployed_dashboards) > 0 {
+		return ExitPartial
+	}
+
+	return ExitDeploy
+}
+
+// Helper method to return the exit code for a failure in the current phase
+func PhaseExitCode() int {
+
+	run_phase_lock.Lock()
+	defer run_phase_lock.Unlock()
+
+	if code, ok := phase_exit_codes[run_phase]; ok {
+		return code
+	}
+
+	return ExitError
+}
+
+// How long the request in flight gets to finish after the job is cancelled, gitlab kills the job soon after
+const InterruptGrace = 20 * time.Second
+
+// Every grafana request is made with this context, so a request outlasting the grace period can be aborted
+var grafana_requests, abort_grafana_requests = context.WithCancel(context.Background())
+
+// Helper method to wind the run down when gitlab cancels the job, which sends SIGTERM.
+// Nothing new is started, a request outlasting the grace period is aborted so the state can still be saved,
+// and a second signal ends the run straight away.
+func HandleInterrupts() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		received := <-signals
+		atomic.StoreInt32(&interrupted, 1)
+		fmt.Println("WARNING: received " + received.String() + ", stopping once the request in flight finishes")
+		Emit(Event{Event: "interrupted"})
+
+		select {
+		case <-signals:
+			fmt.Println("WARNING: received a second signal, exiting without saving the state")
+			os.Exit(ExitInterrupted)
+		case <-time.After(InterruptGrace):
+		}
+		fmt.Println("WARNING: aborting the request in flight")
+		abort_grafana_requests()
+
+		<-signals
+		os.Exit(ExitInterrupted)
+	}()
+}
+
+// Helper method to check if the job has been cancelled
+func Interrupted() bool {
+	return atomic.LoadInt32(&interrupted) == 1
+}
+
+// Helper method to turn a section name into the characters gitlab allows in section markers
+func sectionID(name string) string {
+	return regexp.MustCompile("[^a-z0-9_]+").ReplaceAllString(strings.ToLower(name), "_")
+}
+
+// Start a collapsible section in the gitlab job log. Outside gitlab ci only the header is printed.
+func StartSection(name string, header string, collapsed bool) {
+
+	if os.Getenv("GITLAB_CI") == "" {
+		Info(header)
+		return
+	}
+
+	options := ""
+	if collapsed {
+		options = "[collapsed=true]"
+	}
+	fmt.Printf("\x1b[0Ksection_start:%d:%s%s\r\x1b[0K%s\n", time.Now().Unix(), sectionID(name), options, header)
+}
+
+// End a collapsible section started with StartSection
+func EndSection(name string) {
+
+	if os.Getenv("GITLAB_CI") == "" {
+		return
+	}
+
+	fmt.Printf("\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), sectionID(name))
+}
+
+// A progress event, written as one line of json to the --events-fd file descriptor
+type Event struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Dashboard string    `json:"dashboard,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Where events are written, nil when nobody asked for them
+var events *json.Encoder
+
+// Helper method to emit a progress event
+func Emit(event Event) {
+	if events == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	events.Encode(event)
+}
+
+// Passes log output through to stderr and also emits it as an error event,
+// so fatal errors from anywhere in the script reach the event stream
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(message []byte) (int, error) {
+	Emit(Event{Event: "error", Error: strings.TrimSpace(string(message))})
+	return os.Stderr.Write(message)
+}
+
+// Helper method to build a grafana api request authenticated for the selected environment
+func NewGrafanaRequest(method string, url string, body io.Reader) (*http.Request, error) {
+
+	request, err := http.NewRequestWithContext(grafana_requests, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+
+	// Authenticate with the credentials of the selected environment
+	if environment.token != "" {
+		request.Header.Add("Authorization", "Bearer "+environment.token)
+	} else {
+		request.SetBasicAuth(environment.user, environment.password)
+	}
+
+	for name, value := range environment.Headers {
+		request.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	return request, nil
+}
+
+// Helper method to POST a json payload to grafana
+func DoPOST(url string, payload string) ([]byte, error) {
+	return DoRequest("POST", url, payload)
+}
+
+// Every grafana and gitlab request shares one client so bulk deploys reuse connections rather than opening one per request.
+// --record and --replay swap its transport for a cassette.
+var http_client = &http.Client{Transport: NewTransport()}
+
+// Helper method to build the shared transport, keeping enough idle connections to each server for a bulk deploy
+func NewTransport() *http.Transport {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+	transport.ForceAttemptHTTP2 = true
+
+	return transport
+}
+
+// Helper method to do all the api requests to grafana, returning the response body
+// Returns an error rather than exiting so callers can decide whether a failure is fatal
+func DoRequest(method string, url string, payload string) ([]byte, error) {
+
+	body := strings.NewReader(payload)
+
+	var response_body []byte
+	var response *http.Response
+	var request *http.Request
+
+	request, err := NewGrafanaRequest(method, url, body)
+
+	if err == nil {
+
+		// Uncomment this to debug requests
+		//debug(httputil.DumpRequestOut(request, true))
+
+		response, err = http_client.Do(request)
+	}
+
+	if err == nil {
+
+		defer response.Body.Close()
+
+		// Uncomment this to debug responses
+		debug(httputil.DumpResponse(response, true))
+
+		response_body, err = ioutil.ReadAll(response.Body)
+	}
+
+	if err == nil {
+		Verbosef("%s", response_body)
+	}
+
+	// Grafana reports failures in the status code, the body alone can look like success
+	if err == nil && (response.StatusCode < 200 || response.StatusCode > 299) {
+		err = NewGrafanaError(method, url, response, response_body)
+	}
+
+	// Credentials read from files may have been rotated since startup
+	if IsGrafanaStatus(err, http.StatusUnauthorized) && RefreshCredentialFiles(environment) {
+		return DoRequest(method, url, payload)
+	}
+
+	return response_body, err
+}
+
+// An error response from the grafana api
+type GrafanaError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *GrafanaError) Error() string {
+
+	text := "grafana returned " + e.Status + " for " + e.Method + " " + e.URL
+	if e.Message != "" {
+		text += ": " + e.Message
+	}
+
+	// Point at the likely fix for the errors people hit most
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		text += " (check the credentials for the " + environment.Name + " environment)"
+	case http.StatusForbidden:
+		text += " (the credentials for the " + environment.Name + " environment lack permission, an editor or admin role is needed)"
+	case http.StatusPreconditionFailed:
+		text += " (the dashboard was changed in grafana, or another dashboard in the folder has the same title)"
+	}
+
+	return text
+}
+
+// Helper method to build an error from a grafana response, using the message grafana puts in json error bodies
+func NewGrafanaError(method string, url string, response *http.Response, body []byte) error {
+
+	var parsed struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+
+	message := parsed.Message
+	if message == "" {
+		message = parsed.Error
+	}
+	if message == "" && !json.Valid(body) {
+		message = strings.TrimSpace(string(body))
+	}
+
+	return &GrafanaError{Method: method, URL: url, StatusCode: response.StatusCode, Status: response.Status, Message: message}
+}
+
+// Helper method to check if an error is a grafana response with the given status code
+func IsGrafanaStatus(err error, status_code int) bool {
+	var grafana_error *GrafanaError
+	return errors.As(err, &grafana_error) && grafana_error.StatusCode == status_code
+}
+
+// A recorded http exchange. Headers aren't kept so credentials never reach the fixture file,
+// and urls are kept without their host so a recording replays against any server url.
+type Interaction struct {
+	Method       string `json:"method"`
+	Path         string `json:"path"`
+	RequestBody  string `json:"request_body,omitempty"`
+	Status       int    `json:"status"`
+	ResponseBody string `json:"response_body"`
+}
+
+// An http transport that records every request to a fixture file, or answers requests from one without any network.
+// Installed as the shared clients transport by --record and --replay.
+type Cassette struct {
+	file         string
+	replay       bool
+	interactions []Interaction
+	used         []bool
+	transport    http.RoundTripper
+	lock         sync.Mutex
+}
+
+// Helper method to create a cassette, loading the fixture file when replaying
+func NewCassette(file string, replay bool) (*Cassette, error) {
+
+	cassette := &Cassette{file: file, replay: replay, transport: http_client.Transport}
+
+	if replay {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.New("Could not read recording " + file + ": " + err.Error())
+		}
+		if err := json.Unmarshal(bytes, &cassette.interactions); err != nil {
+			return nil, errors.New("Recording " + file + " is not valid json: " + err.Error())
+		}
+		cassette.used = make([]bool, len(cassette.interactions))
+	}
+
+	return cassette, nil
+}
+
+func (cassette *Cassette) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	cassette.lock.Lock()
+	defer cassette.lock.Unlock()
+
+	var request_body []byte
+	if request.Body != nil {
+		var err error
+		request_body, err = ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(request_body))
+	}
+
+	interaction := Interaction{Method: request.Method, Path: request.URL.RequestURI(), RequestBody: Redact(string(request_body))}
+
+	if cassette.replay {
+
+		// Identical requests are answered in the order they were recorded
+		for i, recorded := range cassette.interactions {
+			if cassette.used[i] || recorded.Method != interaction.Method || recorded.Path != interaction.Path || recorded.RequestBody != interaction.RequestBody {
+				continue
+			}
+			cassette.used[i] = true
+
+			return &http.Response{
+				Status:        strconv.Itoa(recorded.Status) + " " + http.StatusText(recorded.Status),
+				StatusCode:    recorded.Status,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": []string{"application/json"}},
+				Body:          ioutil.NopCloser(strings.NewReader(recorded.ResponseBody)),
+				ContentLength: int64(len(recorded.ResponseBody)),
+				Request:       request,
+			}, nil
+		}
+
+		return nil, errors.New("no recorded response for " + interaction.Method + " " + interaction.Path + " in " + cassette.file)
+	}
+
+	response, err := cassette.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response_body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(response_body))
+
+	interaction.Status = response.StatusCode
+	interaction.ResponseBody = Redact(string(response_body))
+	cassette.interactions = append(cassette.interactions, interaction)
+
+	// Written after every request so the recording survives a fatal error, which is often the interesting part
+	recording, _ := json.MarshalIndent(cassette.interactions, "", "  ")
+	if err := ioutil.WriteFile(cassette.file, recording, 0644); err != nil {
+		return nil, errors.New("Could not write recording " + cassette.file + ": " + err.Error())
+	}
+
+	return response, nil
+}
+
+// Helper method to remove the selected environments credentials from recorded text
+func Redact(text string) string {
+
+	if environment == nil {
+		return text
+	}
+
+	secrets := []string{environment.token, environment.password}
+	for _, value := range environment.Headers {
+		secrets = append(secrets, os.ExpandEnv(value))
+	}
+
+	for _, secret := range secrets {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "REDACTED")
+		}
+	}
+
+	return text
+}
+
+// Expand {{name}} placeholders in a title template.
+// Names are looked up in values, then the configs template_variables, then environment variables such as CI_PROJECT_NAME.
+func ExpandTitleTemplate(template string, values map[string]string) (string, error) {
+
+	var unknown []string
+
+	placeholder := regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+	title := placeholder.ReplaceAllStringFunc(template, func(match string) string {
+
+		name := placeholder.FindStringSubmatch(match)[1]
+
+		if value, ok := values[name]; ok {
+			return value
+		}
+		if value, ok := config.TemplateVariables[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+
+		unknown = append(unknown, name)
+		return match
+	})
+
+	if len(unknown) > 0 {
+		return "", errors.New("Unknown variables in title template " + template + ": " + strings.Join(unknown, ", "))
+	}
+
+	return title, nil
+}
+
+// A grafana folder and the directory of rendered dashboards that deploy into it
+type DeployTarget struct {
+	FolderUID   string
+	FolderTitle string
+	Path        string
+}
+
+// Check whether any rendered dashboard of a deploy target stays in the targets own folder.
+// Targets without any rendered dashboards still get their folder, so pruning has something to look at.
+func NeedsFolder(target DeployTarget) bool {
+
+	dashboards, err := RenderedDashboards(target.Path)
+	if err != nil || len(dashboards) == 0 {
+		return true
+	}
+
+	for _, dashboard := range dashboards {
+		if TargetFolder(dashboard, target.FolderUID) == target.FolderUID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Work out the grafana folders to deploy into.
+// By default every dashboard goes into one folder named after the branch. With folder_mode: project the
+// default branch instead gets one folder per project directory, with a stable uid based on the project name.
+func DeployTargets(out_dir string, branch string, clean_branch string, project string) ([]DeployTarget, error) {
+
+	// Folder titles default to the folder name but can be templated for humans
+	title := func(name string, project string) (string, error) {
+		if config.FolderTitle == "" {
+			return name, nil
+		}
+		return ExpandTitleTemplate(config.FolderTitle, map[string]string{
+			"project":      project,
+			"branch":       branch,
+			"clean_branch": clean_branch,
+			"slug":         BranchSlug(branch),
+			"env":          environment.Name,
+		})
+	}
+
+	if config.FolderMode == "project" && IsDefaultBranch(clean_branch) {
+
+		items, err := ioutil.ReadDir(out_dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var targets []DeployTarget
+		for _, item := range items {
+
+			if !item.IsDir() {
+				continue
+			}
+
+			folder_title, err := title(item.Name(), item.Name())
+			if err != nil {
+				return nil, err
+			}
+
+			targets = append(targets, DeployTarget{
+				FolderUID:   FolderUID("project-" + item.Name()),
+				FolderTitle: folder_title,
+				Path:        out_dir + "/" + item.Name(),
+			})
+		}
+
+		return targets, nil
+	}
+
+	folder_uid := FolderUID(clean_branch)
+
+	folder_title, err := title(clean_branch, project)
+	if err != nil {
+		return nil, err
+	}
+
+	return []DeployTarget{{FolderUID: folder_uid, FolderTitle: folder_title, Path: out_dir}}, nil
+}
+
+// Build a folder uid from a branch or project name.
+// With a namespace configured the uid is namespaced so repositories sharing a grafana can't collide,
+// and shortened with a hash to fit. Without one the original truncated name is kept.
+func FolderUID(name string) string {
+
+	namespace := os.ExpandEnv(config.Namespace)
+	if namespace != "" {
+		return ShortenUID(namespace + "-" + name)
+	}
+
+	// We base our grafana folder uid on the branch name, shortened like dashboard uids to grafanas limit
+	return ShortenUID(name)
+}
+
+// Helper method to return the title of the folder a branches folders are nested in, empty for the root
+func ParentFolderTitle(clean_branch string) string {
+
+	if !IsDefaultBranch(clean_branch) && config.PreviewParentFolder != "" {
+		return config.PreviewParentFolder
+	}
+
+	return config.ParentFolder
+}
+
+// Make sure a grafana folder exists with the given title, creating it when missing and renaming it when the title changed.
+// A parent_uid nests the folder in that folder, moving it there if it already exists elsewhere.
+func CreateGrafanaFolder(folder_uid string, folder_name string, parent_uid string, grafana_server string) error {
+
+	existing, err := LookupFolder(folder_uid, grafana_server)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+
+		// Folders made before parent_folder was configured are moved into the parent
+		if parent_uid != "" && existing.ParentUID != parent_uid {
+			Info("Moving grafana folder " + folder_uid + " into " + parent_uid)
+			payload, _ := json.Marshal(map[string]string{"parentUid": parent_uid})
+			if _, err := DoPOST(grafana_server+"/api/folders/"+folder_uid+"/move", string(payload)); err != nil {
+				return err
+			}
+			existing.ParentUID = parent_uid
+		}
+
+		if existing.Title == folder_name {
+			Verbose("Folder already exists: " + folder_uid)
+			return nil
+		}
+
+		// Branch and project renames, or a new folder_title template, change the title but not the uid
+		Info("Renaming grafana folder: " + existing.Title + " to " + folder_name + ", uid: " + folder_uid)
+		payload, _ := json.Marshal(map[string]interface{}{"title": folder_name, "version": existing.Version, "overwrite": true})
+		response, err := DoRequest("PUT", grafana_server+"/api/folders/"+folder_uid, string(payload))
+		if err != nil {
+			return err
+		}
+
+		renamed := &GrafanaFolder{}
+		json.Unmarshal(response, renamed)
+		CacheFolder(folder_uid, renamed, grafana_server)
+		return nil
+	}
+
+	Info("Creating grafana folder: " + folder_name + ", uid: " + folder_uid)
+
+	// Marshal rather than concatenate as templated titles can contain any characters
+	folder := map[string]interface{}{"uid": folder_uid, "title": folder_name}
+	if parent_uid != "" {
+		folder["parentUid"] = parent_uid
+	}
+	payload, _ := json.Marshal(folder)
+	//fmt.Println(string(payload)) // Uncomment to debug payload
+
+	// Another pipeline can create it between the lookup and the post.
+	// Grafana answers 409, or 412 on older versions, when the folder already exists.
+	response, err := DoPOST(grafana_server+"/api/folders", string(payload))
+	if IsGrafanaStatus(err, http.StatusConflict) || IsGrafanaStatus(err, http.StatusPreconditionFailed) {
+		Info("Folder already exists: " + folder_uid)
+
+		// Forget the missing folder so the next lookup finds the one the other pipeline made
+		delete(folder_cache[grafana_server], folder_uid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	created := &GrafanaFolder{}
+	json.Unmarshal(response, created)
+	CacheFolder(folder_uid, created, grafana_server)
+	return nil
+}
+
+// Make sure the folder other folders are nested in exists, returning its uid.
+// Returns an empty uid, creating nothing, when the server doesn't support nested folders.
+func CreateParentFolder(parent string, grafana_server string) (string, error) {
+
+	if !SupportsNestedFolders(grafana_server) {
+		fmt.Println("WARNING: " + grafana_server + " doesn't support nested folders, creating folders at the root instead of in " + parent)
+		return "", nil
+	}
+
+	parent_uid := FolderUID("parent-" + Slugify(parent))
+	if err := CreateGrafanaFolder(parent_uid, parent, "", grafana_server); err != nil {
+		return "", errors.New("Failed to create parent folder " + parent + ": " + err.Error())
+	}
+
+	return parent_uid, nil
+}
+
+// Create the configured teams on a grafana server and sync their members from gitlab.
+// Members are matched to grafana users by login, users who have never logged in to grafana are skipped with a warning.
+// Returns the team ids keyed by name.
+func SyncTeams(grafana_server string) (map[string]int, error) {
+
+	team_ids := map[string]int{}
+
+	for _, team := range config.Teams {
+
+		Info("Syncing team: " + team.Name)
+
+		response, err := DoRequest("GET", grafana_server+"/api/teams/search?name="+url.QueryEscape(team.Name), "")
+		if err != nil {
+			return nil, err
+		}
+
+		var search struct {
+			Teams []struct {
+				ID   int    `json:"id"`
+				Name string `json:"name"`
+			} `json:"teams"`
+		}
+		if err := json.Unmarshal(response, &search); err != nil {
+			return nil, errors.New("Unexpected teams response: " + err.Error())
+		}
+
+		for _, existing := range search.Teams {
+			if existing.Name == team.Name {
+				team_ids[team.Name] = existing.ID
+			}
+		}
+
+		if _, ok := team_ids[team.Name]; !ok {
+			payload, _ := json.Marshal(map[string]string{"name": team.Name})
+			response, err := DoPOST(grafana_server+"/api/teams", string(payload))
+			if err != nil {
+				return nil, err
+			}
+
+			var created struct {
+				TeamID int `json:"teamId"`
+			}
+			if err := json.Unmarshal(response, &created); err != nil || created.TeamID == 0 {
+				return nil, errors.New("Failed to create team " + team.Name + ": " + string(response))
+			}
+			team_ids[team.Name] = created.TeamID
+		}
+
+		if err := SyncTeamMembers(team, team_ids[team.Name], grafana_server); err != nil {
+			return nil, err
+		}
+	}
+
+	return team_ids, nil
+}
+
+// Make a grafana teams members match its gitlab group and extra members
+func SyncTeamMembers(team Team, team_id int, grafana_server string) error {
+
+	wanted := map[string]bool{}
+	for _, member := range team.Members {
+		wanted[member] = true
+	}
+
+	if team.GitLabGroup != "" {
+		usernames, err := GitLabGroupMembers(team.GitLabGroup)
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			wanted[username] = true
+		}
+	}
+
+	team_endpoint := grafana_server + "/api/teams/" + strconv.Itoa(team_id) + "/members"
+
+	response, err := DoRequest("GET", team_endpoint, "")
+	if err != nil {
+		return err
+	}
+
+	var members []struct {
+		UserID int    `json:"userId"`
+		Login  string `json:"login"`
+	}
+	if err := json.Unmarshal(response, &members); err != nil {
+		return errors.New("Unexpected team members response: " + err.Error())
+	}
+
+	current := map[string]bool{}
+	for _, member := range members {
+		current[member.Login] = true
+
+		if !wanted[member.Login] {
+			Info("Removing " + member.Login + " from team " + team.Name)
+			if _, err := DoRequest("DELETE", team_endpoint+"/"+strconv.Itoa(member.UserID), ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	for login := range wanted {
+
+		if current[login] {
+			continue
+		}
+
+		user_id, err := GrafanaUserID(login, grafana_server)
+		if err != nil {
+			return err
+		}
+		if user_id == 0 {
+			fmt.Println("WARNING: " + login + " has no grafana user yet, not adding them to team " + team.Name)
+			continue
+		}
+
+		Info("Adding " + login + " to team " + team.Name)
+		payload, _ := json.Marshal(map[string]int{"userId": user_id})
+		if _, err := DoPOST(team_endpoint, string(payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper method to find the id of the grafana user with a login in the current org. Returns 0 if there isn't one.
+func GrafanaUserID(login string, grafana_server string) (int, error) {
+
+	response, err := DoRequest("GET", grafana_server+"/api/org/users/lookup?query="+url.QueryEscape(login), "")
+	if err != nil {
+		return 0, err
+	}
+
+	var users []struct {
+		UserID int    `json:"userId"`
+		Login  string `json:"login"`
+	}
+	if err := json.Unmarshal(response, &users); err != nil {
+		return 0, errors.New("Unexpected user lookup response: " + err.Error())
+	}
+
+	// The lookup is a prefix search, so look for the exact login
+	for _, user := range users {
+		if user.Login == login {
+			return user.UserID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Replace the team permissions on a folder. Grafana's default viewer and editor role permissions are kept.
+func ApplyFolderPermissions(folder_uid string, permissions []FolderPermission, team_ids map[string]int, grafana_server string) error {
+
+	if len(permissions) == 0 {
+		return nil
+	}
+
+	Info("Setting permissions on folder: " + folder_uid)
+
+	items := []map[string]interface{}{
+		{"role": "Viewer", "permission": permission_levels["view"]},
+		{"role": "Editor", "permission": permission_levels["edit"]},
+	}
+	for _, permission := range permissions {
+		items = append(items, map[string]interface{}{"teamId": team_ids[permission.Team], "permission": permission_levels[permission.Permission]})
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"items": items})
+	_, err := DoPOST(grafana_server+"/api/folders/"+folder_uid+"/permissions", string(payload))
+	return err
+}
+
+// Which dashboards this pipeline has deployed to each environment, persisted between runs in a state file
+type DeploymentState struct {
+	Environments map[string]map[string]DashboardState `json:"environments"`
+
+	// Branch preview folders, keyed by environment then folder uid, so cleanup can find expired ones
+	Previews map[string]map[string]PreviewFolder `json:"previews,omitempty"`
+}
+
+// A folder created for a branch preview and when it was first and last deployed to
+type PreviewFolder struct {
+	Branch   string    `json:"branch"`
+	Created  time.Time `json:"created"`
+	Deployed time.Time `json:"deployed"`
+}
+
+// A dashboard owned by this pipeline, keyed by uid in the state file
+type DashboardState struct {
+	Source   string    `json:"source"`
+	Folder   string    `json:"folder"`
+	Hash     string    `json:"hash"`
+	Deployed time.Time `json:"deployed"`
+
+	// The version grafana gave the dashboard on each server it was saved to, as servers number versions separately
+	Versions map[string]int `json:"versions,omitempty"`
+}
+
+// The deployment state for this run
+var state = DeploymentState{Environments: map[string]map[string]DashboardState{}}
+
+// Which source file each rendered dashboard came from, keyed by its path in the dist folder
+var rendered_from = map[string]string{}
+
+// Which source file each rendered uid came from, to catch two dashboards deploying over each other
+var rendered_uids = map[string]string{}
+
+// Helper method to load the deployment state, starting empty when there is no state file yet
+func LoadState(file string) error {
+
+	bytes, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return errors.New("Failed to parse " + file + ": " + err.Error())
+	}
+	if state.Environments == nil {
+		state.Environments = map[string]map[string]DashboardState{}
+	}
+
+	return nil
+}
+
+// Helper method to write the deployment state back out
+func SaveState(file string) error {
+
+	bytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, bytes, 0644)
+}
+
+// Helper method to return the dashboards owned by this pipeline in the selected environment
+func EnvironmentDeployments() map[string]DashboardState {
+
+	if state.Environments[environment.Name] == nil {
+		state.Environments[environment.Name] = map[string]DashboardState{}
+	}
+
+	return state.Environments[environment.Name]
+}
+
+// Record a branch preview folder as deployed to now in the selected environment
+func RecordPreview(folder_uid string, branch string) {
+
+	if state.Previews == nil {
+		state.Previews = map[string]map[string]PreviewFolder{}
+	}
+	if state.Previews[environment.Name] == nil {
+		state.Previews[environment.Name] = map[string]PreviewFolder{}
+	}
+
+	now := time.Now().UTC()
+	preview, ok := state.Previews[environment.Name][folder_uid]
+	if !ok {
+		preview.Created = now
+	}
+	preview.Branch = branch
+	preview.Deployed = now
+
+	state.Previews[environment.Name][folder_uid] = preview
+}
+
+// Record a dashboard as deployed to a server by this pipeline
+func RecordDeployment(dashboard string, parsed_dashboard map[string]interface{}, folder_uid string, grafana_server string, version int) {
+
+	dashboard_uid, _ := parsed_dashboard["uid"].(string)
+	if dashboard_uid == "" {
+		return
+	}
+
+	// Keep the versions on the environment's other servers
+	versions := map[string]int{}
+	for server, server_version := range EnvironmentDeployments()[dashboard_uid].Versions {
+		versions[server] = server_version
+	}
+	if version > 0 {
+		versions[grafana_server] = version
+	}
+
+	EnvironmentDeployments()[dashboard_uid] = DashboardState{
+		Source:   rendered_from[dashboard],
+		Folder:   folder_uid,
+		Hash:     ContentHash(parsed_dashboard),
+		Deployed: time.Now().UTC(),
+		Versions: versions,
+	}
+}
+
+// Settings controlling how dashboards are deployed
+type DeployOptions struct {
+	// Attempt every dashboard and collect failures instead of exiting on the first
+	ContinueOnError bool
+
+	// Don't POST dashboards whose content matches what is already live
+	SkipUnchanged bool
+
+	// What to do about missing datasources and library panels: fail, warn or off
+	DatasourceCheck   string
+	LibraryPanelCheck string
+
+	// Delete dashboards in the target folders that the repo no longer produces
+	Prune bool
+
+	// Directory to save png previews into after deploying, empty to skip previews
+	PreviewDir string
+
+	// Directory to save side by side comparisons with the live dashboards into, empty to skip them
+	VisualDiffDir string
+
+	// Glob of dashboard sources to deploy and verify before the rest, empty to deploy everything at once
+	Canary string
+
+	// Give each folders deploy its own collapsible section in the gitlab job log
+	ProjectSections bool
+
+	// Read every dashboard back after deploying and fail if grafana stored something different
+	Verify bool
+
+	// What to do when a dashboard was saved in grafana since the pipeline last deployed it:
+	// force overwrites it, fail-on-conflict fails the dashboard and skip-if-newer leaves it alone
+	Overwrite string
+
+	// Saved as the version message of every dashboard deployed, e.g. the release tag. Empty to leave it out.
+	Message string
+}
+
+// Helper method to hash a dashboard model, ignoring fields grafana manages itself
+func ContentHash(parsed_dashboard map[string]interface{}) string {
+
+	normalised := map[string]interface{}{}
+	for key, value := range parsed_dashboard {
+		if key != "id" && key != "version" {
+			normalised[key] = value
+		}
+	}
+
+	// Maps marshal with sorted keys so formatting differences in the source don't change the hash
+	bytes, _ := json.Marshal(normalised)
+	hasher := sha256.New()
+	hasher.Write(bytes)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Who last saved a dashboard in grafana, when, and the folder it is in
+type LiveMeta struct {
+	FolderUID string    `json:"folderUid"`
+	Updated   time.Time `json:"updated"`
+	UpdatedBy string    `json:"updatedBy"`
+	Version   int       `json:"version"`
+}
+
+// Fetch the live dashboard model and the metadata grafana keeps about it. Returns nil when the dashboard doesn't exist.
+func LiveDashboard(dashboard_uid string, grafana_server string) (map[string]interface{}, LiveMeta, error) {
+
+	request, err := NewGrafanaRequest("GET", grafana_server+"/api/dashboards/uid/"+dashboard_uid, nil)
+	if err != nil {
+		return nil, LiveMeta{}, err
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return nil, LiveMeta{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, LiveMeta{}, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, LiveMeta{}, errors.New("Unexpected " + response.Status + " fetching dashboard " + dashboard_uid)
+	}
+
+	var live struct {
+		Dashboard map[string]interface{} `json:"dashboard"`
+		Meta      LiveMeta               `json:"meta"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&live); err != nil {
+		return nil, LiveMeta{}, err
+	}
+
+	return live.Dashboard, live.Meta, nil
+}
+
+// Helper method to read a rendered dashboard from the dist folder
+func ReadDashboard(dashboard string) (map[string]interface{}, error) {
+
+	bytes, err := ioutil.ReadFile(dashboard)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed_dashboard map[string]interface{}
+	if err := json.Unmarshal(bytes, &parsed_dashboard); err != nil {
+		return nil, errors.New(dashboard + " is not valid json: " + err.Error())
+	}
+
+	return parsed_dashboard, nil
+}
+
+// Helper method to read the version grafana gives a dashboard model, 0 when it has none
+func DashboardVersion(parsed_dashboard map[string]interface{}) int {
+	version, _ := parsed_dashboard["version"].(float64)
+	return int(version)
+}
+
+// Deploy an individual dashboard to a given folder on given grafana server
+func DeployDashboard(dashboard string, folder_uid string, grafana_server string, options DeployOptions) error {
+
+	started := time.Now()
+	row := SummaryRowFor(dashboard)
+	row.Folder = SummaryFolder(folder_uid, grafana_server)
+	defer func() {
+		row.Duration += time.Since(started)
+	}()
+
+	parsed_dashboard, err := ReadDashboard(dashboard)
+	if err != nil {
+		return err
+	}
+
+	// The live dashboard decides whether, and how, to deploy
+	dashboard_uid, _ := parsed_dashboard["uid"].(string)
+	var live map[string]interface{}
+	var live_meta LiveMeta
+	if dashboard_uid != "" && (options.SkipUnchanged || options.Overwrite != "force") {
+		live, live_meta, err = LiveDashboard(dashboard_uid, grafana_server)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Grafana moves a dashboard into the folder it is saved to, so a source moved to another project leaves no copy behind
+	if live != nil && live_meta.FolderUID != folder_uid {
+		Info("Moving " + dashboard_uid + " from folder " + live_meta.FolderUID + " to " + folder_uid)
+	}
+
+	// Formatting only commits render to the same content, so there is nothing to deploy
+	if options.SkipUnchanged && live != nil && live_meta.FolderUID == folder_uid && ContentHash(live) == ContentHash(parsed_dashboard) {
+		Info(Colorize(ColorGrey, "unchanged") + "  " + dashboard)
+		Emit(Event{Event: "deploy-done", Dashboard: dashboard, Server: grafana_server, Result: "unchanged"})
+		row.Skipped++
+		RecordDeployment(dashboard, parsed_dashboard, folder_uid, grafana_server, DashboardVersion(live))
+		return nil
+	}
+
+	// A live version past the one this pipeline last saved means someone saved the dashboard in grafana since
+	if live != nil {
+		deployed_version := EnvironmentDeployments()[dashboard_uid].Versions[grafana_server]
+		live_version := DashboardVersion(live)
+
+		if deployed_version > 0 && live_version > deployed_version {
+
+			// Name the editor so the change can be followed up with them
+			editor := "someone"
+			if live_meta.UpdatedBy != "" {
+				editor = live_meta.UpdatedBy
+			}
+			conflict := fmt.Sprintf("changed in grafana by %s since the last deploy (version %d, deployed %d)", editor, live_version, deployed_version)
+
+			switch options.Overwrite {
+			case "skip-if-newer":
+				fmt.Println(Colorize(ColorYellow, "skipped") + "    " + dashboard + ", " + conflict)
+				Emit(Event{Event: "deploy-done", Dashboard: dashboard, Server: grafana_server, Result: "skipped"})
+				row.Skipped++
+				return nil
+			case "fail-on-conflict":
+				return errors.New("Dashboard " + dashboard_uid + " was " + conflict + ", not overwriting without --overwrite force")
+			default:
+				fmt.Println("WARNING: " + dashboard + " was " + conflict + ", overwriting their changes")
+			}
+		}
+	}
+
+	Verbose("Deploying: " + dashboard)
+	Emit(Event{Event: "deploy-start", Dashboard: dashboard, Server: grafana_server})
+
+	dashboard_command, err := exec.Command("jq", "-c", ".", dashboard).Output()
+	if err != nil {
+		return err
+	}
+
+	dashboard_string := strings.TrimSuffix(string(dashboard_command), "\n")
+
+	// Without overwrite grafana only accepts the save if the live version is still the one we read,
+	// so a change made in between is answered with 412 rather than lost
+	overwrite := "true"
+	if options.Overwrite != "force" {
+		overwrite = "false"
+
+		if live != nil {
+			versioned := map[string]interface{}{}
+			for key, value := range parsed_dashboard {
+				versioned[key] = value
+			}
+			versioned["version"] = DashboardVersion(live)
+
+			bytes, _ := json.Marshal(versioned)
+			dashboard_string = string(bytes)
+		}
+	}
+
+	payload := `{"dashboard": ` + dashboard_string + `, "folderUid": "` + folder_uid + `", "overwrite": ` + overwrite + `}`
+
+	// Grafana 8 only understands numeric folder ids
+	if UsesFolderIDs(grafana_server) {
+		folder_id, err := FolderID(folder_uid, grafana_server)
+		if err != nil {
+			return err
+		}
+		payload = `{"dashboard": ` + dashboard_string + `, "folderId": ` + strconv.Itoa(folder_id) + `, "overwrite": ` + overwrite + `}`
+	}
+
+	// The message shows next to the version in the dashboards version history
+	if options.Message != "" {
+		message, _ := json.Marshal(options.Message)
+		payload = strings.TrimSuffix(payload, "}") + `, "message": ` + string(message) + `}`
+	}
+	//fmt.Println(payload) // Uncomment to debug payloads
+
+	response, err := DoPOST(grafana_server+"/api/dashboards/db", payload)
+	if IsGrafanaStatus(err, http.StatusPreconditionFailed) && options.Overwrite == "skip-if-newer" {
+		fmt.Println(Colorize(ColorYellow, "skipped") + "    " + dashboard + ", " + err.Error())
+		Emit(Event{Event: "deploy-done", Dashboard: dashboard, Server: grafana_server, Result: "skipped"})
+		row.Skipped++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved struct {
+		UID     string `json:"uid"`
+		Version int    `json:"version"`
+		URL     string `json:"url"`
+	}
+	json.Unmarshal(response, &saved)
+
+	// Grafana answering success doesn't guarantee it stored what was sent
+	if options.Verify {
+		if err := VerifyDeployed(parsed_dashboard, saved.UID, grafana_server); err != nil {
+			return err
+		}
+	}
+	RecordDeployedURL(dashboard, saved.URL, folder_uid, grafana_server)
+	Info(Colorize(ColorGreen, "deployed") + "   " + dashboard)
+	Emit(Event{Event: "deploy-done", Dashboard: dashboard, Server: grafana_server, Result: "deployed"})
+	row.Deployed++
+
+	RecordDeployment(dashboard, parsed_dashboard, folder_uid, grafana_server, saved.Version)
+	return nil
+}
+
+// Read a dashboard back after deploying it and check grafana stored the same content that was sent
+func VerifyDeployed(parsed_dashboard map[string]interface{}, dashboard_uid string, grafana_server string) error {
+
+	if dashboard_uid == "" {
+		dashboard_uid, _ = parsed_dashboard["uid"].(string)
+	}
+
+	live, _, err := LiveDashboard(dashboard_uid, grafana_server)
+	if err != nil {
+		return err
+	}
+	if live == nil {
+		return errors.New("Dashboard " + dashboard_uid + " was accepted but not found on " + grafana_server + " after deploying")
+	}
+
+	// Dashboards without a uid in the source get one from grafana
+	sent := map[string]interface{}{}
+	for key, value := range parsed_dashboard {
+		sent[key] = value
+	}
+	sent["uid"] = dashboard_uid
+
+	sent_hash, live_hash := ContentHash(sent), ContentHash(live)
+	if sent_hash != live_hash {
+		return errors.New("Dashboard " + dashboard_uid + " stored on " + grafana_server + " differs from what was deployed (sent " +
+			sent_hash[:12] + ", stored " + live_hash[:12] + ")")
+	}
+
+	Verbose("Verified: " + dashboard_uid)
+	return nil
+}
+
+// Delete a dashboard by uid from the given grafana server
+func DeleteDashboard(dashboard_uid string, grafana_server string) error {
+
+	Info("Deleting dashboard: " + dashboard_uid)
+
+	// Somebody else deleting it first is fine
+	_, err := DoRequest("DELETE", grafana_server+"/api/dashboards/uid/"+dashboard_uid, "")
+	if err != nil && !IsGrafanaStatus(err, http.StatusNotFound) {
+		return err
+	}
+
+	// The pipeline no longer owns the dashboard
+	delete(EnvironmentDeployments(), dashboard_uid)
+	return nil
+}
+
+// Delete a folder and every dashboard in it from the given grafana server. A folder that is already gone is fine.
+func DeletePreviewFolder(folder_uid string, grafana_server string) error {
+
+	dashboards, err := FolderDashboards(folder_uid, grafana_server)
+	if IsGrafanaStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Dashboards are deleted one by one so they also leave the deployment state
+	for _, dashboard := range dashboards {
+		if err := DeleteDashboard(dashboard.UID, grafana_server); err != nil {
+			return err
+		}
+	}
+
+	Info("Deleting folder: " + folder_uid)
+	_, err = DoRequest("DELETE", grafana_server+"/api/folders/"+folder_uid, "")
+	if err != nil && !IsGrafanaStatus(err, http.StatusNotFound) {
+		return err
+	}
+	CacheFolder(folder_uid, nil, grafana_server)
+
+	return nil
+}
+
+// Helper method to parse an age such as 14d, 36h or 90m
+func ParseAge(age string) (time.Duration, error) {
+
+	if days := strings.TrimSuffix(age, "d"); days != age {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, errors.New("Invalid age: " + age)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, errors.New("Invalid age: " + age)
+	}
+
+	return duration, nil
+}
+
+// Helper method to list the rendered dashboard files in the output directory
+func RenderedDashboards(out_dir string) ([]string, error) {
+
+	var dashboards []string
+
+	err := filepath.WalkDir(out_dir, func(file string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(file, ".json") {
+			dashboards = append(dashboards, filepath.ToSlash(file))
+		}
+		return err
+	})
+
+	return dashboards, err
+}
+
+// Helper method to collect every datasource reference in a dashboard, as names or uids
+func DatasourceReferences(node interface{}, references map[string]bool) {
+
+	switch value := node.(type) {
+
+	case map[string]interface{}:
+		for key, child := range value {
+			if key != "datasource" {
+				DatasourceReferences(child, references)
+				continue
+			}
+
+			// Datasources are referenced by name in older dashboards and by {type, uid} in newer ones
+			switch datasource := child.(type) {
+			case string:
+				references[datasource] = true
+			case map[string]interface{}:
+				if uid, ok := datasource["uid"].(string); ok {
+					references[uid] = true
+				}
+			}
+		}
+
+	case []interface{}:
+		for _, child := range value {
+			DatasourceReferences(child, references)
+		}
+	}
+}
+
+// Check that every datasource referenced by the rendered dashboards exists on the target server.
+// Returns a description of each missing reference.
+func ValidateDatasources(out_dir string, grafana_server string) []string {
+
+	Info("Validating datasource references")
+
+	response, err := DoRequest("GET", grafana_server+"/api/datasources", "")
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	var datasources []struct {
+		UID  string `json:"uid"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(response, &datasources); err != nil {
+		Fatalf("ERROR: unexpected datasources response: %s", err)
+	}
+
+	// Built in datasources exist everywhere
+	known := map[string]bool{}
+	for builtin := range builtin_datasources {
+		known[builtin] = true
+	}
+	for _, datasource := range datasources {
+		known[datasource.UID] = true
+		known[datasource.Name] = true
+	}
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	var missing []string
+	for _, dashboard := range dashboards {
+
+		bytes, err := ioutil.ReadFile(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		var parsed_dashboard interface{}
+		json.Unmarshal(bytes, &parsed_dashboard)
+
+		references := map[string]bool{}
+		DatasourceReferences(parsed_dashboard, references)
+
+		for reference := range references {
+
+			// Template variables are resolved by grafana at view time
+			if reference == "" || strings.HasPrefix(reference, "$") || known[reference] {
+				continue
+			}
+
+			missing = append(missing, dashboard+": datasource "+reference+" not found on "+grafana_server)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// Helper method to collect library panel uids a dashboard references, along with their names
+func LibraryPanelReferences(node interface{}, references map[string]string) {
+
+	switch value := node.(type) {
+
+	case map[string]interface{}:
+		if library_panel, ok := value["libraryPanel"].(map[string]interface{}); ok {
+			if uid, ok := library_panel["uid"].(string); ok {
+				name, _ := library_panel["name"].(string)
+				references[uid] = name
+			}
+		}
+		for _, child := range value {
+			LibraryPanelReferences(child, references)
+		}
+
+	case []interface{}:
+		for _, child := range value {
+			LibraryPanelReferences(child, references)
+		}
+	}
+}
+
+// Check if a library panel exists on the target server
+func LibraryPanelExists(uid string, grafana_server string) (bool, error) {
+
+	request, err := NewGrafanaRequest("GET", grafana_server+"/api/library-elements/"+uid, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.New("Unexpected " + response.Status + " looking up library panel " + uid)
+	}
+}
+
+// Check that every library panel referenced by the rendered dashboards exists on the target server,
+// or is bundled with a dashboard in this deploy (the __elements of an exported dashboard).
+// Returns a description of each missing panel.
+func ValidateLibraryPanels(out_dir string, grafana_server string) []string {
+
+	Info("Validating library panel references")
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	bundled := map[string]bool{}
+	referenced_by := map[string][]string{}
+	names := map[string]string{}
+
+	for _, dashboard := range dashboards {
+
+		bytes, err := ioutil.ReadFile(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		var parsed_dashboard map[string]interface{}
+		json.Unmarshal(bytes, &parsed_dashboard)
+
+		if elements, ok := parsed_dashboard["__elements"].(map[string]interface{}); ok {
+			for uid := range elements {
+				bundled[uid] = true
+			}
+		}
+
+		references := map[string]string{}
+		LibraryPanelReferences(parsed_dashboard, references)
+		for uid, name := range references {
+			referenced_by[uid] = append(referenced_by[uid], dashboard)
+			names[uid] = name
+		}
+	}
+
+	var missing []string
+	for uid, dashboards := range referenced_by {
+
+		if bundled[uid] {
+			continue
+		}
+
+		exists, err := LibraryPanelExists(uid, grafana_server)
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		if !exists {
+			missing = append(missing, "library panel "+names[uid]+" ("+uid+") used by "+strings.Join(dashboards, ", "))
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// Helper method to count the panels in a dashboard, including those inside collapsed rows and legacy rows
+func CountPanels(parsed_dashboard map[string]interface{}) int {
+
+	count := 0
+
+	var count_list func(panels interface{})
+	count_list = func(panels interface{}) {
+		list, _ := panels.([]interface{})
+		for _, panel := range list {
+			count++
+			if nested, ok := panel.(map[string]interface{}); ok {
+				count_list(nested["panels"])
+			}
+		}
+	}
+
+	count_list(parsed_dashboard["panels"])
+
+	// Dashboards older than schema 16 keep their panels in rows
+	rows, _ := parsed_dashboard["rows"].([]interface{})
+	for _, row := range rows {
+		if row, ok := row.(map[string]interface{}); ok {
+			count_list(row["panels"])
+		}
+	}
+
+	return count
+}
+
+// Check the rendered dashboards against size and panel count limits.
+// Grafana and proxies in front of it reject very large request bodies, and huge dashboards are slow to load.
+// Returns a description of each dashboard over a limit, a limit of 0 is not checked.
+func ValidateDashboardLimits(out_dir string, max_size_kb int, max_panels int) []string {
+
+	Info("Validating dashboard size and panel count")
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	var problems []string
+	for _, dashboard := range dashboards {
+
+		contents, err := ioutil.ReadFile(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		// Dashboards are posted compacted, so measure them that way rather than as indented on disk
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, contents); err != nil {
+			Fatalf("ERROR: %s is not valid json: %s", dashboard, err)
+		}
+
+		size_kb := compacted.Len() / 1024
+		if max_size_kb > 0 && size_kb > max_size_kb {
+			problems = append(problems, fmt.Sprintf("%s: %d KB exceeds the %d KB limit", dashboard, size_kb, max_size_kb))
+		}
+
+		var parsed_dashboard map[string]interface{}
+		json.Unmarshal(contents, &parsed_dashboard)
+
+		panels := CountPanels(parsed_dashboard)
+		if max_panels > 0 && panels > max_panels {
+			problems = append(problems, fmt.Sprintf("%s: %d panels exceeds the %d panel limit", dashboard, panels, max_panels))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// Create a grafana snapshot of every rendered dashboard so reviewers can see them without a preview deploy.
+// Snapshots expire after the given number of seconds. Returns the snapshot urls keyed by dashboard file.
+func CreateSnapshots(out_dir string, grafana_server string, expires int) map[string]string {
+
+	Info("Creating dashboard snapshots")
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	snapshots := map[string]string{}
+
+	for _, dashboard := range dashboards {
+
+		bytes, err := ioutil.ReadFile(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		var parsed_dashboard map[string]interface{}
+		if err := json.Unmarshal(bytes, &parsed_dashboard); err != nil {
+			Fatalf("ERROR: %s is not valid json: %s", dashboard, err)
+		}
+
+		// Panels show whatever data is embedded in the model, e.g. from the testdata datasource
+		payload, _ := json.Marshal(map[string]interface{}{
+			"dashboard": parsed_dashboard,
+			"name":      parsed_dashboard["title"],
+			"expires":   expires,
+		})
+
+		response, err := DoPOST(grafana_server+"/api/snapshots", string(payload))
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		var snapshot struct {
+			URL string `json:"url"`
+		}
+		json.Unmarshal(response, &snapshot)
+
+		Info("Snapshot of " + dashboard + ": " + snapshot.URL)
+		snapshots[dashboard] = snapshot.URL
+	}
+
+	return snapshots
+}
+
+// Render a png of every deployed dashboard with grafana-image-renderer and save them into preview_dir.
+// Returns the saved image paths keyed by dashboard file.
+func RenderPreviews(out_dir string, grafana_server string, preview_dir string) map[string]string {
+
+	Info("Rendering dashboard previews")
+
+	if err := os.MkdirAll(preview_dir, 0755); err != nil {
+		Fatal(err)
+	}
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	previews := map[string]string{}
+
+	for _, dashboard := range dashboards {
+
+		bytes, err := ioutil.ReadFile(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+
+		var parsed_dashboard struct {
+			UID string `json:"uid"`
+		}
+		json.Unmarshal(bytes, &parsed_dashboard)
+
+		// Previews are best effort, a missing renderer plugin shouldn't fail the deploy
+		image, err := RenderDashboardImage(grafana_server, parsed_dashboard.UID)
+		if err != nil {
+			fmt.Println("Failed to render preview of " + dashboard + ": " + err.Error())
+			continue
+		}
+
+		preview := preview_dir + "/" + parsed_dashboard.UID + ".png"
+		if err := ioutil.WriteFile(preview, image, 0644); err != nil {
+			Fatal(err)
+		}
+
+		Info("Preview of " + dashboard + ": " + preview)
+		previews[dashboard] = preview
+	}
+
+	return previews
+}
+
+// Helper method to render a dashboard to png with grafana-image-renderer
+func RenderDashboardImage(grafana_server string, uid string) ([]byte, error) {
+
+	request, err := NewGrafanaRequest("GET", grafana_server+"/render/d/"+uid+"?width=1600&height=1200&kiosk", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(response.Status)
+	}
+
+	return body, nil
+}
+
+// Helper method to return the uid a dashboard source is deployed with from the default branch
+func LiveUID(source string) string {
+	return SourceUID(source, strings.Replace(DefaultBranch(), "/", "", -1))
+}
+
+// Helper method to compare two images pixel by pixel.
+// Returns an image with the changed pixels in red over a faded copy of after, and the fraction of pixels that changed.
+func ImageDiff(before image.Image, after image.Image) (*image.RGBA, float64) {
+
+	bounds := before.Bounds().Union(after.Bounds())
+	diff := image.NewRGBA(bounds)
+
+	changed := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			point := image.Pt(x, y)
+			r1, g1, b1, a1 := before.At(x, y).RGBA()
+			r2, g2, b2, a2 := after.At(x, y).RGBA()
+			offset := diff.PixOffset(x, y)
+
+			// Anti-aliasing differs slightly between renders, so tiny differences don't count
+			same := point.In(before.Bounds()) && point.In(after.Bounds())
+			for _, delta := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}, {a1, a2}} {
+				if delta[0]>>8 > delta[1]>>8+16 || delta[1]>>8 > delta[0]>>8+16 {
+					same = false
+				}
+			}
+
+			if !same {
+				changed++
+				copy(diff.Pix[offset:offset+4], []uint8{255, 0, 0, 255})
+				continue
+			}
+
+			grey := uint8((r2>>8+g2>>8+b2>>8)/3/4 + 191)
+			copy(diff.Pix[offset:offset+4], []uint8{grey, grey, grey, 255})
+		}
+	}
+
+	total := bounds.Dx() * bounds.Dy()
+	if total == 0 {
+		return diff, 0
+	}
+	return diff, float64(changed) / float64(total)
+}
+
+// Render every deployed preview dashboard and the live dashboard it replaces, and save a before, after and
+// difference image side by side into diff_dir for each dashboard that looks different.
+// Returns the saved comparison paths keyed by dashboard file.
+func VisualDiffs(out_dir string, grafana_server string, diff_dir string) map[string]string {
+
+	Info("Comparing dashboard renders with the live dashboards")
+
+	if err := os.MkdirAll(diff_dir, 0755); err != nil {
+		Fatal(err)
+	}
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	comparisons := map[string]string{}
+
+	for _, dashboard := range dashboards {
+
+		source := rendered_from[dashboard]
+		if source == "" {
+			continue
+		}
+
+		parsed, err := ReadDashboard(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+		uid, _ := parsed["uid"].(string)
+
+		// Like previews, comparisons are best effort and never fail the deploy
+		after_png, err := RenderDashboardImage(grafana_server, uid)
+		if err != nil {
+			fmt.Println("Failed to render " + dashboard + ": " + err.Error())
+			continue
+		}
+		before_png, err := RenderDashboardImage(grafana_server, LiveUID(source))
+		if err != nil {
+			Info("No live render of " + dashboard + " to compare with: " + err.Error())
+			continue
+		}
+
+		before, err := png.Decode(bytes.NewReader(before_png))
+		if err != nil {
+			fmt.Println("Failed to decode render of " + dashboard + ": " + err.Error())
+			continue
+		}
+		after, err := png.Decode(bytes.NewReader(after_png))
+		if err != nil {
+			fmt.Println("Failed to decode render of " + dashboard + ": " + err.Error())
+			continue
+		}
+
+		diff, changed := ImageDiff(before, after)
+		if changed == 0 {
+			Info(Colorize(ColorGrey, "No visual changes to "+dashboard))
+			continue
+		}
+
+		// Before, after and the difference from left to right
+		width := diff.Bounds().Dx()
+		canvas := image.NewRGBA(image.Rect(0, 0, width*3, diff.Bounds().Dy()))
+		for index, side := range []image.Image{before, after, diff} {
+			target := image.Rect(width*index, 0, width*(index+1), diff.Bounds().Dy())
+			draw.Draw(canvas, target, side, side.Bounds().Min, draw.Src)
+		}
+
+		comparison := diff_dir + "/" + uid + ".png"
+		file, err := os.Create(comparison)
+		if err != nil {
+			Fatal(err)
+		}
+		err = png.Encode(file, canvas)
+		file.Close()
+		if err != nil {
+			Fatal(err)
+		}
+
+		fmt.Println(Colorize(ColorYellow, fmt.Sprintf("%s looks different, %.1f%% of pixels changed: %s", dashboard, changed*100, comparison)))
+		comparisons[dashboard] = comparison
+	}
+
+	return comparisons
+}
+
+// A file uploaded to the gitlab project. URL is relative to the project url, FullPath to the server url.
+type GitLabUploaded struct {
+	Markdown string `json:"markdown"`
+	URL      string `json:"url"`
+	FullPath string `json:"full_path"`
+}
+
+// Helper method to upload a file to the gitlab project, returning markdown that embeds it and where it can be found
+func GitLabUpload(file string) (GitLabUploaded, error) {
+
+	CI_API_V4_URL := os.Getenv("CI_API_V4_URL")
+	CI_PROJECT_ID := os.Getenv("CI_PROJECT_ID")
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return GitLabUploaded{}, err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filepath.Base(file))
+	if err != nil {
+		return GitLabUploaded{}, err
+	}
+	part.Write(contents)
+	writer.Close()
+
+	request, err := http.NewRequest("POST", CI_API_V4_URL+"/projects/"+CI_PROJECT_ID+"/uploads", &body)
+	if err != nil {
+		return GitLabUploaded{}, err
+	}
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	request.Header.Add("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return GitLabUploaded{}, err
+	}
+	defer response.Body.Close()
+
+	var upload GitLabUploaded
+	if err := json.NewDecoder(response.Body).Decode(&upload); err != nil {
+		return upload, err
+	}
+
+	if response.StatusCode >= 300 {
+		return GitLabUploaded{}, errors.New("gitlab returned " + response.Status + " uploading " + file)
+	}
+
+	return upload, nil
+}
+
+// Attach the rendered previews to the merge request this pipeline is running for
+func PostPreviewNote(previews map[string]string) error {
+
+	CI_PROJECT_ID := os.Getenv("CI_PROJECT_ID")
+	CI_MERGE_REQUEST_IID := os.Getenv("CI_MERGE_REQUEST_IID")
+
+	var dashboards []string
+	for dashboard := range previews {
+		dashboards = append(dashboards, dashboard)
+	}
+	sort.Strings(dashboards)
+
+	note := "Dashboard previews for this merge request:\n\n"
+	for _, dashboard := range dashboards {
+
+		upload, err := GitLabUpload(previews[dashboard])
+		if err != nil {
+			return err
+		}
+
+		note += "**" + dashboard + "**\n\n" + upload.Markdown + "\n\n"
+	}
+
+	payload, _ := json.Marshal(map[string]string{"body": note})
+	_, err := GitLabPOST("/projects/"+CI_PROJECT_ID+"/merge_requests/"+CI_MERGE_REQUEST_IID+"/notes", string(payload))
+	return err
+}
+
+// Helper method to POST a json payload to the gitlab api.
+// Needs GITLAB_TOKEN as the job token can't write to most endpoints.
+func GitLabPOST(endpoint string, payload string) ([]byte, error) {
+	return GitLabSend("POST", endpoint, payload)
+}
+
+// Helper method to PUT a json payload to the gitlab api, with the same token as GitLabPOST
+func GitLabPUT(endpoint string, payload string) ([]byte, error) {
+	return GitLabSend("PUT", endpoint, payload)
+}
+
+// Helper method to send a json payload to the gitlab api with the token in GITLAB_TOKEN
+func GitLabSend(method string, endpoint string, payload string) ([]byte, error) {
+
+	CI_API_V4_URL, ok := os.LookupEnv("CI_API_V4_URL")
+	if !ok {
+		return nil, errors.New("CI_API_V4_URL env not set")
+	}
+	GITLAB_TOKEN, ok := os.LookupEnv("GITLAB_TOKEN")
+	if !ok {
+		return nil, errors.New("GITLAB_TOKEN env not set")
+	}
+
+	request, err := http.NewRequest(method, CI_API_V4_URL+endpoint, strings.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("PRIVATE-TOKEN", GITLAB_TOKEN)
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 300 {
+		return body, &GitLabError{Endpoint: endpoint, StatusCode: response.StatusCode, Status: response.Status, Body: string(body)}
+	}
+
+	return body, nil
+}
+
+// An error response from the gitlab api
+type GitLabError struct {
+	Endpoint   string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *GitLabError) Error() string {
+	return "gitlab returned " + e.Status + " for " + e.Endpoint + ": " + e.Body
+}
+
+// Helper method to check if an error is a gitlab response with the given status code
+func IsGitLabStatus(err error, status_code int) bool {
+	var gitlab_error *GitLabError
+	return errors.As(err, &gitlab_error) && gitlab_error.StatusCode == status_code
+}
+
+// Helper method to GET from the gitlab api with the token in GITLAB_TOKEN
+func GitLabGET(endpoint string) ([]byte, error) {
+
+	CI_API_V4_URL, ok := os.LookupEnv("CI_API_V4_URL")
+	if !ok {
+		return nil, errors.New("CI_API_V4_URL env not set")
+	}
+	GITLAB_TOKEN, ok := os.LookupEnv("GITLAB_TOKEN")
+	if !ok {
+		return nil, errors.New("GITLAB_TOKEN env not set")
+	}
+
+	request, err := http.NewRequest("GET", CI_API_V4_URL+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("PRIVATE-TOKEN", GITLAB_TOKEN)
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 300 {
+		return body, errors.New("gitlab returned " + response.Status + " for " + endpoint + ": " + string(body))
+	}
+
+	return body, nil
+}
+
+// List the usernames of everyone in a gitlab group, including members inherited from parent groups
+func GitLabGroupMembers(group string) ([]string, error) {
+
+	var usernames []string
+
+	for page := 1; ; page++ {
+
+		body, err := GitLabGET("/groups/" + url.PathEscape(group) + "/members/all?per_page=100&page=" + strconv.Itoa(page))
+		if err != nil {
+			return nil, err
+		}
+
+		var members []struct {
+			Username string `json:"username"`
+		}
+		if err := json.Unmarshal(body, &members); err != nil {
+			return nil, errors.New("Unexpected group members response: " + err.Error())
+		}
+
+		for _, member := range members {
+			usernames = append(usernames, member.Username)
+		}
+
+		if len(members) < 100 {
+			return usernames, nil
+		}
+	}
+}
+
+// Post the snapshot urls as a note on the merge request this pipeline is running for
+func PostSnapshotNote(snapshots map[string]string) error {
+
+	CI_PROJECT_ID := os.Getenv("CI_PROJECT_ID")
+	CI_MERGE_REQUEST_IID := os.Getenv("CI_MERGE_REQUEST_IID")
+
+	// Sort so the note is stable between pipelines
+	var dashboards []string
+	for dashboard := range snapshots {
+		dashboards = append(dashboards, dashboard)
+	}
+	sort.Strings(dashboards)
+
+	note := "Dashboard snapshots for this merge request:\n\n"
+	for _, dashboard := range dashboards {
+		note += "- [" + dashboard + "](" + snapshots[dashboard] + ")\n"
+	}
+
+	payload, _ := json.Marshal(map[string]string{"body": note})
+	_, err := GitLabPOST("/projects/"+CI_PROJECT_ID+"/merge_requests/"+CI_MERGE_REQUEST_IID+"/notes", string(payload))
+	return err
+}
+
+// Post a note on the merge request this pipeline is running for, or update the one an earlier pipeline posted.
+// The note is found by a hidden marker comment at the start of its body, so each pipeline doesn't add another.
+func UpsertMergeRequestNote(marker string, note string) error {
+
+	notes_endpoint := "/projects/" + os.Getenv("CI_PROJECT_ID") + "/merge_requests/" + os.Getenv("CI_MERGE_REQUEST_IID") + "/notes"
+	body := "<!-- " + marker + " -->\n" + note
+	payload, _ := json.Marshal(map[string]string{"body": body})
+
+	for page := 1; ; page++ {
+
+		response, err := GitLabGET(notes_endpoint + "?per_page=100&page=" + strconv.Itoa(page))
+		if err != nil {
+			return err
+		}
+
+		var notes []struct {
+			ID   int    `json:"id"`
+			Body string `json:"body"`
+		}
+		if err := json.Unmarshal(response, &notes); err != nil {
+			return errors.New("Unexpected merge request notes response: " + err.Error())
+		}
+
+		for _, existing := range notes {
+			if strings.HasPrefix(existing.Body, "<!-- "+marker+" -->") {
+				_, err := GitLabPUT(notes_endpoint+"/"+strconv.Itoa(existing.ID), string(payload))
+				return err
+			}
+		}
+
+		if len(notes) < 100 {
+			break
+		}
+	}
+
+	_, err := GitLabPOST(notes_endpoint, string(payload))
+	return err
+}
+
+// A dashboard or folder as returned by grafanas search api
+type SearchResult struct {
+	UID         string   `json:"uid"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"`
+	URL         string   `json:"url"`
+	FolderUID   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+	Tags        []string `json:"tags"`
+}
+
+// List the dashboards in a grafana folder using the search api
+func FolderDashboards(folder_uid string, grafana_server string) ([]SearchResult, error) {
+
+	query := "&folderUIDs=" + url.QueryEscape(folder_uid)
+
+	// Grafana 8 can only search by numeric folder id
+	if UsesFolderIDs(grafana_server) {
+		folder_id, err := FolderID(folder_uid, grafana_server)
+		if err != nil {
+			return nil, err
+		}
+		query = "&folderIds=" + strconv.Itoa(folder_id)
+	}
+
+	return SearchDashboards(grafana_server, query)
+}
+
+// Number of results asked for per page of a grafana list endpoint
+const PageSize = 1000
+
+// Fetch every page of a grafana list endpoint that pages with limit and page parameters, e.g. /api/search.
+// Each page's body is passed to each, which returns how many items it held. Grafana caps results per request,
+// so pages are fetched until a short one comes back.
+func ForEachPage(endpoint string, each func(body []byte) (int, error)) error {
+
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+
+	for page := 1; ; page++ {
+
+		response, err := DoRequest("GET", endpoint+separator+"limit="+strconv.Itoa(PageSize)+"&page="+strconv.Itoa(page), "")
+		if err != nil {
+			return err
+		}
+
+		count, err := each(response)
+		if err != nil {
+			return err
+		}
+		if count < PageSize {
+			return nil
+		}
+	}
+}
+
+// Search the dashboards on a grafana server, narrowed by extra search api query parameters such as &tag=x
+func SearchDashboards(grafana_server string, query string) ([]SearchResult, error) {
+
+	var results []SearchResult
+	err := ForEachPage(grafana_server+"/api/search?type=dash-db"+query, func(body []byte) (int, error) {
+
+		var page []SearchResult
+		if err := json.Unmarshal(body, &page); err != nil {
+			return 0, errors.New("Unexpected search response: " + err.Error())
+		}
+
+		results = append(results, page...)
+		return len(page), nil
+	})
+
+	return results, err
+}
+
+// Delete every dashboard in the folder that the repository no longer produces, so the folder mirrors the branch
+func PruneFolder(folder_uid string, branch string, out_dir string, grafana_server string) error {
+
+	Info("Pruning folder: " + folder_uid)
+
+	// Work out every uid the repo produces, not just the ones rendered in this run
+	sources, err := ListDashboardSources()
+	if err != nil {
+		return err
+	}
+
+	expected := map[string]bool{}
+	for _, source := range sources {
+		expected[SourceUID(source.Path, branch)] = true
+	}
+
+	// Mixin dashboards and metadata uids don't follow the source file name, so take them from the render
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return err
+	}
+	for _, dashboard := range dashboards {
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			return err
+		}
+		if uid, ok := parsed_dashboard["uid"].(string); ok {
+			expected[uid] = true
+		}
+	}
+
+	// Sources not rendered in this run, like an unchanged mixin, still own what they last deployed
+	for uid, deployed := range EnvironmentDeployments() {
+		if _, err := os.Stat(deployed.Source); deployed.Source != "" && err == nil {
+			expected[uid] = true
+		}
+	}
+
+	live, err := FolderDashboards(folder_uid, grafana_server)
+	if err != nil {
+		return err
+	}
+
+	for _, dashboard := range live {
+
+		if expected[dashboard.UID] {
+			continue
+		}
+
+		Info("Pruning orphaned dashboard: " + dashboard.Title + " (" + dashboard.UID + ")")
+		if err := DeleteDashboard(dashboard.UID, grafana_server); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove dashboards whose source file was deleted, or renamed so that it now deploys under a new uid, from every server
+func RemoveStaleDashboards(changed []FileChange, branch string, grafana_servers []string) {
+
+	// Uids still produced by a source in this change set. A file moved between project directories keeps its
+	// uid, and grafana has already moved it into its new folder, so it mustn't be deleted. This also covers
+	// moves the diff reports as a delete and an add.
+	produced := map[string]bool{}
+	for _, change := range changed {
+		if change.Status != "D" {
+			produced[SourceUID(change.Path, branch)] = true
+		}
+	}
+
+	for _, change := range changed {
+
+		var stale_path string
+
+		switch change.Status {
+		case "D":
+			stale_path = change.Path
+		case "R":
+			stale_path = change.OldPath
+		default:
+			continue
+		}
+
+		if !IsDashboardSource(stale_path) {
+			continue
+		}
+
+		stale_uids := []string{SourceUID(stale_path, branch)}
+
+		// Uids set in metadata don't follow the file name, but the state knows what the old path deployed
+		for uid, deployed := range EnvironmentDeployments() {
+			if deployed.Source == stale_path && !contains(stale_uids, uid) {
+				stale_uids = append(stale_uids, uid)
+			}
+		}
+
+		for _, stale_uid := range stale_uids {
+			if produced[stale_uid] {
+				continue
+			}
+
+			Info("Removing dashboard for " + change.Status + " " + stale_path)
+			for _, grafana_server := range grafana_servers {
+				if err := DeleteDashboard(stale_uid, grafana_server); err != nil {
+					Fatalf("ERROR: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// A dashboard that could not be deployed and the reason why
+type DeployFailure struct {
+	Server    string
+	Dashboard string
+	Err       error
+}
+
+// Helper method to list the rendered rule files in a directory
+func RenderedRules(dir string) ([]string, error) {
+
+	var rules []string
+
+	err := filepath.WalkDir(dir, func(file string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(file, ".rules.yaml") {
+			rules = append(rules, filepath.ToSlash(file))
+		}
+		return err
+	})
+
+	return rules, err
+}
+
+// Helper method to send a request to the selected environments ruler
+func RulerRequest(ruler *RulerConfig, method string, url string, content_type string, payload []byte) error {
+
+	request, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", content_type)
+
+	if ruler.Tenant != "" {
+		request.Header.Add("X-Scope-OrgID", ruler.Tenant)
+	}
+	if ruler.Token != "" {
+		request.Header.Add("Authorization", "Bearer "+os.Getenv(ruler.Token))
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode >= 300 {
+		return errors.New("ruler returned " + response.Status + " for " + url + ": " + string(body))
+	}
+
+	return nil
+}
+
+// Deploy the rendered rule files to the selected environments ruler, before the dashboards that query them.
+// Rules for each deploy folder go into a ruler namespace named after the folder uid, so branches don't overwrite each other.
+func DeployRules(out_dir string, branch string, clean_branch string, project string) error {
+
+	targets, err := DeployTargets(out_dir, branch, clean_branch, project)
+	if err != nil {
+		return err
+	}
+
+	ruler := environment.Rules
+	reload := false
+
+	for _, target := range targets {
+
+		rules, err := RenderedRules(target.Path)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range rules {
+
+			if ruler == nil {
+				Info("No ruler configured for " + environment.Name + ", not deploying: " + file)
+				continue
+			}
+
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			if ruler.Type == "prometheus" {
+				// Prometheus reads rule files from disk, so they are copied where it can see them
+				destination := filepath.Join(ruler.Directory, target.FolderUID+"-"+filepath.Base(file))
+				Info("Copying rules: " + file + " to " + destination)
+				if err := ioutil.WriteFile(destination, contents, 0644); err != nil {
+					return err
+				}
+				reload = true
+				continue
+			}
+
+			var rule_file struct {
+				Groups []map[string]interface{} `yaml:"groups"`
+			}
+			if err := yaml.Unmarshal(contents, &rule_file); err != nil {
+				return errors.New("Failed to parse " + file + ": " + err.Error())
+			}
+
+			// Mimir serves the ruler api under its prometheus prefix, cortex under /api/v1
+			endpoint := os.ExpandEnv(ruler.URL) + "/prometheus/config/v1/rules/" + url.PathEscape(target.FolderUID)
+			if ruler.Type == "cortex" {
+				endpoint = os.ExpandEnv(ruler.URL) + "/api/v1/rules/" + url.PathEscape(target.FolderUID)
+			}
+
+			// The ruler api takes one group per request, replacing any group with the same name
+			for _, group := range rule_file.Groups {
+
+				Verbosef("Deploying rule group: %v from %s\n", group["name"], file)
+
+				payload, err := yaml.Marshal(group)
+				if err != nil {
+					return err
+				}
+
+				if err := RulerRequest(ruler, "POST", endpoint, "application/yaml", payload); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if reload && ruler.ReloadURL != "" {
+		Info("Reloading prometheus rules")
+		return RulerRequest(ruler, "POST", os.ExpandEnv(ruler.ReloadURL), "text/plain", nil)
+	}
+
+	return nil
+}
+
+// Validate, deploy, prune and preview the rendered dashboards on one grafana server
+func DeployToServer(grafana_server string, out_dir string, branch string, clean_branch string, project string, options DeployOptions) []DeployFailure {
+
+	EnterPhase("validate")
+	StartSection("validate "+grafana_server, "Validating dashboards against "+grafana_server, true)
+
+	// Catch dashboards that would show "No data" because their datasource doesn't exist there
+	if options.DatasourceCheck != "off" {
+		missing := ValidateDatasources(out_dir, grafana_server)
+		for _, problem := range missing {
+			fmt.Println("WARNING: " + problem)
+		}
+		if len(missing) > 0 && options.DatasourceCheck == "fail" {
+			Fatalf("ERROR: %d missing datasource reference(s)", len(missing))
+		}
+		MarkValidated(missing)
+	}
+
+	// Library panels must exist before the dashboards that use them are deployed
+	if options.LibraryPanelCheck != "off" {
+		missing := ValidateLibraryPanels(out_dir, grafana_server)
+		if len(missing) > 0 {
+			fmt.Println("Missing library panels:")
+			for _, problem := range missing {
+				fmt.Println("  " + problem)
+			}
+			if options.LibraryPanelCheck == "fail" {
+				Fatalf("ERROR: %d missing library panel(s)", len(missing))
+			}
+		}
+		MarkValidated(missing)
+	}
+
+	EndSection("validate " + grafana_server)
+	EnterPhase("deploy")
+
+	// Work out which folders the dashboards go into
+	targets, err := DeployTargets(out_dir, branch, clean_branch, project)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Teams have to exist before folders can grant them permissions
+	team_ids, err := SyncTeams(grafana_server)
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Group the branch or project folders under a parent folder when configured
+	parent_uid := ""
+	if parent := ParentFolderTitle(clean_branch); parent != "" {
+		parent_uid, err = CreateParentFolder(parent, grafana_server)
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+	}
+
+	// Create a folder on that server for the dashboards
+	for _, target := range targets {
+
+		// Nothing is deployed into a folder whose dashboards all go elsewhere
+		if !NeedsFolder(target) {
+			continue
+		}
+
+		// Without a folder there is nowhere to deploy to, so this is always fatal
+		if err := CreateGrafanaFolder(target.FolderUID, target.FolderTitle, parent_uid, grafana_server); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		// Branch previews are removed by cleanup once they stop being deployed to
+		if !IsDefaultBranch(clean_branch) {
+			RecordPreview(target.FolderUID, branch)
+		}
+
+		if err := ApplyFolderPermissions(target.FolderUID, config.FolderPermissions, team_ids, grafana_server); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+	}
+
+	// And the folders dashboards asked for in their metadata
+	created := map[string]bool{}
+	for dashboard, folder_title := range folder_overrides {
+
+		folder_uid := TargetFolder(dashboard, "")
+		if created[folder_uid] || folder_uid == "" {
+			continue
+		}
+		created[folder_uid] = true
+
+		// Metadata can nest the folder in a parent of its own, otherwise it sits with the branch folders
+		override_parent_uid := parent_uid
+		if parent := folder_parents[dashboard]; parent != "" {
+			override_parent_uid, err = CreateParentFolder(parent, grafana_server)
+			if err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+		}
+
+		if err := CreateGrafanaFolder(folder_uid, folder_title, override_parent_uid, grafana_server); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		if err := ApplyFolderPermissions(folder_uid, config.FolderPermissions, team_ids, grafana_server); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+	}
+
+	// Prove the deploy works on a small subset before touching everything else
+	if options.Canary != "" {
+		if failures := DeployCanary(targets, grafana_server, options); len(failures) > 0 {
+			fmt.Println("Canary deploy failed, not deploying remaining dashboards")
+			return failures
+		}
+	}
+
+	var failures []DeployFailure
+
+	for _, target := range targets {
+
+		if options.ProjectSections {
+			StartSection("project "+target.FolderUID+" "+grafana_server, "Deploying "+target.FolderTitle, false)
+		}
+
+		// Deploy the dashboards to that folder
+		failures = append(failures, DeployAllDashboards(target.Path, target.FolderUID, grafana_server, options)...)
+
+		if options.ProjectSections {
+			EndSection("project " + target.FolderUID + " " + grafana_server)
+		}
+	}
+
+	// Don't prune or preview a partially deployed server
+	if len(failures) > 0 || Interrupted() {
+		return failures
+	}
+
+	// Remove anything in the folders the branch no longer contains
+	if options.Prune {
+		for _, target := range targets {
+			if err := PruneFolder(target.FolderUID, clean_branch, out_dir, grafana_server); err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+		}
+	}
+
+	if err := ApplyDashboardPermissions(out_dir, team_ids, grafana_server); err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Public dashboards are shared from the default branch only, never from branch previews
+	if IsDefaultBranch(clean_branch) {
+		if err := ApplyPublicDashboards(out_dir, grafana_server); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+	}
+
+	// Playlists refer to dashboards by uid, so they are only updated once the dashboards exist
+	if err := DeployPlaylists(clean_branch, grafana_server); err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Capture what the deployed dashboards look like for reviewers
+	if options.PreviewDir != "" {
+		previews := RenderPreviews(out_dir, grafana_server, options.PreviewDir)
+
+		if os.Getenv("CI_MERGE_REQUEST_IID") != "" && os.Getenv("GITLAB_TOKEN") != "" && len(previews) > 0 {
+			if err := PostPreviewNote(previews); err != nil {
+				Fatal(err)
+			}
+		}
+	}
+
+	// Catch visual regressions by comparing preview renders with the dashboards they would replace
+	if options.VisualDiffDir != "" && !IsDefaultBranch(clean_branch) {
+		VisualDiffs(out_dir, grafana_server, options.VisualDiffDir)
+	}
+
+	return failures
+}
+
+// Settings for a dashboard that live outside its model, read from a <name>.meta.yaml file next to the source.
+// Folder and UID only apply on the default branch, branch previews stay in their branch folder with branch uids.
+type DashboardMetadata struct {
+	// Title of a folder to deploy into instead of the branch or project folder
+	Folder string `yaml:"folder"`
+
+	// Tags added to the dashboards own
+	Tags []string `yaml:"tags"`
+
+	// Team permissions on the dashboard, on top of those it inherits from its folder
+	Permissions []FolderPermission `yaml:"permissions"`
+
+	// Environments the dashboard is deployed to, empty for all of them
+	Environments []string `yaml:"environments"`
+
+	// Fixed uid for the dashboard
+	UID string `yaml:"uid"`
+
+	// Title of a folder to nest the metadata folder in, instead of the configured parent_folder
+	ParentFolder string `yaml:"parent_folder"`
+
+	Public *PublicDashboard `yaml:"public"`
+}
+
+// Whether and how a dashboard is shared as a grafana public dashboard
+type PublicDashboard struct {
+	Enabled       bool `yaml:"enabled"`
+	TimeSelection bool `yaml:"time_selection"`
+	Annotations   bool `yaml:"annotations"`
+}
+
+// Helper method to return the metadata file path for a dashboard source, e.g. dashboards/x/api.meta.yaml for dashboards/x/api.jsonnet
+func MetadataFile(source string) string {
+	return strings.TrimSuffix(source, path.Ext(source)) + ".meta.yaml"
+}
+
+// Helper method to load the metadata for a dashboard source. Dashboards without a metadata file get empty metadata.
+func LoadMetadata(source string) (DashboardMetadata, error) {
+
+	metadata := DashboardMetadata{}
+
+	bytes, err := ioutil.ReadFile(MetadataFile(source))
+	if errors.Is(err, os.ErrNotExist) {
+		return metadata, nil
+	}
+	if err != nil {
+		return metadata, err
+	}
+
+	if err := yaml.Unmarshal(bytes, &metadata); err != nil {
+		return metadata, errors.New("Failed to parse " + MetadataFile(source) + ": " + err.Error())
+	}
+
+	teams := map[string]bool{}
+	for _, team := range config.Teams {
+		teams[team.Name] = true
+	}
+	for _, permission := range metadata.Permissions {
+		if !teams[permission.Team] {
+			return metadata, errors.New(MetadataFile(source) + " refers to unknown team: " + permission.Team)
+		}
+		if _, ok := permission_levels[permission.Permission]; !ok {
+			return metadata, errors.New(MetadataFile(source) + " has unknown permission " + permission.Permission + ", expected view, edit or admin")
+		}
+	}
+
+	if metadata.UID != "" && len(metadata.UID) > MaxUIDLength {
+		return metadata, errors.New(MetadataFile(source) + " uid is longer than 40 characters")
+	}
+
+	return metadata, nil
+}
+
+// Helper method to find the dashboard source a metadata file belongs to. Returns an empty string if there isn't one.
+func MetadataSource(file string) string {
+
+	base := strings.TrimSuffix(file, ".meta.yaml")
+	for _, extension := range []string{".jsonnet", ".json"} {
+		if _, err := os.Stat(base + extension); err == nil {
+			return base + extension
+		}
+	}
+
+	return ""
+}
+
+// Rendered dashboards that asked for a folder of their own in their metadata, mapped to the folder title
+var folder_overrides = map[string]string{}
+
+// The parent folder title metadata asked for each override folder to be nested in, keyed the same way
+var folder_parents = map[string]string{}
+
+// Helper method to return the folder a rendered dashboard deploys into, honouring a metadata folder override
+func TargetFolder(dashboard string, folder_uid string) string {
+
+	if folder_title, ok := folder_overrides[dashboard]; ok {
+
+		// Grafanas root folder has an empty uid
+		if strings.EqualFold(folder_title, GeneralFolder) {
+			return ""
+		}
+		return FolderUID("folder-" + Slugify(folder_title))
+	}
+
+	return folder_uid
+}
+
+// The title of grafanas root folder, which always exists and can't be created
+const GeneralFolder = "General"
+
+// Helper method to turn any name into a lowercase slug, e.g. team-payments for "Team Payments"
+func Slugify(name string) string {
+	slug := regexp.MustCompile("[^a-z0-9]+").ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(slug, "-")
+}
+
+// Set the team permissions of every rendered dashboard whose metadata has any
+func ApplyDashboardPermissions(out_dir string, team_ids map[string]int, grafana_server string) error {
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dashboard := range dashboards {
+
+		metadata, err := LoadMetadata(rendered_from[dashboard])
+		if err != nil {
+			return err
+		}
+		if len(metadata.Permissions) == 0 {
+			continue
+		}
+
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			return err
+		}
+		dashboard_uid, _ := parsed_dashboard["uid"].(string)
+
+		Info("Setting permissions on dashboard: " + dashboard_uid)
+
+		var items []map[string]interface{}
+		for _, permission := range metadata.Permissions {
+			items = append(items, map[string]interface{}{"teamId": team_ids[permission.Team], "permission": permission_levels[permission.Permission]})
+		}
+
+		payload, _ := json.Marshal(map[string]interface{}{"items": items})
+		if _, err := DoPOST(grafana_server+"/api/dashboards/uid/"+dashboard_uid+"/permissions", string(payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create, update or disable the public dashboard of every rendered dashboard whose metadata has a public section
+func ApplyPublicDashboards(out_dir string, grafana_server string) error {
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dashboard := range dashboards {
+
+		metadata, err := LoadMetadata(rendered_from[dashboard])
+		if err != nil {
+			return err
+		}
+		if metadata.Public == nil {
+			continue
+		}
+
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			return err
+		}
+		dashboard_uid, _ := parsed_dashboard["uid"].(string)
+		endpoint := grafana_server + "/api/dashboards/uid/" + dashboard_uid + "/public-dashboards"
+
+		request, err := NewGrafanaRequest("GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+		response, err := http_client.Do(request)
+		if err != nil {
+			return err
+		}
+
+		var existing struct {
+			UID         string `json:"uid"`
+			AccessToken string `json:"accessToken"`
+		}
+		if response.StatusCode == http.StatusOK {
+			json.NewDecoder(response.Body).Decode(&existing)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+			return errors.New("Unexpected " + response.Status + " fetching public dashboard for " + dashboard_uid)
+		}
+
+		// Nothing to disable on a dashboard that was never shared
+		if existing.UID == "" && !metadata.Public.Enabled {
+			continue
+		}
+
+		payload, _ := json.Marshal(map[string]interface{}{
+			"isEnabled":            metadata.Public.Enabled,
+			"timeSelectionEnabled": metadata.Public.TimeSelection,
+			"annotationsEnabled":   metadata.Public.Annotations,
+			"share":                "public",
+		})
+
+		var saved []byte
+		if existing.UID == "" {
+			Info("Creating public dashboard for: " + dashboard)
+			saved, err = DoPOST(endpoint, string(payload))
+		} else {
+			Info("Updating public dashboard for: " + dashboard)
+			saved, err = DoRequest("PATCH", endpoint+"/"+existing.UID, string(payload))
+		}
+		if err != nil {
+			return err
+		}
+
+		if metadata.Public.Enabled {
+			json.Unmarshal(saved, &existing)
+			Info("Public dashboard: " + grafana_server + "/public-dashboards/" + existing.AccessToken)
+		}
+	}
+
+	return nil
+}
+
+// A playlist defined in the repository, an ordered list of dashboards to cycle through.
+// Each item is one of a dashboard source path, a dashboard uid or a tag.
+type Playlist struct {
+	Name     string         `yaml:"name"`
+	Interval string         `yaml:"interval"`
+	Items    []PlaylistItem `yaml:"items"`
+}
+
+type PlaylistItem struct {
+	Dashboard string `yaml:"dashboard"`
+	UID       string `yaml:"uid"`
+	Tag       string `yaml:"tag"`
+}
+
+// Helper method to load every playlist definition in the playlists directory
+func LoadPlaylists(dir string) ([]Playlist, error) {
+
+	items, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var playlists []Playlist
+	for _, item := range items {
+
+		if item.IsDir() || !(strings.HasSuffix(item.Name(), ".yaml") || strings.HasSuffix(item.Name(), ".yml")) {
+			continue
+		}
+
+		bytes, err := ioutil.ReadFile(dir + "/" + item.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		var playlist Playlist
+		if err := yaml.Unmarshal(bytes, &playlist); err != nil {
+			return nil, errors.New("Failed to parse " + dir + "/" + item.Name() + ": " + err.Error())
+		}
+		if playlist.Name == "" {
+			return nil, errors.New("Playlist " + dir + "/" + item.Name() + " has no name")
+		}
+		if playlist.Interval == "" {
+			playlist.Interval = "5m"
+		}
+
+		playlists = append(playlists, playlist)
+	}
+
+	return playlists, nil
+}
+
+// Create or update the repositories playlists on a grafana server.
+// Dashboard items are resolved to the uid the dashboard gets on this branch, and on other
+// branches the playlist names are prefixed like dashboard titles so they don't replace the real ones.
+func DeployPlaylists(branch string, grafana_server string) error {
+
+	playlists, err := LoadPlaylists(config.Playlists)
+	if err != nil || len(playlists) == 0 {
+		return err
+	}
+
+	// Playlist uids and dashboard_by_uid items arrived in grafana 9
+	if UsesFolderIDs(grafana_server) {
+		fmt.Println("WARNING: playlists need grafana 9 or newer, not deploying them to " + grafana_server)
+		return nil
+	}
+
+	response, err := DoRequest("GET", grafana_server+"/api/playlists", "")
+	if err != nil {
+		return err
+	}
+
+	var existing []struct {
+		UID  string `json:"uid"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(response, &existing); err != nil {
+		return errors.New("Unexpected playlists response: " + err.Error())
+	}
+
+	for _, playlist := range playlists {
+
+		name := playlist.Name
+		if (config.BranchTitlePrefix == nil || *config.BranchTitlePrefix) && !IsDefaultBranch(branch) {
+			name = "[" + BranchSlug(branch) + "] " + name
+		}
+
+		items := []map[string]string{}
+		for _, item := range playlist.Items {
+			switch {
+			case item.Dashboard != "":
+				items = append(items, map[string]string{"type": "dashboard_by_uid", "value": SourceUID(item.Dashboard, branch)})
+			case item.UID != "":
+				items = append(items, map[string]string{"type": "dashboard_by_uid", "value": item.UID})
+			case item.Tag != "":
+				items = append(items, map[string]string{"type": "dashboard_by_tag", "value": item.Tag})
+			}
+		}
+
+		payload, err := json.Marshal(map[string]interface{}{"name": name, "interval": playlist.Interval, "items": items})
+		if err != nil {
+			return err
+		}
+
+		uid := ""
+		for _, live := range existing {
+			if live.Name == name {
+				uid = live.UID
+			}
+		}
+
+		if uid == "" {
+			Info("Creating playlist: " + name)
+			_, err = DoRequest("POST", grafana_server+"/api/playlists", string(payload))
+		} else {
+			Info("Updating playlist: " + name)
+			_, err = DoRequest("PUT", grafana_server+"/api/playlists/"+uid, string(payload))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deploy the dashboards whose source matches the canary glob, then read each back to check it landed.
+// Returns failures for any canary that didn't deploy or couldn't be verified.
+func DeployCanary(targets []DeployTarget, grafana_server string, options DeployOptions) []DeployFailure {
+
+	Info("Deploying canary dashboards matching: " + options.Canary)
+
+	var failures []DeployFailure
+	canaries := 0
+
+	for _, target := range targets {
+
+		dashboards, err := RenderedDashboards(target.Path)
+		if err != nil {
+			Fatal(err)
+		}
+
+		for _, dashboard := range dashboards {
+
+			// Canaries are selected by their source path, like --only
+			if len(FilterChanges([]FileChange{{Path: rendered_from[dashboard]}}, []string{options.Canary}, nil)) == 0 {
+				continue
+			}
+			canaries++
+
+			folder_uid := TargetFolder(dashboard, target.FolderUID)
+
+			err := DeployDashboard(dashboard, folder_uid, grafana_server, options)
+			if err == nil {
+				err = VerifyCanary(dashboard, folder_uid, grafana_server)
+			}
+
+			if err != nil {
+				Emit(Event{Event: "error", Dashboard: dashboard, Server: grafana_server, Error: err.Error()})
+				failures = append(failures, DeployFailure{Server: grafana_server, Dashboard: dashboard, Err: err})
+				SummaryRowFor(dashboard).Failed++
+			} else {
+				Info("Canary verified: " + dashboard)
+			}
+		}
+	}
+
+	// A canary glob that matches nothing is almost certainly a typo
+	if canaries == 0 {
+		Fatalf("ERROR: canary %s matched no rendered dashboards", options.Canary)
+	}
+
+	return failures
+}
+
+// Check a canary dashboard can be read back from the folder it was deployed to
+func VerifyCanary(dashboard string, folder_uid string, grafana_server string) error {
+
+	parsed_dashboard, err := ReadDashboard(dashboard)
+	if err != nil {
+		return err
+	}
+
+	dashboard_uid, _ := parsed_dashboard["uid"].(string)
+	live, live_meta, err := LiveDashboard(dashboard_uid, grafana_server)
+	if err != nil {
+		return err
+	}
+
+	if live == nil {
+		return errors.New("canary " + dashboard_uid + " not found after deploy")
+	}
+	if live_meta.FolderUID != folder_uid {
+		return errors.New("canary " + dashboard_uid + " is in folder " + live_meta.FolderUID + " instead of " + folder_uid)
+	}
+
+	return nil
+}
+
+// A dashboard saved during the run and where to find it
+type DeployedDashboard struct {
+	Server    string `json:"server"`
+	Dashboard string `json:"dashboard"`
+	URL       string `json:"url"`
+	FolderURL string `json:"folder_url,omitempty"`
+}
+
+// Dashboards saved during the run, in the order they were deployed
+var deployed_dashboards []DeployedDashboard
+
+// Helper method to turn a url path grafana returned, which already includes any sub path, into a full url on the server
+func GrafanaLink(grafana_server string, link string) string {
+
+	parsed, err := url.Parse(grafana_server)
+	if err != nil || parsed.Host == "" {
+		return grafana_server + link
+	}
+
+	return parsed.Scheme + "://" + parsed.Host + link
+}
+
+// Helper method to remember where a saved dashboard, and the folder it was saved to, can be found
+func RecordDeployedURL(dashboard string, link string, folder_uid string, grafana_server string) {
+
+	deployed := DeployedDashboard{Server: grafana_server, Dashboard: dashboard, URL: GrafanaLink(grafana_server, link)}
+
+	// Folders are cached by now, so this doesn't cost a request per dashboard
+	if folder_uid != "" {
+		if folder, err := LookupFolder(folder_uid, grafana_server); err == nil && folder != nil && folder.URL != "" {
+			deployed.FolderURL = GrafanaLink(grafana_server, folder.URL)
+		}
+	}
+
+	deployed_dashboards = append(deployed_dashboards, deployed)
+}
+
+// A dashboard that failed to deploy, as written to the run summary
+type SummaryFailure struct {
+	Server    string `json:"server"`
+	Dashboard string `json:"dashboard"`
+	Error     string `json:"error"`
+}
+
+// What a deploy did, kept as a job artifact. It is written when the run is interrupted too, covering what was done by then.
+type RunSummary struct {
+	Interrupted bool                `json:"interrupted"`
+	Servers     []string            `json:"servers"`
+	Deployed    []DeployedDashboard `json:"deployed"`
+	Failed      []SummaryFailure    `json:"failed"`
+}
+
+// Helper method to list the failures on the servers deployed to in a form that can be written as json
+func SummaryFailures(grafana_servers []string, server_failures map[string][]DeployFailure) []SummaryFailure {
+
+	failed := []SummaryFailure{}
+	for _, grafana_server := range grafana_servers {
+		for _, failure := range server_failures[grafana_server] {
+			failed = append(failed, SummaryFailure{Server: failure.Server, Dashboard: failure.Dashboard, Error: failure.Err.Error()})
+		}
+	}
+
+	return failed
+}
+
+// Write the run summary for the servers deployed to
+func WriteRunSummary(file string, grafana_servers []string, server_failures map[string][]DeployFailure) error {
+
+	summary := RunSummary{
+		Interrupted: Interrupted(),
+		Servers:     grafana_servers,
+		Deployed:    deployed_dashboards,
+		Failed:      SummaryFailures(grafana_servers, server_failures),
+	}
+
+	bytes, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, bytes, 0644)
+}
+
+// What a hook is told about the run. Dashboards are the changed sources before rendering and the rendered files after.
+type HookContext struct {
+	Hook        string              `json:"hook"`
+	Branch      string              `json:"branch"`
+	Environment string              `json:"environment"`
+	Servers     []string            `json:"servers"`
+	OutDir      string              `json:"out_dir"`
+	Dashboards  []string            `json:"dashboards"`
+	Deployed    []DeployedDashboard `json:"deployed,omitempty"`
+	Failed      []SummaryFailure    `json:"failed,omitempty"`
+}
+
+// Run the hooks configured for one point of the deploy, returning an error for the first that fails and isn't allowed to
+func RunHooks(hooks []Hook, context HookContext) error {
+
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(context)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+
+		var err error
+		name := hook.Command
+		if hook.Command != "" {
+			Info("Running " + context.Hook + " hook: " + hook.Command)
+
+			// Commands get the basics as variables too, so simple shell hooks don't need to parse json
+			cmd := exec.Command("sh", "-c", hook.Command)
+			cmd.Stdin = bytes.NewReader(payload)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Env = append(os.Environ(),
+				"GRAFANA_HOOK="+context.Hook,
+				"GRAFANA_BRANCH="+context.Branch,
+				"GRAFANA_ENVIRONMENT="+context.Environment,
+				"GRAFANA_OUT_DIR="+context.OutDir,
+			)
+			err = cmd.Run()
+		} else {
+			name = hook.URL
+			Info("Calling " + context.Hook + " webhook: " + hook.URL)
+			err = PostWebhook(os.ExpandEnv(hook.URL), payload, "")
+		}
+
+		if err == nil {
+			continue
+		}
+		if hook.AllowFailure {
+			fmt.Println("WARNING: " + context.Hook + " hook " + name + " failed: " + err.Error())
+			continue
+		}
+		return errors.New(context.Hook + " hook " + name + " failed: " + err.Error())
+	}
+
+	return nil
+}
+
+// Helper method to POST a json payload to a webhook, failing on any response other than a success.
+// With a secret the payload is signed so the receiver can check where it came from.
+func PostWebhook(url string, payload []byte, secret string) error {
+
+	request, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		request.Header.Add("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("webhook returned " + response.Status)
+	}
+
+	return nil
+}
+
+// The outcome of a deploy as posted to the completion webhook.
+// Status is success, partial (some dashboards failed), failed (nothing deployed) or interrupted.
+type CompletionPayload struct {
+	Status      string              `json:"status"`
+	Project     string              `json:"project"`
+	Branch      string              `json:"branch"`
+	Commit      string              `json:"commit"`
+	Pipeline    string              `json:"pipeline"`
+	Environment string              `json:"environment"`
+	Servers     []string            `json:"servers"`
+	Deployed    []DeployedDashboard `json:"deployed"`
+	Failed      []SummaryFailure    `json:"failed"`
+	Finished    string              `json:"finished"`
+}
+
+// Post the outcome of a deploy to the completion webhook, if one is configured.
+// Downstream automation failing shouldn't fail a deploy, so problems are only warnings.
+func PostCompletionWebhook(branch string, grafana_servers []string, server_failures map[string][]DeployFailure) {
+
+	if config.CompletionWebhook == nil || config.CompletionWebhook.URL == "" {
+		return
+	}
+
+	failed := SummaryFailures(grafana_servers, server_failures)
+	deployed := deployed_dashboards
+	if deployed == nil {
+		deployed = []DeployedDashboard{}
+	}
+	if grafana_servers == nil {
+		grafana_servers = []string{}
+	}
+
+	status := "success"
+	switch {
+	case Interrupted():
+		status = "interrupted"
+	case len(failed) > 0 && len(deployed) > 0:
+		status = "partial"
+	case len(failed) > 0:
+		status = "failed"
+	}
+
+	payload, err := json.Marshal(CompletionPayload{
+		Status:      status,
+		Project:     os.Getenv("CI_PROJECT_PATH"),
+		Branch:      branch,
+		Commit:      os.Getenv("CI_COMMIT_SHA"),
+		Pipeline:    os.Getenv("CI_PIPELINE_URL"),
+		Environment: environment.Name,
+		Servers:     grafana_servers,
+		Deployed:    deployed,
+		Failed:      failed,
+		Finished:    time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		fmt.Println("WARNING: could not build the completion webhook payload: " + err.Error())
+		return
+	}
+
+	secret := ""
+	if config.CompletionWebhook.Secret != "" {
+		secret = os.Getenv(config.CompletionWebhook.Secret)
+	}
+
+	Info("Posting the deploy outcome to the completion webhook")
+	if err := PostWebhook(os.ExpandEnv(config.CompletionWebhook.URL), payload, secret); err != nil {
+		fmt.Println("WARNING: completion webhook failed: " + err.Error())
+	}
+}
+
+// Helper method to check if a tag releases the dashboards
+func IsReleaseTag(tag string) bool {
+	return tag != "" && MatchGlob(config.ReleaseTags, tag)
+}
+
+// What a release deployed, kept as a job artifact so the release can be traced back to its dashboards
+type ReleaseArtifact struct {
+	Tag         string              `json:"tag"`
+	Commit      string              `json:"commit"`
+	Environment string              `json:"environment"`
+	Servers     []string            `json:"servers"`
+	Released    string              `json:"released"`
+	Dashboards  []DeployedDashboard `json:"dashboards"`
+}
+
+// Write the release artifact for a tag, listing every dashboard the run deployed
+func WriteReleaseArtifact(file string, tag string, grafana_servers []string) error {
+
+	release := ReleaseArtifact{
+		Tag:         tag,
+		Commit:      os.Getenv("CI_COMMIT_SHA"),
+		Environment: environment.Name,
+		Servers:     grafana_servers,
+		Released:    time.Now().UTC().Format(time.RFC3339),
+		Dashboards:  deployed_dashboards,
+	}
+
+	bytes, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, bytes, 0644)
+}
+
+// Helper method to zip the files under a directory, with paths in the archive relative to it
+func ZipDirectory(dir string, file string) error {
+
+	output, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	archive := zip.NewWriter(output)
+
+	err = filepath.WalkDir(dir, func(name string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		writer, err := archive.Create(filepath.ToSlash(relative))
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(contents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// Helper method to describe the dashboards in a release as markdown, linking each to where it was deployed
+func ReleaseDescription(tag string, out_dir string) (string, error) {
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Every server gets the same dashboards, the first one deployed to is linked
+	links := map[string]string{}
+	for _, deployed := range deployed_dashboards {
+		if links[deployed.Dashboard] == "" {
+			links[deployed.Dashboard] = deployed.URL
+		}
+	}
+
+	description := fmt.Sprintf("%d dashboard(s) released to %s.\n\n", len(dashboards), environment.Name)
+	description += "| Dashboard | UID | File |\n|---|---|---|\n"
+	for _, dashboard := range dashboards {
+
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			return "", err
+		}
+		title, _ := parsed_dashboard["title"].(string)
+		uid, _ := parsed_dashboard["uid"].(string)
+
+		if links[dashboard] != "" {
+			title = "[" + title + "](" + links[dashboard] + ")"
+		}
+		description += "| " + title + " | `" + uid + "` | " + strings.TrimPrefix(dashboard, out_dir+"/") + " |\n"
+	}
+
+	return description, nil
+}
+
+// Create a gitlab release for a tag, with the rendered dashboards attached as a zip
+func CreateGitLabRelease(tag string, out_dir string) error {
+
+	bundle := "dashboards-" + Slugify(tag) + ".zip"
+	if err := ZipDirectory(out_dir, bundle); err != nil {
+		return errors.New("Zipping " + out_dir + ": " + err.Error())
+	}
+
+	upload, err := GitLabUpload(bundle)
+	if err != nil {
+		return err
+	}
+
+	// Newer gitlab returns the upload path from the server root, older gitlab only relative to the project
+	link := os.Getenv("CI_PROJECT_URL") + upload.URL
+	if upload.FullPath != "" {
+		link = os.Getenv("CI_SERVER_URL") + upload.FullPath
+	}
+
+	description, err := ReleaseDescription(tag, out_dir)
+	if err != nil {
+		return err
+	}
+
+	release := map[string]interface{}{
+		"tag_name":    tag,
+		"name":        "Dashboards " + tag,
+		"description": description,
+		"assets": map[string]interface{}{
+			"links": []map[string]string{{"name": bundle, "url": link, "link_type": "package"}},
+		},
+	}
+	payload, _ := json.Marshal(release)
+
+	releases_endpoint := "/projects/" + os.Getenv("CI_PROJECT_ID") + "/releases"
+	_, err = GitLabPOST(releases_endpoint, string(payload))
+	if !IsGitLabStatus(err, http.StatusConflict) {
+		return err
+	}
+
+	// A retried release job finds the release already made, so it is brought up to date instead
+	Info("Gitlab release " + tag + " already exists, updating it")
+	update, _ := json.Marshal(map[string]string{"name": "Dashboards " + tag, "description": description})
+	if _, err := GitLabPUT(releases_endpoint+"/"+url.PathEscape(tag), string(update)); err != nil {
+		return err
+	}
+
+	// Links can't be changed with the release, and the bundle is re-uploaded so its link is new
+	link_payload, _ := json.Marshal(map[string]string{"name": bundle, "url": link, "link_type": "package"})
+	_, err = GitLabPOST(releases_endpoint+"/"+url.PathEscape(tag)+"/assets/links", string(link_payload))
+	if IsGitLabStatus(err, http.StatusBadRequest) {
+		fmt.Println("WARNING: gitlab release " + tag + " already links a " + bundle + ", leaving it in place")
+		return nil
+	}
+	return err
+}
+
+// Print the outcome of the deploy on each server, along with any dashboards over the size limits.
+// Returns true if every server succeeded.
+func ReportServerResults(grafana_servers []string, server_failures map[string][]DeployFailure, oversized []string) bool {
+
+	fmt.Println(" ")
+	fmt.Println(" ")
+
+	var failures []DeployFailure
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVER\tRESULT")
+	for _, grafana_server := range grafana_servers {
+		if len(server_failures[grafana_server]) == 0 {
+			fmt.Fprintf(writer, "%s\t%s\n", grafana_server, Colorize(ColorGreen, "deployed to "+grafana_server+"/dashboards/"))
+		} else {
+			fmt.Fprintf(writer, "%s\t%s\n", grafana_server, Colorize(ColorRed, fmt.Sprintf("%d dashboard(s) failed", len(server_failures[grafana_server]))))
+			failures = append(failures, server_failures[grafana_server]...)
+		}
+	}
+	writer.Flush()
+
+	if len(oversized) > 0 {
+		fmt.Println(" ")
+		fmt.Println(Colorize(ColorYellow, fmt.Sprintf("%d dashboard(s) over the size limits:", len(oversized))))
+		for _, problem := range oversized {
+			fmt.Println("  " + problem)
+		}
+	}
+
+	// Links to everything that changed, grouped by the folder it went into
+	if len(deployed_dashboards) > 0 {
+		fmt.Println(" ")
+		fmt.Printf("%d dashboard(s) deployed:\n", len(deployed_dashboards))
+		folder_url := ""
+		for _, deployed := range deployed_dashboards {
+			if deployed.FolderURL != folder_url && deployed.FolderURL != "" {
+				fmt.Println("  Folder " + deployed.FolderURL)
+			}
+			folder_url = deployed.FolderURL
+			fmt.Println("    " + deployed.URL + "  (" + deployed.Dashboard + ")")
+		}
+	}
+
+	// Only exit non-zero once every dashboard has been attempted
+	if len(failures) > 0 {
+		PrintFailureSummary(failures)
+		return false
+	}
+
+	fmt.Println("Dashboards deployed to " + environment.Name)
+	return true
+}
+
+// The commit status posted for one dashboard or project
+type CommitStatus struct {
+	State       string
+	TargetURL   string
+	Description string
+}
+
+// Post a gitlab commit status per deployed dashboard, or per project with mode project, so the merge request widget
+// shows which dashboards deployed rather than only the job result. Statuses are informational, failures only warn.
+func PostCommitStatuses(mode string, server_failures map[string][]DeployFailure) {
+
+	CI_PROJECT_ID := os.Getenv("CI_PROJECT_ID")
+	CI_COMMIT_SHA := os.Getenv("CI_COMMIT_SHA")
+	if CI_PROJECT_ID == "" || CI_COMMIT_SHA == "" {
+		fmt.Println("WARNING: CI_PROJECT_ID or CI_COMMIT_SHA not set, not posting commit statuses")
+		return
+	}
+
+	name := func(dashboard string) string {
+		source := rendered_from[dashboard]
+		if source == "" {
+			source = dashboard
+		}
+		if mode == "project" {
+			return "grafana " + environment.Name + ": " + DashboardProject(source)
+		}
+		return "grafana " + environment.Name + ": " + source
+	}
+
+	statuses := map[string]CommitStatus{}
+	for _, deployed := range deployed_dashboards {
+		target_url := deployed.URL
+		if mode == "project" {
+			target_url = deployed.FolderURL
+		}
+		if _, ok := statuses[name(deployed.Dashboard)]; !ok {
+			statuses[name(deployed.Dashboard)] = CommitStatus{State: "success", TargetURL: target_url, Description: "Deployed to " + environment.Name}
+		}
+	}
+
+	// A failure on any server fails the dashboard, and its project
+	for _, failures := range server_failures {
+		for _, failure := range failures {
+			description := failure.Err.Error()
+			if len(description) > 255 {
+				description = description[:252] + "..."
+			}
+			statuses[name(failure.Dashboard)] = CommitStatus{State: "failed", Description: description}
+		}
+	}
+
+	var names []string
+	for status_name := range statuses {
+		names = append(names, status_name)
+	}
+	sort.Strings(names)
+
+	for _, status_name := range names {
+		status := statuses[status_name]
+
+		payload, _ := json.Marshal(map[string]string{
+			"state":       status.State,
+			"name":        status_name,
+			"target_url":  status.TargetURL,
+			"description": status.Description,
+			"ref":         os.Getenv("CI_COMMIT_REF_NAME"),
+		})
+		if _, err := GitLabPOST("/projects/"+CI_PROJECT_ID+"/statuses/"+CI_COMMIT_SHA, string(payload)); err != nil {
+			fmt.Println("WARNING: could not post commit status " + status_name + ": " + err.Error())
+		}
+	}
+}
+
+// Helper recursive method to go through generated dashboards and deploy each one
+// When continuing on error failures are collected and returned instead of exiting
+func DeployAllDashboards(path string, folder_uid string, grafana_server string, options DeployOptions) []DeployFailure {
+
+	Verbose("Deploying Dashboards")
+
+	var failures []DeployFailure
+
+	// Loop over each file in path
+	items, _ := ioutil.ReadDir(path)
+	for _, item := range items {
+
+		if Interrupted() {
+			return failures
+		}
+
+		if item.IsDir() && !strings.Contains(item.Name(), "rlt") {
+
+			// If the item is a directory and does not relate to realtime drill down to that level
+			failures = append(failures, DeployAllDashboards(path+"/"+item.Name(), folder_uid, grafana_server, options)...)
+
+		} else if strings.HasSuffix(item.Name(), ".json") {
+
+			// Otherwise if it's an ordinary dashboard file deploy it
+			err := DeployDashboard(path+"/"+item.Name(), TargetFolder(path+"/"+item.Name(), folder_uid), grafana_server, options)
+			if err == nil {
+				continue
+			}
+
+			if !options.ContinueOnError {
+				Fatalf("ERROR: %s", err)
+			}
+
+			fmt.Println(Colorize(ColorRed, "failed") + "     " + path + "/" + item.Name() + ", continuing")
+			Emit(Event{Event: "error", Dashboard: path + "/" + item.Name(), Server: grafana_server, Error: err.Error()})
+			failures = append(failures, DeployFailure{Server: grafana_server, Dashboard: path + "/" + item.Name(), Err: err})
+			SummaryRowFor(path+"/"+item.Name()).Failed++
+		}
+	}
+
+	return failures
+}
+
+// One dashboard in the table printed at the end of a run. Deployed, Skipped and Failed count servers.
+type SummaryRow struct {
+	Dashboard string
+	Rendered  bool
+	Validated string
+	Deployed  int
+	Skipped   int
+	Failed    int
+	Folder    string
+	Duration  time.Duration
+}
+
+// Every dashboard the run rendered or deployed, keyed by rendered file
+var summary_rows = map[string]*SummaryRow{}
+
+// Helper method to return the summary row for a rendered dashboard file, adding it the first time
+func SummaryRowFor(dashboard string) *SummaryRow {
+
+	if summary_rows[dashboard] == nil {
+		summary_rows[dashboard] = &SummaryRow{Dashboard: dashboard}
+	}
+
+	return summary_rows[dashboard]
+}
+
+// Helper method to name a folder for the summary, by title when it is cached
+func SummaryFolder(folder_uid string, grafana_server string) string {
+
+	if folder_uid == "" {
+		return GeneralFolder
+	}
+	if folder, err := LookupFolder(folder_uid, grafana_server); err == nil && folder != nil && folder.Title != "" {
+		return folder.Title
+	}
+
+	return folder_uid
+}
+
+// Record a validation pass over the rendered dashboards. Problems start with, or mention, the dashboard they are about,
+// and a dashboard with a problem stays marked as a warning whatever later checks find.
+func MarkValidated(problems []string) {
+
+	for _, row := range summary_rows {
+		if !row.Rendered || row.Validated == "warn" {
+			continue
+		}
+
+		row.Validated = "ok"
+		for _, problem := range problems {
+			if strings.Contains(problem, row.Dashboard) {
+				row.Validated = "warn"
+				break
+			}
+		}
+	}
+}
+
+// Print a table of every dashboard the run touched, so the end of the job log shows what happened to each one
+func PrintRunSummary() {
+
+	var dashboards []string
+	for dashboard := range summary_rows {
+		dashboards = append(dashboards, dashboard)
+	}
+	sort.Strings(dashboards)
+
+	mark := func(count int, color string) string {
+		if count == 0 {
+			return "-"
+		}
+		return Colorize(color, strconv.Itoa(count))
+	}
+
+	fmt.Println(" ")
+
+	var deployed, skipped, failed int
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "DASHBOARD\tRENDERED\tVALIDATED\tDEPLOYED\tSKIPPED\tFAILED\tFOLDER\tDURATION")
+	for _, dashboard := range dashboards {
+		row := summary_rows[dashboard]
+
+		rendered := "-"
+		if row.Rendered {
+			rendered = "yes"
+		}
+		validated := row.Validated
+		if validated == "" {
+			validated = "-"
+		} else if validated == "warn" {
+			validated = Colorize(ColorYellow, validated)
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dashboard, rendered, validated,
+			mark(row.Deployed, ColorGreen), mark(row.Skipped, ColorGrey), mark(row.Failed, ColorRed), row.Folder, row.Duration.Round(time.Millisecond))
+
+		deployed += row.Deployed
+		skipped += row.Skipped
+		failed += row.Failed
+	}
+	writer.Flush()
+
+	fmt.Printf("%d dashboard(s): %d deployed, %d skipped, %d failed across all servers\n", len(dashboards), deployed, skipped, failed)
+}
+
+// Print a consolidated table of every dashboard that failed to deploy
+func PrintFailureSummary(failures []DeployFailure) {
+
+	fmt.Println(" ")
+	fmt.Println(Colorize(ColorRed, fmt.Sprintf("%d dashboard(s) failed to deploy:", len(failures))))
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVER\tDASHBOARD\tERROR")
+	for _, failure := range failures {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", failure.Server, failure.Dashboard, Colorize(ColorRed, failure.Err.Error()))
+	}
+	writer.Flush()
+}
+
+// Helper method to list the jsonnet and libsonnet files under the given paths.
+// Vendored libraries belong to someone else so they are skipped.
+func JsonnetFiles(paths []string) ([]string, error) {
+
+	var files []string
+
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(file string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if entry.IsDir() && file != root && (entry.Name() == ".git" || entry.Name() == "vendor") {
+				return filepath.SkipDir
+			}
+
+			if !entry.IsDir() && (strings.HasSuffix(file, ".jsonnet") || strings.HasSuffix(file, ".libsonnet")) {
+				files = append(files, filepath.ToSlash(file))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// The fmt command checks or rewrites jsonnet sources in jsonnetfmt's canonical style.
+// With --check it exits non-zero listing any file that isn't formatted, with --write it formats them in place.
+func FormatCommand(args []string) {
+
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	checkPointer := flags.Bool("check", false, "List files that aren't formatted and exit non-zero if there are any.")
+	writePointer := flags.Bool("write", false, "Rewrite files that aren't formatted.")
+	flags.Parse(args)
+
+	if *checkPointer == *writePointer {
+		Fatal("fmt needs exactly one of --check or --write")
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := JsonnetFiles(paths)
+	if err != nil {
+		Fatal(err)
+	}
+
+	unformatted := 0
+	for _, file := range files {
+
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			Fatal(err)
+		}
+
+		formatted, err := formatter.Format(file, string(source), formatter.DefaultOptions())
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		if formatted == string(source) {
+			continue
+		}
+		unformatted++
+
+		if *checkPointer {
+			fmt.Println("Not formatted: " + file)
+			continue
+		}
+
+		Info("Formatting: " + file)
+		if err := ioutil.WriteFile(file, []byte(formatted), 0644); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if *checkPointer && unformatted > 0 {
+		EnterPhase("validate")
+		Fatalf("ERROR: %d file(s) need formatting, run: go run build.go fmt --write", unformatted)
+	}
+
+	Infof("Checked %d jsonnet file(s)\n", len(files))
+}
+
+// Helper method to rewrite a json dashboard in canonical form: sorted keys, 2 space indent and without the
+// id and version grafana assigns, so re-exported dashboards only differ where their content does
+func CanonicalJSON(source []byte) ([]byte, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(source))
+	decoder.UseNumber()
+
+	var parsed_dashboard map[string]interface{}
+	if err := decoder.Decode(&parsed_dashboard); err != nil {
+		return nil, err
+	}
+
+	delete(parsed_dashboard, "id")
+	delete(parsed_dashboard, "version")
+
+	// Maps marshal with sorted keys. Escaping html would turn every < in a query into \u003c
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(parsed_dashboard); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Helper method to tell a json dashboard from other json files such as jsonnet-bundler manifests
+func IsJSONDashboard(source []byte) bool {
+
+	var probe struct {
+		Panels        []interface{} `json:"panels"`
+		Rows          []interface{} `json:"rows"`
+		SchemaVersion int           `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(source, &probe); err != nil {
+		return false
+	}
+
+	return probe.Panels != nil || probe.Rows != nil || probe.SchemaVersion > 0
+}
+
+// The fmt-json command checks or rewrites committed json dashboards in canonical form.
+// With --check it exits non-zero listing any dashboard that isn't canonical, with --write it rewrites them in place.
+func FormatJSONCommand(args []string) {
+
+	flags := flag.NewFlagSet("fmt-json", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	checkPointer := flags.Bool("check", false, "List dashboards that aren't canonical and exit non-zero if there are any.")
+	writePointer := flags.Bool("write", false, "Rewrite dashboards that aren't canonical.")
+	flags.Parse(args)
+
+	if *checkPointer == *writePointer {
+		Fatal("fmt-json needs exactly one of --check or --write")
+	}
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	// Default to the dashboard source directories, the rendered output is never committed
+	paths := flags.Args()
+	if len(paths) == 0 {
+		for _, source := range config.Sources {
+			matches, _ := filepath.Glob(source)
+			paths = append(paths, matches...)
+		}
+	}
+
+	var files []string
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(file string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if entry.IsDir() && file != root && (entry.Name() == ".git" || entry.Name() == "vendor") {
+				return filepath.SkipDir
+			}
+
+			if !entry.IsDir() && strings.HasSuffix(file, ".json") && !IsProjectTooling(filepath.ToSlash(file)) {
+				files = append(files, filepath.ToSlash(file))
+			}
+
+			return nil
+		})
+		if err != nil {
+			Fatal(err)
+		}
+	}
+
+	checked, unformatted := 0, 0
+	for _, file := range files {
+
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			Fatal(err)
+		}
+		if !IsJSONDashboard(source) {
+			continue
+		}
+		checked++
+
+		formatted, err := CanonicalJSON(source)
+		if err != nil {
+			Fatalf("ERROR: %s: %s", file, err)
+		}
+
+		if bytes.Equal(formatted, source) {
+			continue
+		}
+		unformatted++
+
+		if *checkPointer {
+			fmt.Println("Not canonical: " + file)
+			continue
+		}
+
+		Info("Formatting: " + file)
+		if err := ioutil.WriteFile(file, formatted, 0644); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if *checkPointer && unformatted > 0 {
+		EnterPhase("validate")
+		Fatalf("ERROR: %d dashboard(s) need formatting, run: go run build.go fmt-json --write", unformatted)
+	}
+
+	Infof("Checked %d json dashboard(s)\n", checked)
+}
+
+// A JUnit test report, so gitlab can show problems in the merge request widget
+type JUnitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []JUnitTestCase `xml:"testcase"`
+}
+
+type JUnitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *JUnitFailure `xml:"failure,omitempty"`
+}
+
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Helper method to write a JUnit report to a file
+func WriteJUnit(file string, suite JUnitTestSuite) error {
+
+	out, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append([]byte(xml.Header), out...), 0644)
+}
+
+// The lint command runs the jsonnet linter over jsonnet sources, catching unused variables,
+// shadowing and other suspicious constructs before anything is rendered.
+func LintCommand(args []string) {
+
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	junitPointer := flags.String("junit", "", "Also write the results as a JUnit report to this file.")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := JsonnetFiles(paths)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Imports resolve the same way as when rendering
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.FileImporter{JPaths: []string{"vendor"}})
+
+	suite := JUnitTestSuite{Name: "jsonnet-lint", Tests: len(files)}
+
+	for _, file := range files {
+
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			Fatal(err)
+		}
+
+		// Each file is linted on its own so diagnostics can be reported against it
+		var diagnostics bytes.Buffer
+		failed := linter.LintSnippet(vm, &diagnostics, []linter.Snippet{{FileName: file, Code: string(source)}})
+
+		test_case := JUnitTestCase{Name: file, ClassName: "jsonnet-lint"}
+		if failed {
+			fmt.Println("Lint problems in: " + file)
+			fmt.Print(diagnostics.String())
+
+			suite.Failures++
+			test_case.Failure = &JUnitFailure{Message: "jsonnet-lint found problems", Text: diagnostics.String()}
+		}
+		suite.TestCases = append(suite.TestCases, test_case)
+	}
+
+	if *junitPointer != "" {
+		if err := WriteJUnit(*junitPointer, suite); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if suite.Failures > 0 {
+		EnterPhase("validate")
+		Fatalf("ERROR: lint problems in %d of %d jsonnet file(s)", suite.Failures, len(files))
+	}
+
+	Infof("Linted %d jsonnet file(s)\n", len(files))
+}
+
+// A problem a policy found in a rendered dashboard
+type PolicyFinding struct {
+	Dashboard string `json:"dashboard"`
+	Source    string `json:"source"`
+	Rule      string `json:"rule"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+}
+
+// Built in datasources that are fine to reference directly
+var builtin_datasources = map[string]bool{"grafana": true, "-- Grafana --": true, "-- Mixed --": true, "-- Dashboard --": true}
+
+// Find datasources referenced by literal uid or name rather than through a template variable.
+// Returns the json pointer of each reference. With fix set they are rewritten to the datasource variable,
+// and the variable is added to the dashboard if it doesn't have one.
+func HardcodedDatasources(parsed_dashboard map[string]interface{}, fix bool) []string {
+
+	variable := "${" + config.Policies.DatasourceVariable + "}"
+	datasource_type := ""
+
+	var references []string
+
+	var walk func(node interface{}, pointer string)
+	walk = func(node interface{}, pointer string) {
+		switch value := node.(type) {
+
+		case map[string]interface{}:
+			// A datasource variable has no datasource of its own to check
+			if value["type"] == "datasource" && strings.HasPrefix(pointer, "/templating/") {
+				return
+			}
+
+			for key, child := range value {
+
+				if key != "datasource" {
+					walk(child, pointer+"/"+key)
+					continue
+				}
+
+				switch datasource := child.(type) {
+				case string:
+					if datasource != "" && !strings.HasPrefix(datasource, "$") && !builtin_datasources[datasource] {
+						references = append(references, pointer+"/datasource")
+						if fix {
+							value[key] = variable
+						}
+					}
+				case map[string]interface{}:
+					uid, _ := datasource["uid"].(string)
+					if uid != "" && !strings.HasPrefix(uid, "$") && !builtin_datasources[uid] {
+						references = append(references, pointer+"/datasource/uid")
+						if datasource_type == "" {
+							datasource_type, _ = datasource["type"].(string)
+						}
+						if fix {
+							datasource["uid"] = variable
+						}
+					}
+				}
+			}
+
+		case []interface{}:
+			for i, child := range value {
+				walk(child, pointer+"/"+strconv.Itoa(i))
+			}
+		}
+	}
+
+	walk(parsed_dashboard, "")
+	sort.Strings(references)
+
+	if !fix || len(references) == 0 {
+		return references
+	}
+
+	// The rewritten references need a variable to resolve against
+	templating, ok := parsed_dashboard["templating"].(map[string]interface{})
+	if !ok {
+		templating = map[string]interface{}{}
+		parsed_dashboard["templating"] = templating
+	}
+	variables, _ := templating["list"].([]interface{})
+	for _, item := range variables {
+		if existing, ok := item.(map[string]interface{}); ok && existing["name"] == config.Policies.DatasourceVariable {
+			return references
+		}
+	}
+
+	if datasource_type == "" {
+		datasource_type = "prometheus"
+	}
+	templating["list"] = append([]interface{}{map[string]interface{}{
+		"name":  config.Policies.DatasourceVariable,
+		"label": "Data source",
+		"type":  "datasource",
+		"query": datasource_type,
+	}}, variables...)
+
+	return references
+}
+
+// Check a dashboard against a naming rule. Returns a message for each condition it breaks.
+func CheckNaming(rule NamingRule, parsed_dashboard map[string]interface{}) []string {
+
+	title, _ := parsed_dashboard["title"].(string)
+	var problems []string
+
+	if rule.title_pattern != nil && !rule.title_pattern.MatchString(title) {
+		problems = append(problems, "title \""+title+"\" doesn't match "+rule.TitlePattern)
+	}
+
+	if rule.TitlePrefix != "" && !strings.HasPrefix(title, rule.TitlePrefix) {
+		problems = append(problems, "title \""+title+"\" doesn't start with \""+rule.TitlePrefix+"\"")
+	}
+
+	if rule.MaxTitleLength > 0 && len([]rune(title)) > rule.MaxTitleLength {
+		problems = append(problems, fmt.Sprintf("title \"%s\" is longer than %d characters", title, rule.MaxTitleLength))
+	}
+
+	tags, _ := parsed_dashboard["tags"].([]interface{})
+	for _, tag := range rule.RequiredTags {
+		if !containsValue(tags, tag) {
+			problems = append(problems, "missing required tag "+tag)
+		}
+	}
+
+	return problems
+}
+
+// Compile the rego policies in the policy directory. Returns nil when there aren't any.
+func PrepareRego(dir string) (*rego.PreparedEvalQuery, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.rego"))
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	Infof("Loading %d rego polic(ies) from %s\n", len(files), dir)
+
+	query, err := rego.New(rego.Query("data.grafana"), rego.Load(files, nil)).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, errors.New("Failed to compile rego policies: " + err.Error())
+	}
+
+	return &query, nil
+}
+
+// Evaluate the rego policies against a dashboard, which is the policy input.
+// Messages from deny rules are errors and messages from warn rules are warnings.
+func EvaluateRego(query *rego.PreparedEvalQuery, parsed_dashboard map[string]interface{}) (map[string][]string, error) {
+
+	results, err := query.Eval(context.Background(), rego.EvalInput(parsed_dashboard))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := map[string][]string{}
+	for _, result := range results {
+		for _, expression := range result.Expressions {
+
+			rules, _ := expression.Value.(map[string]interface{})
+			for rule, severity := range map[string]string{"deny": "error", "warn": "warn"} {
+				values, _ := rules[rule].([]interface{})
+				for _, value := range values {
+					messages[severity] = append(messages[severity], fmt.Sprint(value))
+				}
+			}
+		}
+	}
+
+	return messages, nil
+}
+
+// Check the rendered dashboards against the configured policies
+func EvaluatePolicies(out_dir string) ([]PolicyFinding, error) {
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := PrepareRego(config.Policies.Rego)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []PolicyFinding
+	for _, dashboard := range dashboards {
+
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Policies.HardcodedDatasources != "off" {
+			for _, reference := range HardcodedDatasources(parsed_dashboard, false) {
+				findings = append(findings, PolicyFinding{
+					Dashboard: dashboard,
+					Source:    rendered_from[dashboard],
+					Rule:      "hardcoded_datasources",
+					Severity:  config.Policies.HardcodedDatasources,
+					Message:   reference + " references a datasource directly instead of through ${" + config.Policies.DatasourceVariable + "}",
+				})
+			}
+		}
+
+		// Rendered dashboards sit in a directory named after their project
+		project := path.Base(path.Dir(dashboard))
+
+		for _, rule := range config.Policies.Naming {
+
+			if len(rule.Projects) > 0 && !contains(rule.Projects, project) {
+				continue
+			}
+
+			for _, problem := range CheckNaming(rule, parsed_dashboard) {
+				findings = append(findings, PolicyFinding{
+					Dashboard: dashboard,
+					Source:    rendered_from[dashboard],
+					Rule:      rule.Name,
+					Severity:  rule.Severity,
+					Message:   problem,
+				})
+			}
+		}
+
+		if query != nil {
+			messages, err := EvaluateRego(query, parsed_dashboard)
+			if err != nil {
+				return nil, errors.New("Evaluating rego policies on " + dashboard + ": " + err.Error())
+			}
+
+			for _, severity := range []string{"error", "warn"} {
+				for _, message := range messages[severity] {
+					findings = append(findings, PolicyFinding{
+						Dashboard: dashboard,
+						Source:    rendered_from[dashboard],
+						Rule:      "rego",
+						Severity:  severity,
+						Message:   message,
+					})
+				}
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// Rewrite hardcoded datasources in a json dashboard source. Jsonnet sources have to be fixed by hand.
+// Returns true if the source was rewritten.
+func FixDatasources(source string) (bool, error) {
+
+	if !strings.HasSuffix(source, ".json") {
+		return false, nil
+	}
+
+	parsed_dashboard, err := ReadDashboard(source)
+	if err != nil {
+		return false, err
+	}
+
+	if len(HardcodedDatasources(parsed_dashboard, true)) == 0 {
+		return false, nil
+	}
+
+	out_file, _ := json.MarshalIndent(parsed_dashboard, "", "  ")
+	return true, ioutil.WriteFile(source, append(out_file, '\n'), 0644)
+}
+
+// The validate command renders every dashboard and checks it against the configured policies.
+// It exits non-zero if any error severity policy fails. With --fix, problems that can be fixed are fixed in the sources.
+func ValidateCommand(args []string) {
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	outPointer := flags.String("out", "dist", "Directory to render dashboards into. It is emptied before rendering.")
+	fixPointer := flags.Bool("fix", false, "Rewrite hardcoded datasources in json sources to the datasource variable.")
+	reportPointer := flags.String("report", "", "Also write the findings as json to this file.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	if err := CleanOutputDir(out_dir); err != nil {
+		Fatal(err)
+	}
+
+	sources, err := ListDashboardSources()
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Dashboards are validated as they appear on the default branch, without branch title prefixes
+	branch := os.Getenv("CI_DEFAULT_BRANCH")
+	if branch == "" {
+		branch = "master"
+	}
+	branch = strings.Replace(branch, "/", "", -1)
+	StartSection("render", "Rendering dashboards", true)
+	RenderChanged(sources, branch, out_dir)
+	RenderMixins(nil, branch, out_dir, true)
+	EndSection("render")
+
+	StartSection("validate", "Evaluating policies", false)
+	findings, err := EvaluatePolicies(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+	EndSection("validate")
+
+	if *fixPointer {
+		fixed := map[string]bool{}
+		for _, finding := range findings {
+			if finding.Rule != "hardcoded_datasources" || fixed[finding.Source] {
+				continue
+			}
+			rewritten, err := FixDatasources(finding.Source)
+			if err != nil {
+				Fatal(err)
+			}
+			fixed[finding.Source] = rewritten
+			if rewritten {
+				Info("Fixed datasources in: " + finding.Source)
+			}
+		}
+
+		// Whatever was fixed no longer counts against the run
+		var remaining []PolicyFinding
+		for _, finding := range findings {
+			if !(finding.Rule == "hardcoded_datasources" && fixed[finding.Source]) {
+				remaining = append(remaining, finding)
+			}
+		}
+		findings = remaining
+	}
+
+	if *reportPointer != "" {
+		report, _ := json.MarshalIndent(map[string]interface{}{"findings": findings}, "", "  ")
+		if err := ioutil.WriteFile(*reportPointer, report, 0644); err != nil {
+			Fatal(err)
+		}
+	}
+
+	errors_found := 0
+	for _, finding := range findings {
+		fmt.Printf("%s: %s [%s] %s\n", strings.ToUpper(finding.Severity), finding.Dashboard, finding.Rule, finding.Message)
+		if finding.Severity == "error" {
+			errors_found++
+		}
+	}
+
+	if errors_found > 0 {
+		EnterPhase("validate")
+		Fatalf("ERROR: %d policy error(s)", errors_found)
+	}
+
+	Infof("Validated %d dashboard source(s)\n", len(sources))
+}
+
+// An in-memory stand in for the parts of the grafana api a deploy uses: health, org, folders, dashboards and search.
+// It lets self-test exercise the real deploy code without a grafana server.
+type MockGrafana struct {
+	lock       sync.Mutex
+	folders    map[string]map[string]interface{}
+	dashboards map[string]MockDashboard
+	next_id    int
+
+	// Number of dashboards saved, so tests can tell whether a deploy posted anything
+	saves int
+}
+
+// A dashboard stored by the mock grafana
+type MockDashboard struct {
+	Model     map[string]interface{}
+	FolderUID string
+}
+
+func NewMockGrafana() *MockGrafana {
+	return &MockGrafana{folders: map[string]map[string]interface{}{}, dashboards: map[string]MockDashboard{}}
+}
+
+// Number of dashboard saves the mock grafana has handled
+func (mock *MockGrafana) Saves() int {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	return mock.saves
+}
+
+// Helper method to write a json response from the mock grafana
+func mockRespond(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(body)
+}
+
+func (mock *MockGrafana) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+
+	// Health is the only endpoint grafana serves without credentials
+	endpoint := request.Method + " " + request.URL.Path
+	if endpoint == "GET /api/health" {
+		mockRespond(writer, http.StatusOK, map[string]string{"database": "ok", "version": "11.0.0"})
+		return
+	}
+	if request.Header.Get("Authorization") == "" {
+		mockRespond(writer, http.StatusUnauthorized, map[string]string{"message": "Unauthorized"})
+		return
+	}
+
+	switch {
+	case endpoint == "GET /api/org":
+		mockRespond(writer, http.StatusOK, map[string]interface{}{"id": 1, "name": "Main Org."})
+
+	case endpoint == "POST /api/folders":
+		var folder map[string]interface{}
+		if err := json.NewDecoder(request.Body).Decode(&folder); err != nil {
+			mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "bad request data"})
+			return
+		}
+		uid, _ := folder["uid"].(string)
+		if _, ok := mock.folders[uid]; ok {
+			mockRespond(writer, http.StatusConflict, map[string]string{"message": "a folder with the same uid already exists"})
+			return
+		}
+		mock.next_id++
+		folder["id"] = mock.next_id
+		title, _ := folder["title"].(string)
+		folder["url"] = "/dashboards/f/" + uid + "/" + Slugify(title)
+		mock.folders[uid] = folder
+		mockRespond(writer, http.StatusOK, folder)
+
+	case request.Method == "POST" && strings.HasPrefix(request.URL.Path, "/api/folders/") && strings.HasSuffix(request.URL.Path, "/move"):
+		folder, ok := mock.folders[strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/api/folders/"), "/move")]
+		if !ok {
+			mockRespond(writer, http.StatusNotFound, map[string]string{"message": "folder not found"})
+			return
+		}
+		var move map[string]interface{}
+		if err := json.NewDecoder(request.Body).Decode(&move); err != nil {
+			mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "bad request data"})
+			return
+		}
+		folder["parentUid"] = move["parentUid"]
+		mockRespond(writer, http.StatusOK, folder)
+
+	case strings.HasPrefix(request.URL.Path, "/api/folders/"):
+		folder, ok := mock.folders[strings.TrimPrefix(request.URL.Path, "/api/folders/")]
+		if !ok {
+			mockRespond(writer, http.StatusNotFound, map[string]string{"message": "folder not found"})
+			return
+		}
+		if request.Method == "PUT" {
+			var update map[string]interface{}
+			if err := json.NewDecoder(request.Body).Decode(&update); err != nil {
+				mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "bad request data"})
+				return
+			}
+			folder["title"] = update["title"]
+		}
+
+		// Grafana deletes the dashboards in a folder along with it
+		if request.Method == "DELETE" {
+			uid, _ := folder["uid"].(string)
+			for dashboard_uid, dashboard := range mock.dashboards {
+				if dashboard.FolderUID == uid {
+					delete(mock.dashboards, dashboard_uid)
+				}
+			}
+			delete(mock.folders, uid)
+			mockRespond(writer, http.StatusOK, map[string]interface{}{"title": folder["title"], "message": "Folder deleted"})
+			return
+		}
+		mockRespond(writer, http.StatusOK, folder)
+
+	case endpoint == "POST /api/dashboards/db":
+		var save struct {
+			Dashboard map[string]interface{} `json:"dashboard"`
+			FolderUID string                 `json:"folderUid"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&save); err != nil || save.Dashboard == nil {
+			mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "bad request data"})
+			return
+		}
+		if _, ok := mock.folders[save.FolderUID]; !ok && save.FolderUID != "" {
+			mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "folder not found"})
+			return
+		}
+		if title, _ := save.Dashboard["title"].(string); title == "" {
+			mockRespond(writer, http.StatusBadRequest, map[string]string{"message": "Dashboard title cannot be empty"})
+			return
+		}
+		uid, _ := save.Dashboard["uid"].(string)
+		if uid == "" {
+			mock.next_id++
+			uid = "mock-" + strconv.Itoa(mock.next_id)
+			save.Dashboard["uid"] = uid
+		}
+
+		// Grafana manages the id and version itself
+		version := 1
+		if existing, ok := mock.dashboards[uid]; ok {
+			save.Dashboard["id"] = existing.Model["id"]
+			if previous, ok := existing.Model["version"].(int); ok {
+				version = previous + 1
+			}
+		} else {
+			mock.next_id++
+			save.Dashboard["id"] = mock.next_id
+		}
+		save.Dashboard["version"] = version
+
+		mock.dashboards[uid] = MockDashboard{Model: save.Dashboard, FolderUID: save.FolderUID}
+		mock.saves++
+		mockRespond(writer, http.StatusOK, map[string]interface{}{
+			"id": save.Dashboard["id"], "uid": uid, "url": "/d/" + uid + "/" + Slugify(save.Dashboard["title"].(string)),
+			"status": "success", "version": version,
+		})
+
+	case strings.HasPrefix(request.URL.Path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(request.URL.Path, "/api/dashboards/uid/")
+		dashboard, ok := mock.dashboards[uid]
+		if !ok {
+			mockRespond(writer, http.StatusNotFound, map[string]string{"message": "Dashboard not found"})
+			return
+		}
+		switch request.Method {
+		case "GET":
+			mockRespond(writer, http.StatusOK, map[string]interface{}{
+				"dashboard": dashboard.Model, "meta": map[string]interface{}{"folderUid": dashboard.FolderUID},
+			})
+		case "DELETE":
+			delete(mock.dashboards, uid)
+			mockRespond(writer, http.StatusOK, map[string]interface{}{"title": dashboard.Model["title"], "message": "Dashboard deleted"})
+		default:
+			mockRespond(writer, http.StatusMethodNotAllowed, map[string]string{"message": "Method not allowed"})
+		}
+
+	case endpoint == "GET /api/search":
+		query := request.URL.Query()
+		folder_uids := query["folderUIDs"]
+
+		results := []SearchResult{}
+		for uid, dashboard := range mock.dashboards {
+			if len(folder_uids) > 0 && !contains(folder_uids, dashboard.FolderUID) {
+				continue
+			}
+			title, _ := dashboard.Model["title"].(string)
+			if search := query.Get("query"); search != "" && !strings.Contains(strings.ToLower(title), strings.ToLower(search)) {
+				continue
+			}
+			folder_title, _ := mock.folders[dashboard.FolderUID]["title"].(string)
+			results = append(results, SearchResult{
+				UID: uid, Title: title, Type: "dash-db", URL: "/d/" + uid + "/" + Slugify(title),
+				FolderUID: dashboard.FolderUID, FolderTitle: folder_title,
+			})
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].Title < results[j].Title })
+
+		// Page like grafana does so pagination gets exercised too
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		if limit > 0 && page > 0 {
+			start := limit * (page - 1)
+			if start > len(results) {
+				start = len(results)
+			}
+			end := start + limit
+			if end > len(results) {
+				end = len(results)
+			}
+			results = results[start:end]
+		}
+		mockRespond(writer, http.StatusOK, results)
+
+	default:
+		mockRespond(writer, http.StatusNotFound, map[string]string{"message": "Not found: " + endpoint + " isn't implemented by the self-test grafana"})
+	}
+}
+
+// Render every dashboard in the repo and deploy it twice to a mock grafana, checking each deploy lands and that
+// the second deploy finds nothing changed. This checks the jsonnet toolchain, jq and the pipeline config without a real grafana.
+func SelfTestCommand(args []string) {
+
+	flags := flag.NewFlagSet("self-test", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	projectPointer := flags.String("project", "self-test", "Project name to deploy the dashboards as.")
+	flags.Parse(args)
+
+	color = UseColor(false)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	out_dir, err := ioutil.TempDir("", "grafana-self-test")
+	if err != nil {
+		Fatal(err)
+	}
+	defer os.RemoveAll(out_dir)
+
+	mock := NewMockGrafana()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	environment = &Environment{Name: "self-test", URL: server.URL, token: "self-test"}
+	grafana_server := server.URL
+
+	if err := CheckServer(grafana_server); err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	sources, err := ListDashboardSources()
+	if err != nil {
+		Fatal(err)
+	}
+
+	// A branch deploy, so nothing is shared publicly or moved into metadata folders
+	branch := "self-test"
+	StartSection("render", "Rendering dashboards", false)
+	RenderChanged(sources, branch, out_dir)
+	RenderMixins(nil, branch, out_dir, true)
+	EndSection("render")
+
+	targets, err := DeployTargets(out_dir, branch, branch, *projectPointer)
+	if err != nil {
+		Fatal(err)
+	}
+
+	options := DeployOptions{ContinueOnError: true, SkipUnchanged: true, Verify: true, Overwrite: "force"}
+
+	// Deploy everything to its folders, returning any failures
+	deploy := func() []DeployFailure {
+		var failures []DeployFailure
+		for _, target := range targets {
+			if err := CreateGrafanaFolder(target.FolderUID, target.FolderTitle, "", grafana_server); err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+			failures = append(failures, DeployAllDashboards(target.Path, target.FolderUID, grafana_server, options)...)
+		}
+		return failures
+	}
+
+	StartSection("deploy", "Deploying to the self-test grafana", false)
+	failures := deploy()
+	EndSection("deploy")
+	deployed := mock.Saves()
+
+	var problems []string
+
+	if len(failures) == 0 {
+
+		// Every saved dashboard must be found in its folder
+		found := 0
+		for _, target := range targets {
+			results, err := FolderDashboards(target.FolderUID, grafana_server)
+			if err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+			found += len(results)
+		}
+		if found != deployed {
+			problems = append(problems, fmt.Sprintf("deployed %d dashboard(s) but found %d searching their folders", deployed, found))
+		}
+
+		// The same dashboards again should all be skipped as unchanged
+		StartSection("redeploy", "Redeploying to check nothing changed", true)
+		failures = deploy()
+		EndSection("redeploy")
+
+		if saved := mock.Saves() - deployed; saved > 0 {
+			problems = append(problems, fmt.Sprintf("redeploying saved %d dashboard(s) again, they don't round trip through grafana unchanged", saved))
+		}
+	}
+
+	if len(failures) > 0 {
+		PrintFailureSummary(failures)
+		problems = append(problems, fmt.Sprintf("%d dashboard(s) failed to deploy", len(failures)))
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(Colorize(ColorRed, "FAIL") + " " + problem)
+		}
+
+		// Exiting skips the deferred clean up
+		server.Close()
+		os.RemoveAll(out_dir)
+		os.Exit(ExitError)
+	}
+
+	if deployed == 0 {
+		fmt.Println("WARNING: no dashboards were rendered, nothing was deployed")
+	}
+	fmt.Printf("%s rendered and deployed %d dashboard(s) to the self-test grafana\n", Colorize(ColorGreen, "PASS"), deployed)
+}
+
+// Starter files written by init, PROJECT is replaced with the project name
+var init_templates = map[string]string{
+	"overview.jsonnet": `local lib = import 'lib/dashboard.libsonnet';
+
+lib.dashboard('PROJECT overview') {
+  panels: [
+    lib.timeseries('Request rate', 'sum(rate(http_requests_total{job="PROJECT"}[$__rate_interval]))', x=0),
+    lib.timeseries('Error rate', 'sum(rate(http_requests_total{job="PROJECT", code=~"5.."}[$__rate_interval]))', x=12),
+  ],
+}
+`,
+	"overview.meta.yaml": `# Settings for overview.jsonnet, see Dashboard metadata in the pipeline README
+tags: [PROJECT]
+# folder: PROJECT
+# permissions:
+#   - team: PROJECT
+#     permission: edit
+`,
+	"lib/dashboard.libsonnet": `// Building blocks shared by the PROJECT dashboards
+{
+  dashboard(title, tags=[]):: {
+    title: title,
+    uid: std.extVar('uid'),
+    tags: ['PROJECT'] + tags,
+    timezone: 'browser',
+    schemaVersion: 39,
+    time: { from: 'now-6h', to: 'now' },
+    templating: {
+      list: [
+        { name: 'datasource', type: 'datasource', query: 'prometheus' },
+      ],
+    },
+    panels: [],
+  },
+
+  timeseries(title, expr, x=0, y=0, w=12, h=8):: {
+    type: 'timeseries',
+    title: title,
+    datasource: { type: 'prometheus', uid: '${datasource}' },
+    gridPos: { x: x, y: y, w: w, h: h },
+    targets: [
+      { expr: expr, refId: 'A' },
+    ],
+  },
+}
+`,
+	"jsonnetfile.json": `{
+  "version": 1,
+  "dependencies": [],
+  "legacyImports": true
+}
+`,
+}
+
+// Scaffold a new project directory with a starter dashboard, its metadata, a lib/ directory and a jsonnetfile.json
+func InitCommand(args []string) {
+
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		Fatal("Usage: go run build.go init <project>")
+	}
+	project := flags.Arg(0)
+	if project != Slugify(project) {
+		Fatal("Project names are lowercase letters, digits and dashes, e.g. " + Slugify(project))
+	}
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	// New projects go under the first source root, which can't be a glob
+	root := strings.Trim(config.Sources[0], "/")
+	if strings.ContainsAny(root, "*?[") {
+		Fatal("The first source root " + root + " is a pattern, create the project directory by hand")
+	}
+
+	project_dir := root + "/" + project
+	if _, err := os.Stat(project_dir); err == nil {
+		Fatal(project_dir + " already exists")
+	}
+
+	var names []string
+	for name := range init_templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := project_dir + "/" + name
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(strings.ReplaceAll(init_templates[name], "PROJECT", project)), 0644); err != nil {
+			Fatal(err)
+		}
+		Info("Created " + file)
+	}
+
+	Info("Add libraries with: cd " + project_dir + " && jb install <library>")
+}
+
+// A parameter a dashboard template asks for, declared in <template>.params.yaml next to the template
+type TemplateParam struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Default     string `yaml:"default"`
+}
+
+// Helper method to substitute {{name}} placeholders in a dashboard template, failing on any without a value
+func ExpandTemplate(template string, values map[string]string) (string, error) {
+
+	var unknown []string
+
+	placeholder := regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+	expanded := placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		name := placeholder.FindStringSubmatch(match)[1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		if !contains(unknown, name) {
+			unknown = append(unknown, name)
+		}
+		return match
+	})
+
+	if len(unknown) > 0 {
+		return "", errors.New("No value for template parameters: " + strings.Join(unknown, ", ") + ", declare them in the params file")
+	}
+
+	return expanded, nil
+}
+
+// Create a dashboard in a project from one of the organisations templates, e.g.
+// go run build.go new dashboard --template service-overview --project payments --param service=checkout
+// Parameters not given as flags are asked for when running in a terminal, or take their default.
+func NewCommand(args []string) {
+
+	if len(args) == 0 || args[0] != "dashboard" {
+		Fatal("Usage: go run build.go new dashboard --template <name> --project <project>")
+	}
+
+	flags := flag.NewFlagSet("new dashboard", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	templatePointer := flags.String("template", "", "Name of the template in the templates directory, e.g. service-overview.")
+	projectPointer := flags.String("project", "", "Project directory to create the dashboard in.")
+	namePointer := flags.String("name", "", "File name for the new dashboard, without extension. Defaults to the template name.")
+	params := map[string]string{}
+	flags.Func("param", "A template parameter as name=value. Repeatable.", func(value string) error {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("parameters are name=value")
+		}
+		params[parts[0]] = parts[1]
+		return nil
+	})
+	flags.Parse(args[1:])
+
+	if *templatePointer == "" || *projectPointer == "" {
+		Fatal("new dashboard needs --template and --project")
+	}
+	if *projectPointer != Slugify(*projectPointer) {
+		Fatal("Project names are lowercase letters, digits and dashes, e.g. " + Slugify(*projectPointer))
+	}
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	// Templates are jsonnet or plain json
+	template_base := config.Templates + "/" + *templatePointer
+	extension := ""
+	var template []byte
+	for _, candidate := range []string{".jsonnet", ".json"} {
+		if template, err = ioutil.ReadFile(template_base + candidate); err == nil {
+			extension = candidate
+			break
+		}
+	}
+	if extension == "" {
+		Fatal("No template " + *templatePointer + " in " + config.Templates + ", expected " + template_base + ".jsonnet or .json")
+	}
+
+	var declared []TemplateParam
+	if bytes, err := ioutil.ReadFile(template_base + ".params.yaml"); err == nil {
+		if err := yaml.Unmarshal(bytes, &declared); err != nil {
+			Fatal("Failed to parse " + template_base + ".params.yaml: " + err.Error())
+		}
+	}
+
+	name := *namePointer
+	if name == "" {
+		name = *templatePointer
+	}
+	if name != Slugify(name) {
+		Fatal("Dashboard names are lowercase letters, digits and dashes, e.g. " + Slugify(name))
+	}
+
+	// Every template can use these without declaring them
+	values := map[string]string{"project": *projectPointer, "name": name}
+
+	info, _ := os.Stdin.Stat()
+	interactive := info != nil && info.Mode()&os.ModeCharDevice != 0
+	input := bufio.NewReader(os.Stdin)
+
+	for _, param := range declared {
+		if value, ok := params[param.Name]; ok {
+			values[param.Name] = value
+			continue
+		}
+
+		if interactive {
+			prompt := param.Name
+			if param.Description != "" {
+				prompt += " (" + param.Description + ")"
+			}
+			if param.Default != "" {
+				prompt += " [" + param.Default + "]"
+			}
+			fmt.Print(prompt + ": ")
+
+			answer, _ := input.ReadString('\n')
+			if answer = strings.TrimSpace(answer); answer != "" {
+				values[param.Name] = answer
+				continue
+			}
+		}
+
+		if param.Default == "" {
+			Fatal("No value for template parameter " + param.Name + ", pass --param " + param.Name + "=<value>")
+		}
+		values[param.Name] = param.Default
+	}
+
+	for key := range params {
+		if _, ok := values[key]; !ok {
+			Fatal("Template " + *templatePointer + " has no parameter " + key)
+		}
+	}
+
+	dashboard, err := ExpandTemplate(string(template), values)
+	if err != nil {
+		Fatalf("ERROR: %s: %s", template_base+extension, err)
+	}
+
+	// New dashboards go under the first source root, like init
+	root := strings.Trim(config.Sources[0], "/")
+	if strings.ContainsAny(root, "*?[") {
+		Fatal("The first source root " + root + " is a pattern, copy the template by hand")
+	}
+
+	file := root + "/" + *projectPointer + "/" + name + extension
+	if _, err := os.Stat(file); err == nil {
+		Fatal(file + " already exists")
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(dashboard), 0644); err != nil {
+		Fatal(err)
+	}
+
+	Info("Created " + file + " from template " + *templatePointer)
+}
+
+// Grafonnet constructors for grafana panel types
+var grafonnet_panels = map[string]string{
+	"alertlist":       "alertList",
+	"annotationsList": "annotationsList",
+	"barchart":        "barChart",
+	"bargauge":        "barGauge",
+	"candlestick":     "candlestick",
+	"canvas":          "canvas",
+	"dashlist":        "dashboardList",
+	"datagrid":        "datagrid",
+	"flamegraph":      "flamegraph",
+	"gauge":           "gauge",
+	"geomap":          "geomap",
+	"heatmap":         "heatmap",
+	"histogram":       "histogram",
+	"logs":            "logs",
+	"news":            "news",
+	"nodeGraph":       "nodeGraph",
+	"piechart":        "pieChart",
+	"row":             "row",
+	"stat":            "stat",
+	"state-timeline":  "stateTimeline",
+	"status-history":  "statusHistory",
+	"table":           "table",
+	"text":            "text",
+	"timeseries":      "timeSeries",
+	"traces":          "traces",
+	"trend":           "trend",
+	"xychart":         "xyChart",
+}
+
+// Helper method to write a json value as jsonnet, which json already is
+func JsonnetLiteral(value interface{}) string {
+	bytes, _ := json.MarshalIndent(value, "", "  ")
+	return string(bytes)
+}
+
+// Helper method to write an object from fields that are already jsonnet code, in key order
+func JsonnetObject(fields map[string]string) string {
+
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	code := "{\n"
+	for _, key := range keys {
+		name, _ := json.Marshal(key)
+		code += string(name) + ": " + fields[key] + ",\n"
+	}
+	return code + "}"
+}
+
+// Helper method to write a constructor call followed by the fields it doesn't set as an object mixin
+func JsonnetMixin(constructor string, fields map[string]string) string {
+	if len(fields) == 0 {
+		return constructor
+	}
+	return constructor + " + " + JsonnetObject(fields)
+}
+
+// Convert a panel to a grafonnet constructor plus the rest of its fields. Unknown panel types stay plain objects.
+func ConvertPanel(panel map[string]interface{}) string {
+
+	panel_type, _ := panel["type"].(string)
+	constructor, ok := grafonnet_panels[panel_type]
+	if !ok {
+		return JsonnetLiteral(panel)
+	}
+
+	fields := map[string]string{}
+	for key, value := range panel {
+		if key != "type" && key != "title" {
+			fields[key] = JsonnetLiteral(value)
+		}
+	}
+
+	// Collapsed rows carry their panels with them
+	if nested, ok := panel["panels"].([]interface{}); ok {
+		fields["panels"] = ConvertPanels(nested)
+	}
+
+	title, _ := panel["title"].(string)
+	return JsonnetMixin("g.panel."+constructor+".new("+JsonnetLiteral(title)+")", fields)
+}
+
+// Helper method to convert a list of panels
+func ConvertPanels(panels []interface{}) string {
+
+	var converted []string
+	for _, panel := range panels {
+		if parsed, ok := panel.(map[string]interface{}); ok {
+			converted = append(converted, ConvertPanel(parsed))
+		} else {
+			converted = append(converted, JsonnetLiteral(panel))
+		}
+	}
+
+	return "[\n" + strings.Join(converted, ",\n") + "\n]"
+}
+
+// Convert a template variable to a grafonnet constructor plus the rest of its fields.
+// Only variable types whose constructors need no more than the name and query are converted.
+func ConvertVariable(variable map[string]interface{}) string {
+
+	name, _ := variable["name"].(string)
+	query, _ := variable["query"].(string)
+
+	var constructor string
+	switch variable["type"] {
+	case "query":
+		constructor = "g.dashboard.variable.query.new(" + JsonnetLiteral(name) + ")"
+	case "textbox":
+		constructor = "g.dashboard.variable.textbox.new(" + JsonnetLiteral(name) + ")"
+	case "constant":
+		constructor = "g.dashboard.variable.constant.new(" + JsonnetLiteral(name) + ", " + JsonnetLiteral(query) + ")"
+	case "datasource":
+		constructor = "g.dashboard.variable.datasource.new(" + JsonnetLiteral(name) + ", " + JsonnetLiteral(query) + ")"
+	default:
+		return JsonnetLiteral(variable)
+	}
+
+	fields := map[string]string{}
+	for key, value := range variable {
+		if key != "name" {
+			fields[key] = JsonnetLiteral(value)
+		}
+	}
+
+	return JsonnetMixin(constructor, fields)
+}
+
+// Convert an exported dashboard model to jsonnet built on grafonnet.
+// Fields the pipeline manages (id, uid and version) are dropped, the uid comes from the pipeline at render time.
+func ConvertDashboard(parsed_dashboard map[string]interface{}, grafonnet string) string {
+
+	title, _ := parsed_dashboard["title"].(string)
+
+	code := "local g = import " + JsonnetLiteral(grafonnet) + ";\n\n"
+	code += "g.dashboard.new(" + JsonnetLiteral(title) + ")\n"
+	code += "+ g.dashboard.withUid(std.extVar('uid'))\n"
+
+	var panels_code, variables_code string
+	fields := map[string]string{}
+	for key, value := range parsed_dashboard {
+		switch key {
+		case "id", "uid", "version", "title":
+		case "panels":
+			panels, ok := value.([]interface{})
+			if !ok {
+				fields[key] = JsonnetLiteral(value)
+				continue
+			}
+			panels_code = "+ g.dashboard.withPanels(" + ConvertPanels(panels) + ")\n"
+		case "templating":
+			templating, _ := value.(map[string]interface{})
+			variables, ok := templating["list"].([]interface{})
+			if !ok || len(templating) > 1 {
+				fields[key] = JsonnetLiteral(value)
+				continue
+			}
+
+			var converted []string
+			for _, variable := range variables {
+				if parsed, ok := variable.(map[string]interface{}); ok {
+					converted = append(converted, ConvertVariable(parsed))
+				} else {
+					converted = append(converted, JsonnetLiteral(variable))
+				}
+			}
+			variables_code = "+ g.dashboard.withVariables([\n" + strings.Join(converted, ",\n") + "\n])\n"
+		default:
+			fields[key] = JsonnetLiteral(value)
+		}
+	}
+	code += variables_code + panels_code
+
+	// Everything else is kept as it was exported
+	if len(fields) > 0 {
+		code += "+ " + JsonnetObject(fields) + "\n"
+	}
+
+	return code
+}
+
+// Convert exported json dashboards into jsonnet files next to them, e.g. go run build.go convert dashboards/payments/api.json
+func ConvertCommand(args []string) {
+
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	grafonnetPointer := flags.String("grafonnet", "github.com/grafana/grafonnet/gen/grafonnet-latest/main.libsonnet", "Import path of grafonnet.")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		Fatal("Usage: go run build.go convert <dashboard.json>...")
+	}
+
+	for _, source := range flags.Args() {
+
+		parsed_dashboard, err := ReadDashboard(source)
+		if err != nil {
+			Fatal(err)
+		}
+
+		out_file := strings.TrimSuffix(source, ".json") + ".jsonnet"
+		if _, err := os.Stat(out_file); err == nil {
+			Fatal(out_file + " already exists")
+		}
+
+		// The formatter turns the generated code into the layout fmt expects
+		formatted, err := formatter.Format(out_file, ConvertDashboard(parsed_dashboard, *grafonnetPointer), formatter.DefaultOptions())
+		if err != nil {
+			Fatalf("ERROR: converting %s: %s", source, err)
+		}
+
+		if err := ioutil.WriteFile(out_file, []byte(formatted), 0644); err != nil {
+			Fatal(err)
+		}
+
+		Info("Converted " + source + " to " + out_file + ", remove " + source + " once the render matches")
+	}
+}
+
+// Helper method to list every panel of a dashboard, including those inside rows, keyed by id or title when there is no id
+func PanelsByKey(parsed_dashboard map[string]interface{}) (map[string]map[string]interface{}, []string) {
+
+	panels := map[string]map[string]interface{}{}
+	var order []string
+
+	var add func(list interface{})
+	add = func(list interface{}) {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			panel, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			key, _ := panel["title"].(string)
+			if id, ok := panel["id"].(float64); ok {
+				key = "#" + strconv.Itoa(int(id))
+			}
+			if _, exists := panels[key]; !exists {
+				order = append(order, key)
+			}
+			panels[key] = panel
+
+			add(panel["panels"])
+		}
+	}
+
+	add(parsed_dashboard["panels"])
+
+	// Dashboards older than schema 16 keep their panels in rows
+	rows, _ := parsed_dashboard["rows"].([]interface{})
+	for _, row := range rows {
+		if row, ok := row.(map[string]interface{}); ok {
+			add(row["panels"])
+		}
+	}
+
+	return panels, order
+}
+
+// Helper method to name a panel in a change report
+func PanelName(panel map[string]interface{}) string {
+	title, _ := panel["title"].(string)
+	panel_type, _ := panel["type"].(string)
+	return fmt.Sprintf("%q (%s)", title, panel_type)
+}
+
+// Helper method to show a value in a change report, shortened so one change stays on one line
+func ChangeValue(value interface{}) string {
+
+	text, ok := value.(string)
+	if !ok {
+		bytes, _ := json.Marshal(value)
+		text = string(bytes)
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > 120 {
+		text = text[:117] + "..."
+	}
+	return "`" + text + "`"
+}
+
+// Helper method to compare two json values
+func SameValue(a interface{}, b interface{}) bool {
+	a_bytes, _ := json.Marshal(a)
+	b_bytes, _ := json.Marshal(b)
+	return bytes.Equal(a_bytes, b_bytes)
+}
+
+// The query text of a target, whichever datasource it is for
+func TargetQuery(target map[string]interface{}) interface{} {
+	for _, field := range []string{"expr", "query", "rawSql", "expression", "target"} {
+		if query, ok := target[field]; ok {
+			return query
+		}
+	}
+	return nil
+}
+
+// Compare the queries of two versions of a panel, matched by refId
+func DiffTargets(name string, old_panel map[string]interface{}, new_panel map[string]interface{}) []DashboardChange {
+
+	var changes []DashboardChange
+
+	targets := func(panel map[string]interface{}) (map[string]map[string]interface{}, []string) {
+		by_ref := map[string]map[string]interface{}{}
+		var order []string
+		list, _ := panel["targets"].([]interface{})
+		for i, item := range list {
+			target, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ref, _ := target["refId"].(string)
+			if ref == "" {
+				ref = strconv.Itoa(i)
+			}
+			by_ref[ref] = target
+			order = append(order, ref)
+		}
+		return by_ref, order
+	}
+
+	old_targets, old_order := targets(old_panel)
+	new_targets, new_order := targets(new_panel)
+
+	for _, ref := range new_order {
+		old_target, ok := old_targets[ref]
+		if !ok {
+			changes = append(changes, DashboardChange{ChangeModified, name, "query", "~ panel " + name + ": query " + ref + " added: " + ChangeValue(TargetQuery(new_targets[ref]))})
+			continue
+		}
+		if !SameValue(TargetQuery(old_target), TargetQuery(new_targets[ref])) {
+			changes = append(changes, DashboardChange{ChangeModified, name, "query", "~ panel " + name + ": query " + ref + ": " + ChangeValue(TargetQuery(old_target)) + " -> " + ChangeValue(TargetQuery(new_targets[ref]))})
+		} else if !SameValue(old_target, new_targets[ref]) {
+			changes = append(changes, DashboardChange{ChangeModified, name, "query", "~ panel " + name + ": query " + ref + " options changed"})
+		}
+	}
+	for _, ref := range old_order {
+		if _, ok := new_targets[ref]; !ok {
+			changes = append(changes, DashboardChange{ChangeModified, name, "query", "~ panel " + name + ": query " + ref + " removed: " + ChangeValue(TargetQuery(old_targets[ref]))})
+		}
+	}
+
+	return changes
+}
+
+// Helper method to read the threshold steps of a panel
+func PanelThresholds(panel map[string]interface{}) interface{} {
+	field_config, _ := panel["fieldConfig"].(map[string]interface{})
+	defaults, _ := field_config["defaults"].(map[string]interface{})
+	thresholds, _ := defaults["thresholds"].(map[string]interface{})
+	return thresholds["steps"]
+}
+
+// One difference between two versions of a dashboard. Text is the line shown to reviewers, starting with + for
+// additions, - for removals and ~ for changes; the other fields say what changed without parsing it.
+type DashboardChange struct {
+	Kind string
+
+	// The panel that changed, empty for variables and dashboard settings
+	Panel string
+
+	// What changed: panel, query, title, type, thresholds, layout or settings for panels, variable for template
+	// variables, or the name of the dashboard setting
+	Field string
+
+	Text string
+}
+
+// The kinds of dashboard change
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Describe how a dashboard changed between two versions, one change per line: panels added, removed or changed
+// (queries, thresholds, layout and other settings), template variables and dashboard settings.
+func DiffDashboards(old_dashboard map[string]interface{}, new_dashboard map[string]interface{}) []DashboardChange {
+
+	var changes []DashboardChange
+
+	for _, field := range []string{"title", "tags", "time", "refresh", "timezone"} {
+		if !SameValue(old_dashboard[field], new_dashboard[field]) {
+			changes = append(changes, DashboardChange{ChangeModified, "", field, "~ " + field + ": " + ChangeValue(old_dashboard[field]) + " -> " + ChangeValue(new_dashboard[field])})
+		}
+	}
+
+	// Template variables are matched by name
+	variables := func(parsed_dashboard map[string]interface{}) (map[string]map[string]interface{}, []string) {
+		by_name := map[string]map[string]interface{}{}
+		var order []string
+		templating, _ := parsed_dashboard["templating"].(map[string]interface{})
+		list, _ := templating["list"].([]interface{})
+		for _, item := range list {
+			if variable, ok := item.(map[string]interface{}); ok {
+				name, _ := variable["name"].(string)
+				by_name[name] = variable
+				order = append(order, name)
+			}
+		}
+		return by_name, order
+	}
+
+	old_variables, old_variable_order := variables(old_dashboard)
+	new_variables, new_variable_order := variables(new_dashboard)
+
+	for _, name := range new_variable_order {
+		old_variable, ok := old_variables[name]
+		switch {
+		case !ok:
+			changes = append(changes, DashboardChange{ChangeAdded, "", "variable", "+ variable " + name})
+		case !SameValue(old_variable["query"], new_variables[name]["query"]):
+			changes = append(changes, DashboardChange{ChangeModified, "", "variable", "~ variable " + name + " query: " + ChangeValue(old_variable["query"]) + " -> " + ChangeValue(new_variables[name]["query"])})
+		case !SameValue(old_variable, new_variables[name]):
+			changes = append(changes, DashboardChange{ChangeModified, "", "variable", "~ variable " + name + " settings changed"})
+		}
+	}
+	for _, name := range old_variable_order {
+		if _, ok := new_variables[name]; !ok {
+			changes = append(changes, DashboardChange{ChangeRemoved, "", "variable", "- variable " + name})
+		}
+	}
+
+	old_panels, old_order := PanelsByKey(old_dashboard)
+	new_panels, new_order := PanelsByKey(new_dashboard)
+
+	for _, key := range new_order {
+
+		new_panel := new_panels[key]
+		old_panel, ok := old_panels[key]
+		if !ok {
+			changes = append(changes, DashboardChange{ChangeAdded, PanelName(new_panel), "panel", "+ panel " + PanelName(new_panel)})
+			continue
+		}
+
+		name := PanelName(new_panel)
+		panel_changes := DiffTargets(name, old_panel, new_panel)
+
+		if !SameValue(old_panel["title"], new_panel["title"]) {
+			panel_changes = append(panel_changes, DashboardChange{ChangeModified, name, "title", "~ panel " + name + ": renamed from " + ChangeValue(old_panel["title"])})
+		}
+		if !SameValue(old_panel["type"], new_panel["type"]) {
+			panel_changes = append(panel_changes, DashboardChange{ChangeModified, name, "type", "~ panel " + name + ": type " + ChangeValue(old_panel["type"]) + " -> " + ChangeValue(new_panel["type"])})
+		}
+		if !SameValue(PanelThresholds(old_panel), PanelThresholds(new_panel)) {
+			panel_changes = append(panel_changes, DashboardChange{ChangeModified, name, "thresholds", "~ panel " + name + ": thresholds " + ChangeValue(PanelThresholds(old_panel)) + " -> " + ChangeValue(PanelThresholds(new_panel))})
+		}
+		if !SameValue(old_panel["gridPos"], new_panel["gridPos"]) {
+			panel_changes = append(panel_changes, DashboardChange{ChangeModified, name, "layout", "~ panel " + name + ": moved or resized"})
+		}
+
+		// Anything else is summarised rather than listed field by field
+		if len(panel_changes) == 0 {
+			old_rest, new_rest := map[string]interface{}{}, map[string]interface{}{}
+			for field, value := range old_panel {
+				if field != "panels" {
+					old_rest[field] = value
+				}
+			}
+			for field, value := range new_panel {
+				if field != "panels" {
+					new_rest[field] = value
+				}
+			}
+			if !SameValue(old_rest, new_rest) {
+				panel_changes = append(panel_changes, DashboardChange{ChangeModified, name, "settings", "~ panel " + name + ": display settings changed"})
+			}
+		}
+
+		changes = append(changes, panel_changes...)
+	}
+	for _, key := range old_order {
+		if _, ok := new_panels[key]; !ok {
+			changes = append(changes, DashboardChange{ChangeRemoved, PanelName(old_panels[key]), "panel", "- panel " + PanelName(old_panels[key])})
+		}
+	}
+
+	// Whatever else differs, such as annotations or links
+	if len(changes) == 0 && ContentHash(old_dashboard) != ContentHash(new_dashboard) {
+		changes = append(changes, DashboardChange{ChangeModified, "", "settings", "~ dashboard settings changed"})
+	}
+
+	return changes
+}
+
+// Render dashboards and print how each differs from what is deployed in an environment, e.g. for reviewers in a merge request job log.
+// Dashboards are rendered as the merge request target branch, or the current branch, so their uids match the deployed copies.
+func DiffCommand(args []string) {
+
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	envPointer := flags.String("env", "", "Environment to compare against, as named in the config.")
+	branchPointer := flags.String("branch", "", "Branch whose deployed dashboards to compare against. Defaults to the merge request target branch, then CI_COMMIT_BRANCH.")
+	outPointer := flags.String("out", "dist", "Directory to render dashboards into. It is emptied before rendering.")
+	allPointer := flags.Bool("all", false, "Compare every dashboard instead of only those in git-diff.json.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	grafana_servers, err := UseEnvironment(*envPointer)
+	if err != nil {
+		Fatal(err)
+	}
+
+	branch := *branchPointer
+	for _, variable := range []string{"CI_MERGE_REQUEST_TARGET_BRANCH_NAME", "CI_COMMIT_BRANCH", "CI_DEFAULT_BRANCH"} {
+		if branch == "" {
+			branch = os.Getenv(variable)
+		}
+	}
+	if branch == "" {
+		branch = "master"
+	}
+	clean_branch := strings.Replace(branch, "/", "", -1)
+
+	var changed []FileChange
+	if *allPointer {
+		changed, err = ListDashboardSources()
+	} else {
+		changed, err = LoadChanges("git-diff.json")
+		if err == nil {
+			changed, err = AddAffectedDashboards(changed)
+		}
+	}
+	if err != nil {
+		Fatal(err)
+	}
+
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	if err := CleanOutputDir(out_dir); err != nil {
+		Fatal(err)
+	}
+
+	StartSection("render", "Rendering dashboards as "+branch, true)
+	RenderChanged(changed, clean_branch, out_dir)
+	EndSection("render")
+
+	dashboards, err := RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Every server in an environment has the same dashboards, the first is enough to compare against
+	differences := 0
+	for _, dashboard := range dashboards {
+
+		parsed_dashboard, err := ReadDashboard(dashboard)
+		if err != nil {
+			Fatal(err)
+		}
+		dashboard_uid, _ := parsed_dashboard["uid"].(string)
+
+		live, _, err := LiveDashboard(dashboard_uid, grafana_servers[0])
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		source := rendered_from[dashboard]
+		if source == "" {
+			source = dashboard
+		}
+
+		if live == nil {
+			fmt.Println(source + ": new dashboard, not deployed to " + environment.Name)
+			differences++
+			continue
+		}
+
+		changes := DiffDashboards(live, parsed_dashboard)
+		if len(changes) == 0 {
+			Verbose(source + ": unchanged")
+			continue
+		}
+
+		differences++
+		fmt.Println(source + ":")
+		for _, change := range changes {
+			fmt.Println("  " + change.Text)
+		}
+	}
+
+	Infof("%d of %d dashboard(s) differ from %s\n", differences, len(dashboards), environment.Name)
+}
+
+// Helper method to select an environment from the config by name for the operator commands,
+// resolving its credentials and returning its grafana servers
+func UseEnvironment(name string) ([]string, error) {
+
+	env, ok := config.Environments[name]
+	if !ok {
+		return nil, errors.New("Unknown environment: " + name)
+	}
+	environment = env
+
+	if err := ResolveCredentials(environment); err != nil {
+		return nil, err
+	}
+
+	return GrafanaURLs(environment)
+}
+
+// A dashboard managed by this pipeline as printed by the list command
+type ListedDashboard struct {
+	UID       string    `json:"uid"`
+	Title     string    `json:"title"`
+	FolderUID string    `json:"folderUid"`
+	Folder    string    `json:"folder"`
+	Tags      []string  `json:"tags"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Print the dashboards this pipeline manages on an environments first server, as a table or json
+func ListCommand(args []string) {
+
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	envPointer := flags.String("env", "", "Environment to list, as named in the config.")
+	folderPointer := flags.String("folder", "", "Only list dashboards in the folder with this uid.")
+	statePointer := flags.String("state", "grafana-state.json", "File recording which dashboards this pipeline has deployed to each environment.")
+	jsonPointer := flags.Bool("json", false, "Print a json array instead of a table.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	grafana_servers, err := UseEnvironment(*envPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	if err := LoadState(*statePointer); err != nil {
+		Fatal(err)
+	}
+
+	var results []SearchResult
+	if *folderPointer != "" {
+		results, err = FolderDashboards(*folderPointer, grafana_servers[0])
+	} else {
+		results, err = SearchDashboards(grafana_servers[0], "")
+	}
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	// Generated uids identify branch copies the state file may have lost track of, unless they have no prefix
+	deployments := EnvironmentDeployments()
+	var listed []ListedDashboard
+	for _, result := range results {
+
+		generated := UIDPrefix() != "" && strings.HasPrefix(result.UID, UIDPrefix())
+		if _, ok := deployments[result.UID]; !ok && !generated {
+			continue
+		}
+
+		_, meta, err := LiveDashboard(result.UID, grafana_servers[0])
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		listed = append(listed, ListedDashboard{
+			UID:       result.UID,
+			Title:     result.Title,
+			FolderUID: result.FolderUID,
+			Folder:    result.FolderTitle,
+			Tags:      result.Tags,
+			Updated:   meta.Updated,
+		})
+	}
+
+	sort.Slice(listed, func(i, j int) bool {
+		if listed[i].Folder != listed[j].Folder {
+			return listed[i].Folder < listed[j].Folder
+		}
+		return listed[i].Title < listed[j].Title
+	})
+
+	if *jsonPointer {
+		if listed == nil {
+			listed = []ListedDashboard{}
+		}
+		bytes, err := json.MarshalIndent(listed, "", "  ")
+		if err != nil {
+			Fatal(err)
+		}
+		fmt.Println(string(bytes))
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "UID\tTITLE\tFOLDER\tTAGS\tUPDATED")
+	for _, dashboard := range listed {
+		folder := dashboard.Folder
+		if folder == "" {
+			folder = GeneralFolder
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", dashboard.UID, dashboard.Title, folder, strings.Join(dashboard.Tags, ","), dashboard.Updated.Format(time.RFC3339))
+	}
+	writer.Flush()
+}
+
+// Delete dashboards by uid or title glob, or whole folders, from every server in an environment.
+// Lists what will be deleted first and asks for confirmation unless --yes is passed.
+func DeleteCommand(args []string) {
+
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	envPointer := flags.String("env", "", "Environment to delete from, as named in the config.")
+	folderPointer := flags.String("folder", "", "Delete the folder with this uid and every dashboard in it. Combined with --uid or --title only dashboards in it are deleted.")
+	uidPointer := flags.String("uid", "", "Delete the dashboard with this uid.")
+	titlePointer := flags.String("title", "", "Delete dashboards whose title matches this glob, e.g. 'Payments *'. Combine with --folder to only look in that folder.")
+	statePointer := flags.String("state", "grafana-state.json", "File recording which dashboards this pipeline has deployed to each environment.")
+	dryRunPointer := flags.Bool("dry-run", false, "Only list what would be deleted.")
+	yesPointer := flags.Bool("yes", false, "Don't ask for confirmation, needed when not running in a terminal.")
+	flags.Parse(args)
+
+	if *folderPointer == "" && *uidPointer == "" && *titlePointer == "" {
+		Fatal("Pass --folder, --uid or --title to choose what to delete")
+	}
+	if _, err := path.Match(*titlePointer, ""); err != nil {
+		Fatal("Invalid --title glob: " + err.Error())
+	}
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	grafana_servers, err := UseEnvironment(*envPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	if err := LoadState(*statePointer); err != nil {
+		Fatal(err)
+	}
+
+	// Work out the targets on the first server, every server in an environment has the same dashboards
+	var dashboards []SearchResult
+	delete_folder := *folderPointer != "" && *titlePointer == "" && *uidPointer == ""
+
+	if *titlePointer != "" {
+		var results []SearchResult
+		if *folderPointer != "" {
+			results, err = FolderDashboards(*folderPointer, grafana_servers[0])
+		} else {
+			results, err = SearchDashboards(grafana_servers[0], "")
+		}
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+		for _, result := range results {
+			if matched, _ := path.Match(*titlePointer, result.Title); matched {
+				dashboards = append(dashboards, result)
+			}
+		}
+	} else if delete_folder {
+		dashboards, err = FolderDashboards(*folderPointer, grafana_servers[0])
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+	}
+	// Look the uid up so the listing and confirmation show what it is, and --folder can scope it
+	if *uidPointer != "" {
+		live, live_meta, err := LiveDashboard(*uidPointer, grafana_servers[0])
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		switch {
+		case live == nil:
+			fmt.Println("WARNING: no dashboard with uid " + *uidPointer + " on " + grafana_servers[0])
+		case *folderPointer != "" && live_meta.FolderUID != *folderPointer:
+			Fatal("Dashboard " + *uidPointer + " is in folder " + SummaryFolder(live_meta.FolderUID, grafana_servers[0]) + ", not " + *folderPointer + ", nothing deleted")
+		default:
+			title, _ := live["title"].(string)
+			dashboards = append(dashboards, SearchResult{UID: *uidPointer, Title: title, FolderUID: live_meta.FolderUID})
+		}
+	}
+
+	if len(dashboards) == 0 && !delete_folder {
+		Info("Nothing matches, not deleting anything")
+		return
+	}
+
+	fmt.Println("Deleting from " + environment.Name + " (" + strings.Join(grafana_servers, ", ") + "):")
+	for _, dashboard := range dashboards {
+		fmt.Println("  dashboard " + dashboard.Title + " (" + dashboard.UID + ")")
+	}
+	if delete_folder {
+		fmt.Println("  folder " + *folderPointer)
+	}
+
+	if *dryRunPointer {
+		return
+	}
+
+	if !*yesPointer {
+		info, _ := os.Stdin.Stat()
+		if info == nil || info.Mode()&os.ModeCharDevice == 0 {
+			Fatal("Not running in a terminal, pass --yes to delete without confirmation")
+		}
+
+		fmt.Print("Type the environment name to confirm: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != environment.Name {
+			Fatal("Not confirmed, nothing deleted")
+		}
+	}
+
+	for _, grafana_server := range grafana_servers {
+
+		for _, dashboard := range dashboards {
+			if err := DeleteDashboard(dashboard.UID, grafana_server); err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+		}
+
+		if delete_folder {
+			if err := DeletePreviewFolder(*folderPointer, grafana_server); err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+		}
+	}
+
+	if err := SaveState(*statePointer); err != nil {
+		Fatal(err)
+	}
+}
+
+// Download every dashboard in a folder on an environments first server into json files,
+// for backups and for bringing manually managed dashboards into the repo with the convert command
+func ExportCommand(args []string) {
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	envPointer := flags.String("env", "", "Environment to export from, as named in the config.")
+	folderPointer := flags.String("folder", "", "Uid of the folder to export.")
+	outPointer := flags.String("out", "backup", "Directory to write the dashboards into.")
+	flags.Parse(args)
+
+	if *folderPointer == "" {
+		Fatal("Pass --folder with the uid of the folder to export")
+	}
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	grafana_servers, err := UseEnvironment(*envPointer)
+	if err != nil {
+		Fatal(err)
+	}
+
+	results, err := FolderDashboards(*folderPointer, grafana_servers[0])
+	if err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	if err := os.MkdirAll(out_dir, 0755); err != nil {
+		Fatal(err)
+	}
+
+	written := map[string]bool{}
+	for _, result := range results {
+
+		live, _, err := LiveDashboard(result.UID, grafana_servers[0])
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+		if live == nil {
+			Info("Dashboard " + result.UID + " was deleted while exporting, skipping")
+			continue
+		}
+
+		// Written in the fmt-json canonical form, which also drops the id and version that belong to the server
+		exported, err := json.Marshal(live)
+		if err != nil {
+			Fatal(err)
+		}
+		bytes, err := CanonicalJSON(exported)
+		if err != nil {
+			Fatal(err)
+		}
+
+		// Dashboards in a folder can share a title, the uid keeps their files apart
+		name := Slugify(result.Title)
+		if name == "" || written[name] {
+			name = Slugify(result.Title + " " + result.UID)
+		}
+		written[name] = true
+
+		file := out_dir + "/" + name + ".json"
+		if err := ioutil.WriteFile(file, bytes, 0644); err != nil {
+			Fatal(err)
+		}
+		Info("Exported " + result.Title + " to " + file)
+	}
+
+	Info(fmt.Sprintf("Exported %d dashboard(s) from folder %s", len(written), *folderPointer))
+}
+
+// A change sync makes to one dashboard: create, update or delete
+type SyncAction struct {
+	Action    string
+	UID       string
+	Title     string
+	FolderUID string
+}
+
+// Work out what it takes to make the deploy targets folders on a server hold exactly the rendered dashboards
+func PlanSync(targets []DeployTarget, grafana_server string) ([]SyncAction, error) {
+
+	var plan []SyncAction
+	produced := map[string]bool{}
+	folders := map[string]bool{}
+
+	for _, target := range targets {
+
+		folders[target.FolderUID] = true
+
+		dashboards, err := RenderedDashboards(target.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dashboard := range dashboards {
+
+			parsed_dashboard, err := ReadDashboard(dashboard)
+			if err != nil {
+				return nil, err
+			}
+			dashboard_uid, _ := parsed_dashboard["uid"].(string)
+			title, _ := parsed_dashboard["title"].(string)
+
+			folder_uid := TargetFolder(dashboard, target.FolderUID)
+			folders[folder_uid] = true
+			produced[dashboard_uid] = true
+
+			live, live_meta, err := LiveDashboard(dashboard_uid, grafana_server)
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case live == nil:
+				plan = append(plan, SyncAction{Action: "create", UID: dashboard_uid, Title: title, FolderUID: folder_uid})
+			case live_meta.FolderUID != folder_uid || ContentHash(live) != ContentHash(parsed_dashboard):
+				plan = append(plan, SyncAction{Action: "update", UID: dashboard_uid, Title: title, FolderUID: folder_uid})
+			}
+		}
+	}
+
+	// Sorted so the plan reads the same every time
+	var folder_uids []string
+	for folder_uid := range folders {
+		folder_uids = append(folder_uids, folder_uid)
+	}
+	sort.Strings(folder_uids)
+
+	for _, folder_uid := range folder_uids {
+
+		// Anyone can put dashboards in the general folder, so nothing there counts as extra
+		if folder_uid == "" {
+			continue
+		}
+
+		live, err := FolderDashboards(folder_uid, grafana_server)
+		if IsGrafanaStatus(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dashboard := range live {
+			if !produced[dashboard.UID] {
+				plan = append(plan, SyncAction{Action: "delete", UID: dashboard.UID, Title: dashboard.Title, FolderUID: folder_uid})
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Helper method to print a sync plan, returning whether it changes anything
+func PrintSyncPlan(plan []SyncAction, grafana_server string) bool {
+
+	counts := map[string]int{}
+	colors := map[string]string{"create": ColorGreen, "update": ColorYellow, "delete": ColorRed}
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-"}
+
+	fmt.Println("Plan for " + grafana_server + ":")
+	for _, action := range plan {
+		counts[action.Action]++
+		folder := action.FolderUID
+		if folder == "" {
+			folder = GeneralFolder
+		}
+		fmt.Println("  " + Colorize(colors[action.Action], symbols[action.Action]+" "+action.Action) + "  " + action.Title + " (" + action.UID + ") in " + folder)
+	}
+	fmt.Printf("Plan: %d to create, %d to update, %d to delete.\n", counts["create"], counts["update"], counts["delete"])
+
+	return len(plan) > 0
+}
+
+// Make the branch folders in an environment match the repo exactly: render every dashboard, print a plan of what
+// will be created, updated and deleted, and with --apply carry it out on every server
+func SyncCommand(args []string) {
+
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	envPointer := flags.String("env", "", "Environment to sync, as named in the config. Defaults to the environment the branch deploys to.")
+	branchPointer := flags.String("branch", "", "Branch to sync. Defaults to CI_COMMIT_BRANCH, then the default branch.")
+	projectPointer := flags.String("project", "", "Project name for the folder title, as for deploys.")
+	outPointer := flags.String("out", "dist", "Directory to render dashboards into. It is emptied before rendering.")
+	statePointer := flags.String("state", "grafana-state.json", "File recording which dashboards this pipeline has deployed to each environment.")
+	confirmPointer := flags.String("confirm", "", "Name of the protected environment being synced, required to apply to protected environments.")
+	continuePointer := flags.Bool("continue-on-error", false, "Attempt every dashboard and report failures at the end instead of stopping on the first.")
+	applyPointer := flags.Bool("apply", false, "Carry out the plan. Without it the plan is only printed.")
+	resyncPointer := flags.Bool("resync", false, "Reconcile every server with the default branch, for scheduled pipelines. Implies --apply and --continue-on-error.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	branch := *branchPointer
+	for _, variable := range []string{"CI_COMMIT_BRANCH", "CI_DEFAULT_BRANCH"} {
+		if branch == "" {
+			branch = os.Getenv(variable)
+		}
+	}
+	if branch == "" {
+		branch = "master"
+	}
+
+	// The working tree is what gets rendered, so a re-sync has to run on the default branch to heal the canonical folders
+	if *resyncPointer {
+		if branch != DefaultBranch() {
+			Fatal("--resync reconciles the " + DefaultBranch() + " folders and has to run on " + DefaultBranch() + ", not " + branch)
+		}
+		*applyPointer = true
+		*continuePointer = true
+	}
+	clean_branch := strings.Replace(branch, "/", "", -1)
+
+	var grafana_servers []string
+	if *envPointer != "" {
+		grafana_servers, err = UseEnvironment(*envPointer)
+	} else {
+		environment, err = SelectGrafanaServer(branch, os.Getenv("CI_COMMIT_TAG"))
+		if err == nil {
+			err = ResolveCredentials(environment)
+		}
+		if err == nil {
+			grafana_servers, err = GrafanaURLs(environment)
+		}
+	}
+	if err != nil {
+		Fatal(err)
+	}
+
+	if *applyPointer {
+		if err := CheckConfirmation(environment, *confirmPointer); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if err := LoadState(*statePointer); err != nil {
+		Fatal(err)
+	}
+
+	// Only a full render shows what the folders should hold
+	sources, err := ListDashboardSources()
+	if err != nil {
+		Fatal(err)
+	}
+
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	if err := CleanOutputDir(out_dir); err != nil {
+		Fatal(err)
+	}
+
+	// Syncs deploy like any other run, so they run the same hooks
+	hook_context := HookContext{Branch: branch, Environment: environment.Name, Servers: grafana_servers, OutDir: out_dir}
+
+	EnterPhase("validate")
+	hook_context.Hook = "pre_render"
+	for _, source := range sources {
+		hook_context.Dashboards = append(hook_context.Dashboards, source.Path)
+	}
+	if err := RunHooks(config.Hooks.PreRender, hook_context); err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+
+	EnterPhase("render")
+	StartSection("render", "Rendering dashboards", true)
+	RenderChanged(sources, clean_branch, out_dir)
+	RenderMixins(sources, clean_branch, out_dir, true)
+	EndSection("render")
+
+	EnterPhase("validate")
+	hook_context.Hook = "post_render"
+	hook_context.Dashboards, err = RenderedDashboards(out_dir)
+	if err != nil {
+		Fatal(err)
+	}
+	if err := RunHooks(config.Hooks.PostRender, hook_context); err != nil {
+		Fatalf("ERROR: %s", err)
+	}
+	EnterPhase("deploy")
+
+	targets, err := DeployTargets(out_dir, branch, clean_branch, *projectPointer)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Every server in an environment should hold the same dashboards, the first stands in for the rest.
+	// A re-sync is there to heal drift, so it plans every server rather than trusting one to speak for the others.
+	plan_servers := grafana_servers[:1]
+	if *resyncPointer {
+		plan_servers = grafana_servers
+	}
+
+	changes := false
+	for _, grafana_server := range plan_servers {
+		plan, err := PlanSync(targets, grafana_server)
+		if err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+		if PrintSyncPlan(plan, grafana_server) {
+			changes = true
+		}
+	}
+	if !changes {
+		Info("Grafana already matches the repo")
+		return
+	}
+
+	if !*applyPointer {
+		fmt.Println("Run with --apply to make these changes.")
+		return
+	}
+
+	options := DeployOptions{
+		ContinueOnError:   *continuePointer,
+		SkipUnchanged:     true,
+		DatasourceCheck:   "warn",
+		LibraryPanelCheck: "fail",
+		Verify:            true,
+		Overwrite:         "force",
+	}
+	if *resyncPointer {
+		options.Message = "Scheduled re-sync"
+	}
+
+	server_failures := map[string][]DeployFailure{}
+	for _, grafana_server := range grafana_servers {
+
+		StartSection("deploy "+grafana_server, "Syncing server: "+grafana_server, false)
+
+		server_failures[grafana_server] = DeployToServer(grafana_server, out_dir, branch, clean_branch, *projectPointer, options)
+
+		// Only deletes are left once everything is deployed, and nothing is deleted from a partially deployed server
+		if len(server_failures[grafana_server]) == 0 {
+			remaining, err := PlanSync(targets, grafana_server)
+			if err != nil {
+				Fatalf("ERROR: %s", err)
+			}
+			for _, action := range remaining {
+				if action.Action != "delete" {
+					continue
+				}
+				if err := DeleteDashboard(action.UID, grafana_server); err != nil {
+					Fatalf("ERROR: %s", err)
+				}
+			}
+		}
+
+		EndSection("deploy " + grafana_server)
+	}
+
+	ok := ReportServerResults(grafana_servers, server_failures, nil)
+	if err := SaveState(*statePointer); err != nil {
+		Fatal(err)
+	}
+	if err := SaveUIDManifest(); err != nil {
+		Fatal(err)
+	}
+
+	// Downstream automation hears about syncs of the default branch like any other deploy
+	PostCompletionWebhook(branch, grafana_servers, server_failures)
+
+	hook_context.Hook = "post_deploy"
+	hook_context.Deployed = deployed_dashboards
+	hook_context.Failed = SummaryFailures(grafana_servers, server_failures)
+	if err := RunHooks(config.Hooks.PostDeploy, hook_context); err != nil {
+		if ok {
+			Fatalf("ERROR: %s", err)
+		}
+		log.Printf("ERROR: %s", err)
+	}
+
+	if !ok {
+		os.Exit(DeployExitCode())
+	}
+}
+
+// Helper method to write the files of a branch into a directory, fetching the branch first if it can.
+// Uses go-git like git-diff.go so no git binary is needed.
+func ExtractBranch(branch string, dir string) error {
+
+	repo, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return errors.New("Opening repository: " + err.Error())
+	}
+
+	// Merge request pipelines only fetch the merge request itself
+	refspec := gitconfig.RefSpec("+refs/heads/" + branch + ":refs/remotes/origin/" + branch)
+	err = repo.Fetch(&git.FetchOptions{RemoteName: "origin", RefSpecs: []gitconfig.RefSpec{refspec}})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		fmt.Println("WARNING: could not fetch " + branch + ", using the local copy: " + err.Error())
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision("refs/remotes/origin/" + branch))
+	if err != nil {
+		hash, err = repo.ResolveRevision(plumbing.Revision(branch))
+	}
+	if err != nil {
+		return errors.New("Resolving " + branch + ": " + err.Error())
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	return tree.Files().ForEach(func(file *object.File) error {
+
+		contents, err := file.Contents()
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, []byte(contents), 0644)
+	})
+}
+
+// Helper method to read the title of a rendered dashboard, falling back to the given name
+func DashboardTitle(dashboard string, fallback string) string {
+
+	parsed_dashboard, err := ReadDashboard(dashboard)
+	if err != nil {
+		return fallback
+	}
+	if title, ok := parsed_dashboard["title"].(string); ok && title != "" {
+		return title
+	}
+
+	return fallback
+}
+
+// Helper method to sum up the changes DiffDashboards found in one line for a changelog,
+// e.g. "1 panel(s) added, 2 panel(s) changed, 3 query(s) changed"
+func SummarizeChanges(changes []DashboardChange) string {
+
+	var panels_added, panels_removed, queries, variables int
+	panels_changed := map[string]bool{}
+	settings := false
+
+	for _, change := range changes {
+		switch {
+		case change.Field == "panel" && change.Kind == ChangeAdded:
+			panels_added++
+		case change.Field == "panel" && change.Kind == ChangeRemoved:
+			panels_removed++
+		case change.Panel != "":
+			if change.Field == "query" {
+				queries++
+			}
+			panels_changed[change.Panel] = true
+		case change.Field == "variable":
+			variables++
+		default:
+			settings = true
+		}
+	}
+
+	var parts []string
+	for _, count := range []struct {
+		n    int
+		text string
+	}{
+		{panels_added, "panel(s) added"},
+		{panels_removed, "panel(s) removed"},
+		{len(panels_changed), "panel(s) changed"},
+		{queries, "query(s) changed"},
+		{variables, "variable(s) changed"},
+	} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.text))
+		}
+	}
+	if settings {
+		parts = append(parts, "dashboard settings changed")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Helper method to build a changelog fragment, in the keep a changelog style, from the dashboards a change adds,
+// modifies and removes. Ready to paste into release notes or a merge request description.
+func ChangelogFragment(added []string, modified []string, removed []string) string {
+
+	if len(added)+len(modified)+len(removed) == 0 {
+		return "No dashboard changes.\n"
+	}
+
+	fragment := ""
+	for _, section := range []struct {
+		heading string
+		entries []string
+	}{
+		{"Added", added},
+		{"Changed", modified},
+		{"Removed", removed},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		fragment += "### " + section.heading + "\n\n"
+		for _, entry := range section.entries {
+			fragment += "- " + entry + "\n"
+		}
+		fragment += "\n"
+	}
+
+	return fragment
+}
+
+// Render the dashboards changed in a merge request as they are now and as they are on the target branch,
+// and report which panels, queries and variables changed as a markdown artifact and optionally a merge request note.
+func ChangesCommand(args []string) {
+
+	flags := flag.NewFlagSet("changes", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	targetPointer := flags.String("target", "", "Branch to compare with. Defaults to the merge request target branch, then the default branch.")
+	outPointer := flags.String("out", "dist", "Directory to render dashboards into. It is emptied before rendering.")
+	reportPointer := flags.String("report", "dashboard-changes.md", "Markdown file to write the report to.")
+	notePointer := flags.Bool("note", false, "Also post the report on the merge request, needs GITLAB_TOKEN.")
+	changelogPointer := flags.String("changelog", "dashboard-changelog.md", "Markdown file to write a changelog fragment of added, changed and removed dashboards to. Empty to skip it.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	target := *targetPointer
+	for _, variable := range []string{"CI_MERGE_REQUEST_TARGET_BRANCH_NAME", "CI_DEFAULT_BRANCH"} {
+		if target == "" {
+			target = os.Getenv(variable)
+		}
+	}
+	if target == "" {
+		target = "master"
+	}
+
+	changed, err := LoadChanges("git-diff.json")
+	if err == nil {
+		changed, err = AddAffectedDashboards(changed)
+	}
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Both sides are rendered as the target branch so only the sources differ
+	clean_branch := strings.Replace(target, "/", "", -1)
+
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	new_dir, err := filepath.Abs(out_dir + "/new")
+	if err != nil {
+		Fatal(err)
+	}
+	old_dir, err := filepath.Abs(out_dir + "/old")
+	if err != nil {
+		Fatal(err)
+	}
+	if err := CleanOutputDir(out_dir); err != nil {
+		Fatal(err)
+	}
+
+	StartSection("render", "Rendering changed dashboards", true)
+
+	var before []FileChange
+	for _, change := range changed {
+		switch change.Status {
+		case "A":
+		case "R":
+			before = append(before, FileChange{Path: change.OldPath, Status: "M"})
+		default:
+			before = append(before, FileChange{Path: change.Path, Status: "M"})
+		}
+	}
+
+	os.MkdirAll(new_dir, 0755)
+	RenderChanged(changed, clean_branch, new_dir)
+
+	tree, err := ioutil.TempDir("", "grafana-changes")
+	if err != nil {
+		Fatal(err)
+	}
+	defer os.RemoveAll(tree)
+
+	if err := ExtractBranch(target, tree); err != nil {
+		Fatal(err)
+	}
+
+	// Vendored libraries are often installed by the pipeline rather than committed
+	if _, err := os.Stat(tree + "/vendor"); err != nil {
+		if vendor, err := filepath.Abs("vendor"); err == nil {
+			if _, err := os.Stat(vendor); err == nil {
+				os.Symlink(vendor, tree+"/vendor")
+			}
+		}
+	}
+
+	working_dir, err := os.Getwd()
+	if err != nil {
+		Fatal(err)
+	}
+	if err := os.Chdir(tree); err != nil {
+		Fatal(err)
+	}
+
+	// A dashboard moved to another project keeps its uid, which isn't a collision between the two branches
+	rendered_uids = map[string]string{}
+
+	// Sources the target branch doesn't have are new dashboards, not render failures
+	var existing []FileChange
+	for _, change := range before {
+		if _, err := os.Stat(change.Path); err == nil {
+			existing = append(existing, change)
+		}
+	}
+	os.MkdirAll(old_dir, 0755)
+	RenderChanged(existing, clean_branch, old_dir)
+
+	if err := os.Chdir(working_dir); err != nil {
+		Fatal(err)
+	}
+
+	EndSection("render")
+
+	list := func(dir string) map[string]string {
+		files := map[string]string{}
+		dashboards, err := RenderedDashboards(dir)
+		if err != nil {
+			Fatal(err)
+		}
+		for _, dashboard := range dashboards {
+			relative, _ := filepath.Rel(dir, dashboard)
+			files[filepath.ToSlash(relative)] = dashboard
+		}
+		return files
+	}
+	old_files, new_files := list(old_dir), list(new_dir)
+
+	var names []string
+	for name := range new_files {
+		names = append(names, name)
+	}
+	for name := range old_files {
+		if _, ok := new_files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	report := ""
+	var added, modified, removed []string
+	for _, name := range names {
+
+		var changes []DashboardChange
+		switch {
+		case old_files[name] == "":
+			changes = []DashboardChange{{ChangeAdded, "", "dashboard", "+ new dashboard"}}
+		case new_files[name] == "":
+			changes = []DashboardChange{{ChangeRemoved, "", "dashboard", "- dashboard removed"}}
+		default:
+			old_dashboard, err := ReadDashboard(old_files[name])
+			if err != nil {
+				Fatal(err)
+			}
+			new_dashboard, err := ReadDashboard(new_files[name])
+			if err != nil {
+				Fatal(err)
+			}
+			changes = DiffDashboards(old_dashboard, new_dashboard)
+		}
+
+		if len(changes) == 0 {
+			continue
+		}
+
+		// Removed dashboards were only rendered from the target branch
+		source := rendered_from[new_files[name]]
+		if source == "" {
+			source = rendered_from[old_files[name]]
+		}
+		if source == "" {
+			source = name
+		}
+
+		// The changelog names dashboards by title, removed ones as they were on the target branch
+		file := new_files[name]
+		if file == "" {
+			file = old_files[name]
+		}
+		entry := "**" + DashboardTitle(file, name) + "** (" + source + ")"
+		switch {
+		case old_files[name] == "":
+			added = append(added, entry)
+		case new_files[name] == "":
+			removed = append(removed, entry)
+		default:
+			modified = append(modified, entry+": "+SummarizeChanges(changes))
+		}
+
+		fmt.Println(source + ":")
+		report += "**" + source + "**\n\n"
+		for _, change := range changes {
+			fmt.Println("  " + change.Text)
+			report += "- " + change.Text + "\n"
+		}
+		report += "\n"
+	}
+
+	if report == "" {
+		Info("No dashboard changes compared to " + target)
+		report = "No dashboard changes.\n"
+	}
+	report = "### Dashboard changes compared to " + target + "\n\n" + report
+
+	if err := ioutil.WriteFile(*reportPointer, []byte(report), 0644); err != nil {
+		Fatal(err)
+	}
+
+	if *changelogPointer != "" {
+		if err := ioutil.WriteFile(*changelogPointer, []byte(ChangelogFragment(added, modified, removed)), 0644); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if *notePointer {
+		CI_MERGE_REQUEST_IID := os.Getenv("CI_MERGE_REQUEST_IID")
+		if CI_MERGE_REQUEST_IID == "" {
+			fmt.Println("WARNING: not a merge request pipeline, not posting the change report")
+			return
+		}
+
+		// Later pipelines update the report rather than adding another note
+		if err := UpsertMergeRequestNote("grafana-pipeline:changes", report); err != nil {
+			Fatal(err)
+		}
+	}
+}
+
+// Delete branch preview folders, and their dashboards, that haven't been deployed to for longer than --older-than.
+// Meant for a scheduled pipeline sharing the deployment state cache with the deploy jobs.
+// With --merge-request only the previews of the merge requests source branch are deleted, from a stop job run when it is merged or closed.
+func CleanupCommand(args []string) {
+
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	configPointer := flags.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	statePointer := flags.String("state", "grafana-state.json", "File recording which dashboards and preview folders this pipeline has deployed.")
+	olderThanPointer := flags.String("older-than", "14d", "Delete preview folders not deployed to for this long, e.g. 14d or 36h.")
+	mergeRequestPointer := flags.Bool("merge-request", false, "Delete the preview folders of the merge request in CI_MERGE_REQUEST_IID instead of expired ones.")
+	dryRunPointer := flags.Bool("dry-run", false, "Only list the preview folders that would be deleted.")
+	flags.Parse(args)
+
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	if err := LoadState(*statePointer); err != nil {
+		Fatal(err)
+	}
+
+	var remove func(preview PreviewFolder) bool
+
+	if *mergeRequestPointer {
+
+		branch, err := MergeRequestBranch()
+		if err != nil {
+			Fatal(err)
+		}
+		clean_branch := strings.Replace(branch, "/", "", -1)
+		if IsDefaultBranch(clean_branch) {
+			Fatal("Merge request source branch " + branch + " is the default branch, not cleaning it up")
+		}
+		Info("Cleaning up previews of branch: " + branch)
+
+		// The state cache can have been evicted, so the folder the branch would have deployed to is always included
+		if env, err := SelectGrafanaServer(branch, ""); err == nil {
+			if state.Previews == nil {
+				state.Previews = map[string]map[string]PreviewFolder{}
+			}
+			if state.Previews[env.Name] == nil {
+				state.Previews[env.Name] = map[string]PreviewFolder{}
+			}
+			folder_uid := FolderUID(clean_branch)
+			if _, ok := state.Previews[env.Name][folder_uid]; !ok {
+				state.Previews[env.Name][folder_uid] = PreviewFolder{Branch: branch}
+			}
+		}
+
+		remove = func(preview PreviewFolder) bool {
+			return preview.Branch == branch
+		}
+
+	} else {
+
+		max_age, err := ParseAge(*olderThanPointer)
+		if err != nil {
+			Fatal(err)
+		}
+		cutoff := time.Now().Add(-max_age)
+
+		remove = func(preview PreviewFolder) bool {
+			return preview.Deployed.Before(cutoff)
+		}
+	}
+
+	var names []string
+	for name := range state.Previews {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	removed := 0
+	for _, name := range names {
+
+		env, ok := config.Environments[name]
+		if !ok {
+			fmt.Println("WARNING: environment " + name + " is no longer configured, not cleaning up its previews")
+			continue
+		}
+
+		var expired []string
+		for folder_uid, preview := range state.Previews[name] {
+			if remove(preview) {
+				expired = append(expired, folder_uid)
+			}
+		}
+		sort.Strings(expired)
+		if len(expired) == 0 {
+			continue
+		}
+
+		environment = env
+		if err := ResolveCredentials(environment); err != nil {
+			Fatal(err)
+		}
+		grafana_servers, err := GrafanaURLs(environment)
+		if err != nil {
+			Fatal(err)
+		}
+
+		for _, folder_uid := range expired {
+
+			preview := state.Previews[name][folder_uid]
+			if preview.Deployed.IsZero() {
+				Info("Preview folder " + folder_uid + " in " + name + " for branch " + preview.Branch)
+			} else {
+				Info("Preview folder " + folder_uid + " in " + name + " for branch " + preview.Branch + " last deployed " + preview.Deployed.Format("2006-01-02"))
+			}
+			removed++
+			if *dryRunPointer {
+				continue
+			}
+
+			for _, grafana_server := range grafana_servers {
+				if err := DeletePreviewFolder(folder_uid, grafana_server); err != nil {
+					Fatalf("ERROR: %s", err)
+				}
+			}
+			delete(state.Previews[name], folder_uid)
+
+			// Saved after each folder so a failure part way doesn't forget what was already removed
+			if err := SaveState(*statePointer); err != nil {
+				Fatal(err)
+			}
+		}
+	}
+
+	if *dryRunPointer {
+		Infof("Would remove %d preview folder(s)\n", removed)
+	} else {
+		Infof("Removed %d preview folder(s)\n", removed)
+	}
+}
+
+// Helper method to find the source branch of the merge request the pipeline runs for
+func MergeRequestBranch() (string, error) {
+
+	CI_MERGE_REQUEST_IID := os.Getenv("CI_MERGE_REQUEST_IID")
+	if CI_MERGE_REQUEST_IID == "" {
+		return "", errors.New("CI_MERGE_REQUEST_IID env not set, merge request cleanup has to run in a merge request pipeline")
+	}
+
+	// Merge request pipelines normally have it already
+	if branch := os.Getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"); branch != "" {
+		return branch, nil
+	}
+
+	response, err := GitLabGET("/projects/" + os.Getenv("CI_PROJECT_ID") + "/merge_requests/" + CI_MERGE_REQUEST_IID)
+	if err != nil {
+		return "", err
+	}
+
+	var merge_request struct {
+		SourceBranch string `json:"source_branch"`
+	}
+	if err := json.Unmarshal(response, &merge_request); err != nil || merge_request.SourceBranch == "" {
+		return "", errors.New("Could not find the source branch of merge request " + CI_MERGE_REQUEST_IID)
+	}
+
+	return merge_request.SourceBranch, nil
+}
+
+func main() {
+
+	// Commands other than render and deploy are selected by the first argument, e.g. go run build.go fmt --check
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "fmt":
+			FormatCommand(os.Args[2:])
+		case "fmt-json":
+			FormatJSONCommand(os.Args[2:])
+		case "lint":
+			LintCommand(os.Args[2:])
+		case "validate":
+			ValidateCommand(os.Args[2:])
+		case "self-test":
+			SelfTestCommand(os.Args[2:])
+		case "cleanup":
+			CleanupCommand(os.Args[2:])
+		case "init":
+			InitCommand(os.Args[2:])
+		case "new":
+			NewCommand(os.Args[2:])
+		case "convert":
+			ConvertCommand(os.Args[2:])
+		case "diff":
+			DiffCommand(os.Args[2:])
+		case "changes":
+			ChangesCommand(os.Args[2:])
+		case "list":
+			ListCommand(os.Args[2:])
+		case "delete":
+			DeleteCommand(os.Args[2:])
+		case "export":
+			ExportCommand(os.Args[2:])
+		case "sync":
+			SyncCommand(os.Args[2:])
+		default:
+			Fatal("Unknown command: " + os.Args[1])
+		}
+		return
+	}
+
+	// Command Line Flags
+	// These are pointers, not the actual values. Access by using *varname.
+	quietPointer := flag.Bool("quiet", false, "Only print warnings, errors and the final summary.")
+	verbosePointer := flag.Bool("verbose", false, "Also print render details and grafana response bodies.")
+	debugPointer := flag.Bool("debug", false, "Also dump every grafana response in full.")
+	noColorPointer := flag.Bool("no-color", false, "Don't color dashboard results. Color is also off when NO_COLOR is set or stdout isn't a terminal.")
+	projectSectionsPointer := flag.Bool("project-sections", false, "Give each folder's deploy its own collapsible section in the gitlab job log.")
+	eventsPointer := flag.Int("events-fd", 0, "Write a json line per render and deploy event to this file descriptor, e.g. 3. 0 disables events.")
+	projectPointer := flag.String("project", "", "Set project name for long lived branches.")
+	branchPointer := flag.String("branch", "", "Branch to build as instead of CI_COMMIT_BRANCH, for running outside gitlab ci.")
+	serverURLPointer := flag.String("server-url", "", "Deploy to this grafana url instead of the environments servers, e.g. a local sandbox. Also read from GRAFANA_SERVER_URL.")
+	flag.StringVar(serverURLPointer, "server", "", "Alias for --server-url.")
+	envPointer := flag.String("env", "", "Deploy to this environment, as named in the config, instead of the one the branch or tag routes to. Also read from GRAFANA_ENV.")
+	tokenPointer := flag.String("token", "", "Grafana api token to use instead of the environments credential variables.")
+	deployPointer := flag.Bool("deploy", false, "Turn on flag to deploy rendered dashboards to grafana.")
+	healthCheckPointer := flag.Bool("health-check", true, "Check each grafana server is healthy and accepts the credentials before rendering.")
+	canaryPointer := flag.String("canary", "", "Deploy and verify dashboards matching this glob (e.g. dashboards/payments/**) before deploying the rest.")
+	deployRulesPointer := flag.Bool("deploy-rules", true, "Deploy rendered rule files to the environments ruler before deploying dashboards.")
+	prunePointer := flag.Bool("prune", false, "After deploying, delete dashboards in the target folder that the repo no longer produces.")
+	statePointer := flag.String("state", "grafana-state.json", "File recording which dashboards this pipeline has deployed to each environment.")
+	recordPointer := flag.String("record", "", "Record every grafana and gitlab request and response to this json file, without credentials.")
+	replayPointer := flag.String("replay", "", "Answer grafana and gitlab requests from a file made with --record instead of the network.")
+	overwritePointer := flag.String("overwrite", "force", "How to treat dashboards saved in grafana since the last deploy: force, fail-on-conflict or skip-if-newer.")
+	verifyPointer := flag.Bool("verify", true, "Read each dashboard back after deploying and fail if grafana stored different content.")
+	skipUnchangedPointer := flag.Bool("skip-unchanged", true, "Skip dashboards whose rendered content matches the live dashboard.")
+	continuePointer := flag.Bool("continue-on-error", false, "Attempt every dashboard and report failures at the end instead of stopping on the first.")
+	configPointer := flag.String("config", "grafana-pipeline.yaml", "Path to the pipeline config file.")
+	outPointer := flag.String("out", "dist", "Directory to render dashboards into. It is emptied before rendering.")
+	snapshotPointer := flag.Bool("snapshot", false, "Create grafana snapshots of rendered dashboards, posting them to the merge request when GITLAB_TOKEN is set.")
+	snapshotExpiresPointer := flag.Int("snapshot-expires", 7*24*60*60, "Seconds until created snapshots expire. 0 never expires.")
+	previewsPointer := flag.String("previews", "", "After deploying, render png previews of dashboards into this directory (for job artifacts).")
+	commitStatusPointer := flag.String("commit-status", "off", "Post a gitlab commit status per deployed dashboard or project: dashboard, project or off. Needs GITLAB_TOKEN.")
+	visualDiffPointer := flag.String("visual-diff", "", "After deploying a branch, save side by side renders of changed dashboards and their live versions into this directory.")
+	datasourceCheckPointer := flag.String("datasource-check", "warn", "What to do when a dashboard references a datasource missing on the target server: fail, warn or off.")
+	libraryPanelCheckPointer := flag.String("library-panel-check", "fail", "What to do when a dashboard references a library panel missing on the target server: fail, warn or off.")
+	confirmPointer := flag.String("confirm", "", "Name of the protected environment being deployed to, required for protected environments.")
+	sizeCheckPointer := flag.String("size-check", "warn", "What to do when a rendered dashboard exceeds --max-size or --max-panels: fail, warn or off.")
+	maxSizePointer := flag.Int("max-size", 1024, "Largest rendered dashboard, in KB, before --size-check applies. 0 disables the check.")
+	maxPanelsPointer := flag.Int("max-panels", 100, "Most panels a dashboard may have before --size-check applies. 0 disables the check.")
+	allPointer := flag.Bool("all", false, "Render and deploy every dashboard in the repo instead of only changed ones.")
+	requestTimeoutPointer := flag.Duration("request-timeout", 2*time.Minute, "Fail a grafana or gitlab request that takes longer than this. 0 waits forever.")
+	runTimeoutPointer := flag.Duration("run-timeout", 0, "Fail the run once it has taken this long, e.g. 50m to stay inside the job timeout. 0 disables it.")
+	summaryPointer := flag.String("summary", "deploy-summary.json", "File recording what the deploy did, written even when the job is cancelled.")
+	gitlabReleasePointer := flag.Bool("gitlab-release", true, "Create a gitlab release with the rendered dashboards once a release tag has deployed. Needs GITLAB_TOKEN.")
+	releaseArtifactPointer := flag.String("release-artifact", "release.json", "File recording what a release tag deployed, written by release tag pipelines.")
+
+	var only, exclude stringList
+	flag.Var(&only, "only", "Only render and deploy dashboards matching this glob (e.g. dashboards/payments/**). Repeatable.")
+	flag.Var(&exclude, "exclude", "Skip dashboards matching this glob. Repeatable.")
+
+	// Parse Command Line flags
+	flag.Parse()
+
+	color = UseColor(*noColorPointer)
+
+	if !contains([]string{"force", "fail-on-conflict", "skip-if-newer"}, *overwritePointer) {
+		Fatal("Unknown overwrite strategy: " + *overwritePointer)
+	}
+	if !contains([]string{"dashboard", "project", "off"}, *commitStatusPointer) {
+		Fatal("Unknown commit status mode: " + *commitStatusPointer)
+	}
+
+	switch {
+	case *debugPointer:
+		verbosity = LevelDebug
+	case *verbosePointer:
+		verbosity = LevelVerbose
+	case *quietPointer:
+		verbosity = LevelQuiet
+	}
+
+	// Wrapper tooling can follow progress through an extra file descriptor, e.g. go run build.go --events-fd 3 3>events.ndjson
+	if *eventsPointer > 0 {
+		events = json.NewEncoder(os.NewFile(uintptr(*eventsPointer), "events"))
+		log.SetOutput(eventLogWriter{})
+	}
+
+	Info("Pipeline build script started")
+	Emit(Event{Event: "run-start"})
+
+	http_client.Timeout = *requestTimeoutPointer
+	if *runTimeoutPointer > 0 {
+		StartRunDeadline(*runTimeoutPointer)
+	}
+	HandleInterrupts()
+
+	// Every request goes through the shared client, so swapping its transport captures or replays the whole run
+	if *recordPointer != "" && *replayPointer != "" {
+		Fatal("--record and --replay can't be used together")
+	}
+	if *recordPointer != "" || *replayPointer != "" {
+		cassette, err := NewCassette(*recordPointer+*replayPointer, *replayPointer != "")
+		if err != nil {
+			Fatal(err)
+		}
+		http_client.Transport = cassette
+	}
+
+	// Load pipeline config
+	loaded, err := LoadConfig(*configPointer)
+	if err != nil {
+		Fatal(err)
+	}
+	config = loaded
+
+	// Tag pipelines matching release_tags release every dashboard, rather than the ones the commit changed
+	tag := os.Getenv("CI_COMMIT_TAG")
+	release := IsReleaseTag(tag)
+	all := *allPointer || release
+
+	// Retrieve branch name from environment, unless running locally with --branch.
+	// Tag pipelines have no branch and deploy to the default branch folders.
+	branch := *branchPointer
+	if branch == "" {
+		var ok bool
+		branch, ok = os.LookupEnv("CI_COMMIT_BRANCH")
+		if !ok && tag != "" {
+			branch = DefaultBranch()
+		} else if !ok {
+			log.Print("ERROR: CI_COMMIT_BRANCH env not set, use --branch when running locally")
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Create folder to render Dashboards to. This folder is in .gitignore so it won't be commited.
+	// Separate render jobs can use their own folder via --out so they don't clobber each other.
+	out_dir := strings.TrimSuffix(*outPointer, "/")
+	Info("Creating " + out_dir + " Folder")
+	if err := CleanOutputDir(out_dir); err != nil {
+		Fatal(err)
+	}
+
+	// If we are doing a deployment, or creating snapshots which also need a grafana server
+	if *deployPointer || *snapshotPointer {
+
+		Info("Running grafana deploy")
+
+		if *deployPointer && *projectPointer == "" {
+			log.Print("ERROR: Project has not been specified. This should be set by pipeline.")
+			os.Exit(ExitConfig)
+		}
+
+		// Clean the branch name to remove slashes
+		clean_branch := strings.Replace(branch, "/", "", -1)
+		Info("Project: " + clean_branch)
+
+		// Identify the grafana server based on branch or tag, unless an operator picked one for a manual run,
+		// e.g. a hotfix deploy. Manual pipelines can't pass flags, so the variables set when running them count too.
+		env_name := *envPointer
+		if env_name == "" {
+			env_name = os.Getenv("GRAFANA_ENV")
+		}
+		if env_name != "" {
+			selected, ok := config.Environments[env_name]
+			if !ok {
+				Fatal("Unknown environment: " + env_name)
+			}
+			environment = selected
+			fmt.Println("WARNING: deploying to environment " + env_name + " as requested, ignoring the routes for " + branch)
+		} else {
+			environment, err = SelectGrafanaServer(branch, tag)
+			if err != nil {
+				Fatal(err)
+			}
+		}
+		if release {
+			Info("Releasing " + tag)
+		}
+
+		// A local sandbox or a new instance being tried out stands in for every server in the environment
+		server_url := *serverURLPointer
+		if server_url == "" {
+			server_url = os.Getenv("GRAFANA_SERVER_URL")
+		}
+		if server_url != "" {
+			fmt.Println("WARNING: deploying to " + server_url + " with the " + environment.Name + " credentials instead of the environments servers")
+			environment.URL = server_url
+			environment.URLs = nil
+		}
+
+		grafana_servers, err := GrafanaURLs(environment)
+		if err != nil {
+			Fatal(err)
+		}
+		Info("Environment: " + environment.Name + " (" + strings.Join(grafana_servers, ", ") + ")")
+
+		// Never touch a protected environment without explicit confirmation
+		if err := CheckConfirmation(environment, *confirmPointer); err != nil {
+			Fatal(err)
+		}
+
+		// Fail before rendering anything if the credentials for the environment aren't available.
+		// --token stands in for the environments own credentials, but its headers are still needed.
+		if *tokenPointer != "" {
+			if err := CheckHeaders(environment); err != nil {
+				Fatal(err)
+			}
+			environment.token, environment.user, environment.password = *tokenPointer, "", ""
+		} else if err := ResolveCredentials(environment); err != nil {
+			Fatal(err)
+		}
+
+		// Fail fast rather than rendering everything and dying on the first request
+		if *healthCheckPointer {
+			for _, grafana_server := range grafana_servers {
+				if err := CheckServer(grafana_server); err != nil {
+					Fatal(err)
+				}
+			}
+		}
+
+		// Load what previous runs deployed
+		if err := LoadState(*statePointer); err != nil {
+			Fatal(err)
+		}
+
+		// Identify any files that have changed
+		// When every dashboard is wanted, or dashboards are selected explicitly with --only, there is no need for a git diff
+		var changed []FileChange
+		if all || len(only) > 0 {
+			Info("Rendering all dashboards, ignoring git diff")
+			changed, err = ListDashboardSources()
+		} else {
+			changed, err = LoadChanges("git-diff.json")
+			if err == nil {
+				// Changing a shared library changes every dashboard built from it
+				changed, err = AddAffectedDashboards(changed)
+			}
+		}
+		if err != nil {
+			Fatal(err)
+		}
+		changed = FilterChanges(changed, only, exclude)
+
+		// Hooks are told where the run is going, the dashboards are filled in for each one
+		hook_context := HookContext{Branch: branch, Environment: environment.Name, Servers: grafana_servers, OutDir: out_dir}
+
+		EnterPhase("validate")
+		hook_context.Hook = "pre_render"
+		for _, change := range changed {
+			hook_context.Dashboards = append(hook_context.Dashboards, change.Path)
+		}
+		if err := RunHooks(config.Hooks.PreRender, hook_context); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		EnterPhase("render")
+		StartSection("render", "Rendering dashboards", false)
+
+		files_to_deploy := RenderChanged(changed, clean_branch, out_dir)
+
+		// Vendored mixins are rendered with the environments config rather than as individual sources
+		if RenderMixins(changed, clean_branch, out_dir, all) {
+			files_to_deploy = true
+		}
+
+		EndSection("render")
+
+		// Nothing has been deployed yet, so there is nothing to record
+		if Interrupted() {
+			os.Exit(InterruptedExitCode())
+		}
+
+		EnterPhase("validate")
+
+		// Patches for dashboards that no longer exist would otherwise be ignored without anyone noticing
+		problems, err := ValidateEnvironmentPatches(out_dir)
+		if err != nil {
+			Fatal(err)
+		}
+		if len(problems) > 0 {
+			Fatalf("ERROR: %s", strings.Join(problems, ", "))
+		}
+
+		hook_context.Hook = "post_render"
+		hook_context.Dashboards, err = RenderedDashboards(out_dir)
+		if err != nil {
+			Fatal(err)
+		}
+		if err := RunHooks(config.Hooks.PostRender, hook_context); err != nil {
+			Fatalf("ERROR: %s", err)
+		}
+
+		// Catch dashboards grafana or its proxy would reject, before anything is posted
+		var oversized []string
+		if files_to_deploy && *sizeCheckPointer != "off" {
+			oversized = ValidateDashboardLimits(out_dir, *maxSizePointer, *maxPanelsPointer)
+			for _, problem := range oversized {
+				fmt.Println("WARNING: " + problem)
+			}
+			if len(oversized) > 0 && *sizeCheckPointer == "fail" {
+				Fatalf("ERROR: %d dashboard(s) over the size limits", len(oversized))
+			}
+			MarkValidated(oversized)
+		}
+
+		// Snapshots let reviewers see the rendered result without a preview deploy
+		if *snapshotPointer && files_to_deploy {
+			EnterPhase("snapshot")
+
+			// Snapshots are shared links, one server is enough
+			snapshots := CreateSnapshots(out_dir, grafana_servers[0], *snapshotExpiresPointer)
+
+			// Merge request pipelines can post the links straight onto the merge request
+			if os.Getenv("CI_MERGE_REQUEST_IID") != "" && os.Getenv("GITLAB_TOKEN") != "" {
+				if err := PostSnapshotNote(snapshots); err != nil {
+					Fatal(err)
+				}
+			}
+		}
+
+		// Every server in the environment gets the same dashboards, failures are reported per server
+		server_failures := map[string][]DeployFailure{}
+		var attempted []string
+		succeeded := true
+
+		// If renderchanged returned true, then there are dashboards to deploy
+		if *deployPointer && files_to_deploy {
+
+			options := DeployOptions{
+				ContinueOnError:   *continuePointer,
+				SkipUnchanged:     *skipUnchangedPointer,
+				DatasourceCheck:   *datasourceCheckPointer,
+				LibraryPanelCheck: *libraryPanelCheckPointer,
+				Prune:             *prunePointer,
+				PreviewDir:        strings.TrimSuffix(*previewsPointer, "/"),
+				VisualDiffDir:     strings.TrimSuffix(*visualDiffPointer, "/"),
+				Canary:            *canaryPointer,
+				ProjectSections:   *projectSectionsPointer,
+				Verify:            *verifyPointer,
+				Overwrite:         *overwritePointer,
+			}
+			if release {
+				options.Message = "Release " + tag
+			}
+			EnterPhase("deploy")
+
+			// Rules go first so recording rules exist before the dashboards that query them
+			if *deployRulesPointer {
+				if err := DeployRules(out_dir, branch, clean_branch, *projectPointer); err != nil {
+					Fatalf("ERROR: %s", err)
+				}
+			}
+
+			for _, grafana_server := range grafana_servers {
+
+				if Interrupted() {
+					break
+				}
+				attempted = append(attempted, grafana_server)
+
+				StartSection("deploy "+grafana_server, "Deploying to server: "+grafana_server, false)
+				server_failures[grafana_server] = DeployToServer(grafana_server, out_dir, branch, clean_branch, *projectPointer, options)
+				EndSection("deploy " + grafana_server)
+			}
+
+			// A cancelled run records what it deployed before anything else, gitlab kills the job soon after.
+			// Nothing is posted anywhere, a slow gitlab or webhook would cost the record.
+			if Interrupted() {
+				if err := WriteRunSummary(*summaryPointer, attempted, server_failures); err != nil {
+					Fatal(err)
+				}
+				if err := SaveState(*statePointer); err != nil {
+					Fatal(err)
+				}
+				PrintRunSummary()
+				fmt.Println("Run interrupted, " + *summaryPointer + " lists what was deployed before it stopped")
+				os.Exit(InterruptedExitCode())
+			}
+
+			PrintRunSummary()
+			succeeded = ReportServerResults(attempted, server_failures, oversized)
+
+			if *commitStatusPointer != "off" {
+				PostCommitStatuses(*commitStatusPointer, server_failures)
+			}
+
+			if err := WriteRunSummary(*summaryPointer, attempted, server_failures); err != nil {
+				Fatal(err)
+			}
+		}
+
+		// Clean up dashboards that were deleted or are left behind under their old names.
+		// Nothing is cleaned up after a failed deploy, but what it did deploy is still recorded.
+		if *deployPointer {
+			if succeeded {
+				EnterPhase("cleanup")
+				RemoveStaleDashboards(changed, clean_branch, grafana_servers)
+			}
+
+			if err := SaveState(*statePointer); err != nil {
+				Fatal(err)
+			}
+			if succeeded {
+				if err := SaveUIDManifest(); err != nil {
+					Fatal(err)
+				}
+			}
+		}
+
+		// Every deploy run reports its outcome once the state is safe, a run with nothing to deploy as zero dashboards
+		if *deployPointer && !Interrupted() {
+			PostCompletionWebhook(branch, attempted, server_failures)
+		}
+
+		// Post deploy hooks run once the state is safe, and hear about failures too so notifications can report them
+		if *deployPointer && files_to_deploy && !Interrupted() {
+			hook_context.Hook = "post_deploy"
+			hook_context.Servers = attempted
+			hook_context.Deployed = deployed_dashboards
+			hook_context.Failed = SummaryFailures(attempted, server_failures)
+			if err := RunHooks(config.Hooks.PostDeploy, hook_context); err != nil {
+				if succeeded {
+					Fatalf("ERROR: %s", err)
+				}
+				log.Printf("ERROR: %s", err)
+			}
+		}
+
+		if !succeeded {
+			os.Exit(DeployExitCode())
+		}
+
+		// Releases are only recorded once the state is saved, so a failure here can't lose track of the deploy
+		if *deployPointer && files_to_deploy && release {
+			if err := WriteReleaseArtifact(*releaseArtifactPointer, tag, grafana_servers); err != nil {
+				Fatal(err)
+			}
+			Info("Wrote release artifact " + *releaseArtifactPointer)
+
+			if *gitlabReleasePointer && os.Getenv("GITLAB_TOKEN") == "" {
+				fmt.Println("WARNING: GITLAB_TOKEN not set, not creating a gitlab release for " + tag)
+			} else if *gitlabReleasePointer {
+				if err := CreateGitLabRelease(tag, out_dir); err != nil {
+					Fatalf("ERROR: creating the gitlab release for %s: %s", tag, err)
+				}
+				Info("Created gitlab release " + tag)
+			}
+		}
+	}
+
+	Emit(Event{Event: "run-done"})
 }
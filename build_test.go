@@ -0,0 +1,923 @@
+//go:build !gitdiff
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Helper method to run a test in an empty repository with the default config and no deployment state
+func testRepository(t *testing.T) {
+
+	t.Chdir(t.TempDir())
+
+	loaded, err := LoadConfig("grafana-pipeline.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = loaded
+	environment = &Environment{Name: "prod", token: "test"}
+
+	state = DeploymentState{Environments: map[string]map[string]DashboardState{}}
+	rendered_from = map[string]string{}
+	uid_manifest = map[string]string{}
+}
+
+// Helper method to write a file, creating its directory
+func writeTestFile(t *testing.T, file string, contents string) {
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper method to start a mock grafana holding the given folder, returning it and its url
+func testGrafana(t *testing.T, folder_uid string) (*MockGrafana, string) {
+
+	mock := NewMockGrafana()
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+
+	if err := CreateGrafanaFolder(folder_uid, folder_uid, "", server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	return mock, server.URL
+}
+
+// Helper method to save a dashboard straight to grafana, as someone editing it in the ui would
+func saveInGrafana(t *testing.T, grafana_server string, payload string) {
+
+	if _, err := DoPOST(grafana_server+"/api/dashboards/db", payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper method to list the uids of the dashboards left in a mock grafana, sorted
+func remainingUIDs(mock *MockGrafana) []string {
+
+	var remaining []string
+	for uid := range mock.dashboards {
+		remaining = append(remaining, uid)
+	}
+	sort.Strings(remaining)
+
+	return remaining
+}
+
+func TestDeployConflictsArePerServer(t *testing.T) {
+
+	testRepository(t)
+	_, server_a := testGrafana(t, "team")
+	_, server_b := testGrafana(t, "team")
+
+	dashboard := "dist/team/latency.json"
+	writeTestFile(t, dashboard, `{"uid": "latency", "title": "Latency"}`)
+	options := DeployOptions{Overwrite: "fail-on-conflict"}
+
+	for _, server := range []string{server_a, server_b} {
+		if err := DeployDashboard(dashboard, "team", server, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Someone edits the dashboard on b only
+	saveInGrafana(t, server_b, `{"dashboard": {"uid": "latency", "title": "Latency edited"}, "folderUid": "team", "overwrite": true}`)
+
+	// a hasn't changed since the pipeline deployed it, so the versions b saved mustn't make it look edited
+	if err := DeployDashboard(dashboard, "team", server_a, options); err != nil {
+		t.Fatalf("deploying to the unedited server: %v", err)
+	}
+
+	// b has, and a single version shared between servers would have been overwritten by a's deploy
+	err := DeployDashboard(dashboard, "team", server_b, options)
+	if err == nil || !strings.Contains(err.Error(), "changed in grafana") {
+		t.Fatalf("expected a conflict on the edited server, got %v", err)
+	}
+
+	versions := EnvironmentDeployments()["latency"].Versions
+	if versions[server_a] != 2 || versions[server_b] != 1 {
+		t.Errorf("expected versions a=2 b=1, got %v", versions)
+	}
+}
+
+func TestPruneFolderKeepsMixinAndStateDashboards(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+
+	branch := "main"
+	writeTestFile(t, "dashboards/team/latency.json", `{"title": "Latency"}`)
+	writeTestFile(t, "mixins/node/mixin.libsonnet", `{}`)
+
+	// A mixin dashboard rendered in this run, and one from a mixin that wasn't
+	out_dir := "dist"
+	writeTestFile(t, out_dir+"/node/node-cluster.json", `{"uid": "node-cluster", "title": "Node cluster"}`)
+	EnvironmentDeployments()["node-disk"] = DashboardState{Source: "mixins/node/mixin.libsonnet", Folder: "team"}
+	EnvironmentDeployments()["removed-mixin"] = DashboardState{Source: "mixins/removed/mixin.libsonnet", Folder: "team"}
+
+	for _, dashboard := range []struct{ UID, Title string }{
+		{SourceUID("dashboards/team/latency.json", branch), "Latency"},
+		{"node-cluster", "Node cluster"},
+		{"node-disk", "Node disk"},
+		{"removed-mixin", "Removed mixin"},
+		{"hand-made", "Hand made"},
+	} {
+		saveInGrafana(t, server, `{"dashboard": {"uid": "`+dashboard.UID+`", "title": "`+dashboard.Title+`"}, "folderUid": "team", "overwrite": true}`)
+	}
+
+	if err := PruneFolder("team", branch, out_dir, server); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	for uid := range mock.dashboards {
+		remaining = append(remaining, uid)
+	}
+	sort.Strings(remaining)
+
+	expected := []string{"node-cluster", "node-disk", SourceUID("dashboards/team/latency.json", branch)}
+	sort.Strings(expected)
+	if strings.Join(remaining, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be left, got %v", expected, remaining)
+	}
+}
+
+func TestValidateEnvironmentPatches(t *testing.T) {
+
+	testRepository(t)
+	config.Mixins = []Mixin{{Name: "node", Path: "mixins/node"}, {Name: "kafka", Path: "mixins/kafka"}}
+
+	writeTestFile(t, "dashboards/team/latency.json", `{"title": "Latency"}`)
+	writeTestFile(t, "dashboards/team/overview.json", `{"title": "Team overview"}`)
+	writeTestFile(t, "dashboards/other/overview.json", `{"title": "Other overview"}`)
+	writeTestFile(t, "dist/node/node-cluster.json", `{"title": "Node cluster"}`)
+
+	patch := `[{"op": "replace", "path": "/title", "value": "Patched"}]`
+	writeTestFile(t, "patches/prod/latency.patch.json", patch)
+	writeTestFile(t, "patches/prod/node-cluster.patch.json", patch)
+	writeTestFile(t, "patches/prod/team/overview.patch.json", patch)
+	writeTestFile(t, "patches/prod/kafka/kafka-lag.patch.json", patch)
+	writeTestFile(t, "patches/prod/team/renamed.patch.json", patch)
+	writeTestFile(t, "patches/prod/overview.patch.json", patch)
+
+	problems, err := ValidateEnvironmentPatches("dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kafka wasn't rendered in this run so its patch can't be checked, and the others match one dashboard
+	expected := []string{
+		"patches/prod/overview.patch.json matches overview in projects other, team, move it to patches/prod/<project>/overview.patch.json",
+		"patches/prod/team/renamed.patch.json doesn't match any dashboard",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected problems %q, got %q", expected, problems)
+	}
+
+	// With every mixin rendered a patch named only by dashboard can be checked too
+	config.Mixins = config.Mixins[:1]
+	os.RemoveAll("patches/prod/kafka")
+	writeTestFile(t, "patches/prod/gone.patch.json", patch)
+	problems, err = ValidateEnvironmentPatches("dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 || problems[0] != "patches/prod/gone.patch.json doesn't match any dashboard" {
+		t.Errorf("expected gone.patch.json to be reported, got %q", problems)
+	}
+}
+
+func TestApplyEnvironmentPatch(t *testing.T) {
+
+	testRepository(t)
+	writeTestFile(t, "patches/prod/latency.patch.json", `[{"op": "replace", "path": "/title", "value": "Patched latency"}]`)
+	writeTestFile(t, "patches/prod/team/overview.patch.json", `[{"op": "replace", "path": "/title", "value": "Team overview"}]`)
+
+	for out_path, title := range map[string]string{
+		"dist/team/latency.json":   "Patched latency",
+		"dist/team/overview.json":  "Team overview",
+		"dist/other/overview.json": "Overview",
+	} {
+
+		patched, err := ApplyEnvironmentPatch(map[string]interface{}{"title": "Overview"}, out_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patched["title"] != title {
+			t.Errorf("expected %s to be titled %q, got %q", out_path, title, patched["title"])
+		}
+	}
+}
+
+// A credentials case, resolved for the prod environment
+type credentialTest struct {
+	name        string
+	credentials Credentials
+	token       string
+	user        string
+	err         string
+}
+
+// Helper method to resolve each case's credentials, checking the credentials or the error it gives
+func runCredentialTests(t *testing.T, tests []credentialTest) {
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			env := &Environment{Name: "prod", Credentials: test.credentials}
+			err := ResolveCredentials(env)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.token != test.token || env.user != test.user {
+				t.Errorf("expected token %q user %q, got token %q user %q", test.token, test.user, env.token, env.user)
+			}
+		})
+	}
+}
+
+func TestRunCredentialHelper(t *testing.T) {
+
+	testRepository(t)
+	writeTestFile(t, "bin/creds", "#!/bin/sh\necho '{\"user\": \"helper-'$2'\", \"password\": \"secret\"}'\n")
+	writeTestFile(t, "bin/broken", "#!/bin/sh\necho not json\n")
+	os.Chmod("bin/creds", 0755)
+	os.Chmod("bin/broken", 0755)
+
+	runCredentialTests(t, []credentialTest{
+		{name: "helper", credentials: Credentials{Helper: "./bin/creds"}, user: "helper-prod"},
+		{name: "blank helper", credentials: Credentials{Helper: "  "}, err: "Credential helper for environment prod is blank"},
+		{name: "missing helper", credentials: Credentials{Helper: "./bin/missing"}, err: "Credential helper for environment prod failed"},
+		{name: "not json", credentials: Credentials{Helper: "./bin/broken"}, err: "didn't print credentials as json"},
+	})
+}
+
+func TestReadCredentialFiles(t *testing.T) {
+
+	testRepository(t)
+	writeTestFile(t, "secrets/token", "file-token\n")
+	writeTestFile(t, "secrets/user", "admin\n")
+
+	runCredentialTests(t, []credentialTest{
+		{name: "token file", credentials: Credentials{TokenFile: "secrets/token"}, token: "file-token"},
+		{name: "missing file", credentials: Credentials{TokenFile: "secrets/missing"}, err: "no such file"},
+		{name: "user without password", credentials: Credentials{UserFile: "secrets/user"}, err: "must declare token_file, or both user_file and password_file"},
+	})
+}
+
+func TestCloudSecretsAreExclusive(t *testing.T) {
+
+	testRepository(t)
+
+	runCredentialTests(t, []credentialTest{
+		{name: "both clouds", credentials: Credentials{AWSSecret: "a", GCPSecret: "b"}, err: "only one of aws_secret and gcp_secret"},
+	})
+}
+
+func TestReadCloudSecretReplay(t *testing.T) {
+
+	fixture, err := filepath.Abs("testdata/cloud-secrets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRepository(t)
+
+	cassette, err := NewCassette(fixture, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := http_client.Transport
+	http_client.Transport = cassette
+	t.Cleanup(func() { http_client.Transport = transport })
+
+	// Keep the sdks away from the machine's own cloud credentials
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "missing")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "missing")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("GCP_SERVICE_ACCOUNT", "")
+	t.Setenv("GITLAB_OIDC_TOKEN", "gitlab-id-token")
+	t.Setenv("CI_JOB_ID", "42")
+
+	aws_secret := "arn:aws:secretsmanager:eu-west-1:123456789012:secret:grafana-prod"
+
+	// The jobs own aws credentials, then a role assumed with its gitlab id token
+	env := &Environment{Name: "prod", Credentials: Credentials{AWSSecret: aws_secret}}
+	if err := ResolveCredentials(env); err != nil {
+		t.Fatal(err)
+	}
+	if env.token != "aws-token" {
+		t.Errorf("expected the token from the aws secret's json, got %q", env.token)
+	}
+
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/grafana")
+	env = &Environment{Name: "prod", Credentials: Credentials{AWSSecret: aws_secret}}
+	if err := ResolveCredentials(env); err != nil {
+		t.Fatal(err)
+	}
+	if env.token != "aws-role-token" {
+		t.Errorf("expected the plain aws secret as the token, got %q", env.token)
+	}
+
+	// Gcp workload identity federation exchanges the id token before reading the secret
+	t.Setenv("GCP_WORKLOAD_IDENTITY_PROVIDER", "projects/1/locations/global/workloadIdentityPools/gitlab/providers/gitlab")
+	env = &Environment{Name: "prod", Credentials: Credentials{GCPSecret: "projects/ops/secrets/grafana-prod"}}
+	if err := ResolveCredentials(env); err != nil {
+		t.Fatal(err)
+	}
+	if env.user != "admin" || env.password != "gcp-password" {
+		t.Errorf("expected the user and password from the gcp secret, got %q %q", env.user, env.password)
+	}
+
+	for i, used := range cassette.used {
+		if !used {
+			t.Errorf("recorded %s %s was never requested", cassette.interactions[i].Method, cassette.interactions[i].Path)
+		}
+	}
+}
+
+func TestCleanOutputDir(t *testing.T) {
+
+	testRepository(t)
+	config.Sources = []string{"dashboards", "teams/*/grafana"}
+	config.Mixins = []Mixin{{Name: "node", Path: "mixins/node"}}
+	writeTestFile(t, "dashboards/payments/latency.json", `{"title": "Latency"}`)
+
+	tests := []struct {
+		out_dir string
+		refused bool
+	}{
+		{"dist", false},
+		{"build/dist", false},
+		{"dashboards-dist", false},
+		{".", true},
+		{"..", true},
+		{"dashboards", true},
+		{"dashboards/payments", true},
+		{"dashboards/payments/dist", true},
+		{"teams", true},
+		{"teams/payments/grafana/dist", true},
+		{"teams/payments/docs", false},
+		{"patches/prod", true},
+		{"templates", true},
+		{"playlists", true},
+		{"policies", true},
+		{"vendor/github.com", true},
+		{"mixins", true},
+		{"mixins/node/dist", true},
+	}
+
+	for _, test := range tests {
+		err := CleanOutputDir(test.out_dir)
+		if test.refused && err == nil {
+			t.Errorf("expected --out %s to be refused", test.out_dir)
+		}
+		if !test.refused && err != nil {
+			t.Errorf("expected --out %s to be cleaned, got %v", test.out_dir, err)
+		}
+	}
+
+	if _, err := os.Stat("dashboards/payments/latency.json"); err != nil {
+		t.Errorf("a refused clean deleted dashboard sources: %v", err)
+	}
+}
+
+func TestShortenUID(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		uid       string
+		unchanged bool
+	}{
+		{"38 characters", strings.Repeat("a", 38), true},
+		{"39 characters", strings.Repeat("a", 39), true},
+		{"40 characters", strings.Repeat("a", 40), false},
+		{"41 characters", strings.Repeat("a", 41), false},
+		{"multibyte", strings.Repeat("ü", 25), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			shortened := ShortenUID(test.uid)
+			if test.unchanged && shortened != test.uid {
+				t.Fatalf("expected %s to be left alone, got %s", test.uid, shortened)
+			}
+			if test.unchanged {
+				return
+			}
+
+			if shortened == test.uid || len(shortened) > MaxUIDLength {
+				t.Fatalf("expected %s to be shortened to %d bytes, got %s", test.uid, MaxUIDLength, shortened)
+			}
+			if !utf8.ValidString(shortened) {
+				t.Errorf("expected a valid utf-8 uid, got %q", shortened)
+			}
+
+			// A different uid sharing the same readable prefix must not collide
+			if ShortenUID(test.uid+"b") == shortened {
+				t.Errorf("expected %s and %sb to shorten differently", test.uid, test.uid)
+			}
+		})
+	}
+}
+
+func TestFolderUIDIsShortenedLikeDashboards(t *testing.T) {
+
+	testRepository(t)
+
+	branch := "feature-" + strings.Repeat("x", 40)
+	if folder_uid := FolderUID(branch); folder_uid != ShortenUID(branch) {
+		t.Errorf("expected the branch folder uid %s, got %s", ShortenUID(branch), folder_uid)
+	}
+	if folder_uid := FolderUID("feature-x"); folder_uid != "feature-x" {
+		t.Errorf("expected a short branch name to be used as is, got %s", folder_uid)
+	}
+}
+
+func TestCompletionWebhookWithNothingDeployed(t *testing.T) {
+
+	testRepository(t)
+	deployed_dashboards = nil
+
+	var posted CompletionPayload
+	var raw []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		raw, _ = ioutil.ReadAll(request.Body)
+		json.Unmarshal(raw, &posted)
+	}))
+	defer server.Close()
+	config.CompletionWebhook = &CompletionWebhook{URL: server.URL}
+
+	PostCompletionWebhook("main", nil, map[string][]DeployFailure{})
+
+	if posted.Status != "success" || posted.Environment != "prod" {
+		t.Errorf("expected a successful prod deploy, got %+v", posted)
+	}
+	for _, field := range []string{`"servers":[]`, `"deployed":[]`, `"failed":[]`} {
+		if !strings.Contains(string(raw), field) {
+			t.Errorf("expected %s in %s", field, raw)
+		}
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+
+	t.Setenv("CF_ACCESS_CLIENT_ID", "client")
+	t.Setenv("CF_ACCESS_CLIENT_SECRET", "")
+	t.Setenv("GRAFANA_TOKEN_PROD", "env-token")
+
+	env := &Environment{Name: "prod", Headers: map[string]string{"CF-Access-Client-Id": "${CF_ACCESS_CLIENT_ID}"}}
+	if err := CheckHeaders(env); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing header variable fails the credentials whether they come from the environment or --token
+	env.Headers["CF-Access-Client-Secret"] = "${CF_ACCESS_CLIENT_SECRET}"
+	for _, err := range []error{CheckHeaders(env), ResolveCredentials(env)} {
+		if err == nil || !strings.Contains(err.Error(), "Missing header CF-Access-Client-Secret for environment prod, variables not set: CF_ACCESS_CLIENT_SECRET") {
+			t.Errorf("expected the missing header variable to be named, got %v", err)
+		}
+	}
+}
+
+func TestMockGrafanaDeletesFolders(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+	saveInGrafana(t, server, `{"dashboard": {"uid": "latency", "title": "Latency"}, "folderUid": "team", "overwrite": true}`)
+
+	if _, err := DoRequest("DELETE", server+"/api/folders/team", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.folders) != 0 || len(mock.dashboards) != 0 {
+		t.Errorf("expected the folder and its dashboard to be deleted, left %v and %v", mock.folders, mock.dashboards)
+	}
+	if _, err := DoRequest("DELETE", server+"/api/folders/team", ""); !IsGrafanaStatus(err, http.StatusNotFound) {
+		t.Errorf("expected deleting it again to be a 404, got %v", err)
+	}
+}
+
+func TestDeleteUIDOnlyInFolder(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+	saveInGrafana(t, server, `{"dashboard": {"uid": "latency", "title": "Latency"}, "folderUid": "team", "overwrite": true}`)
+	saveInGrafana(t, server, `{"dashboard": {"uid": "errors", "title": "Errors"}, "folderUid": "team", "overwrite": true}`)
+
+	writeTestFile(t, "grafana-pipeline.yaml", "environments:\n  prod:\n    url: "+server+"\n")
+	t.Setenv("GRAFANA_TOKEN_PROD", "env-token")
+
+	// --folder only scopes --uid, it mustn't delete the folder and the rest of its dashboards too
+	DeleteCommand([]string{"--env", "prod", "--folder", "team", "--uid", "latency", "--yes"})
+
+	if _, ok := mock.folders["team"]; !ok {
+		t.Error("expected the folder to be kept")
+	}
+	if _, ok := mock.dashboards["latency"]; ok {
+		t.Error("expected the dashboard to be deleted")
+	}
+	if _, ok := mock.dashboards["errors"]; !ok {
+		t.Error("expected the other dashboard in the folder to be kept")
+	}
+}
+
+func TestRemoveStaleDashboards(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+
+	branch := "main"
+	changes := []FileChange{
+		{Path: "dashboards/team/latency-by-route.json", Status: "R", OldPath: "dashboards/team/latency.json"},
+		{Path: "dashboards/other/errors.json", Status: "R", OldPath: "dashboards/team/errors.json"},
+		{Path: "dashboards/team/removed.json", Status: "D"},
+	}
+
+	for _, source := range []string{"dashboards/team/latency.json", "dashboards/team/latency-by-route.json", "dashboards/team/errors.json", "dashboards/team/removed.json"} {
+		saveInGrafana(t, server, `{"dashboard": {"uid": "`+SourceUID(source, branch)+`", "title": "`+source+`"}, "folderUid": "team", "overwrite": true}`)
+	}
+
+	RemoveStaleDashboards(changes, branch, []string{server})
+
+	// The renamed dashboard's old uid goes, while the one moved between projects keeps its uid and its dashboard
+	expected := []string{SourceUID("dashboards/team/latency-by-route.json", branch), SourceUID("dashboards/other/errors.json", branch)}
+	sort.Strings(expected)
+	if remaining := remainingUIDs(mock); strings.Join(remaining, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be left, got %v", expected, remaining)
+	}
+}
+
+func TestDeploySkipsUnchangedDashboards(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+	if err := CreateGrafanaFolder("other", "other", "", server); err != nil {
+		t.Fatal(err)
+	}
+
+	dashboard := "dist/team/latency.json"
+	options := DeployOptions{Overwrite: "force", SkipUnchanged: true}
+
+	tests := []struct {
+		name     string
+		contents string
+		folder   string
+		saves    int
+	}{
+		{name: "new", contents: `{"uid": "latency", "title": "Latency"}`, folder: "team", saves: 1},
+		{name: "reformatted", contents: "{\n  \"title\": \"Latency\",\n  \"uid\": \"latency\"\n}", folder: "team", saves: 1},
+		{name: "changed", contents: `{"uid": "latency", "title": "Latency by route"}`, folder: "team", saves: 2},
+		{name: "moved", contents: `{"uid": "latency", "title": "Latency by route"}`, folder: "other", saves: 3},
+	}
+
+	// Each step deploys over the last, only saving when the content or the folder changed
+	for _, test := range tests {
+		writeTestFile(t, dashboard, test.contents)
+		if err := DeployDashboard(dashboard, test.folder, server, options); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if mock.Saves() != test.saves {
+			t.Errorf("%s: expected %d saves, got %d", test.name, test.saves, mock.Saves())
+		}
+	}
+}
+
+func TestDiffDashboards(t *testing.T) {
+
+	var old_dashboard, new_dashboard map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"title": "Service",
+		"templating": {"list": [{"name": "cluster", "query": "label_values(cluster)"}]},
+		"panels": [
+			{"id": 1, "title": "CPU: usage", "type": "timeseries", "targets": [{"refId": "A", "expr": "rate(cpu[1m])"}]},
+			{"id": 2, "title": "Memory", "type": "timeseries"}
+		]
+	}`), &old_dashboard)
+	json.Unmarshal([]byte(`{
+		"title": "Service",
+		"templating": {"list": [{"name": "cluster", "query": "label_values(up, cluster)"}]},
+		"panels": [
+			{"id": 1, "title": "CPU: usage", "type": "timeseries", "targets": [{"refId": "A", "expr": "rate(cpu[5m])"}]},
+			{"id": 3, "title": "Disk", "type": "gauge"}
+		]
+	}`), &new_dashboard)
+
+	expected := []DashboardChange{
+		{ChangeModified, "", "variable", "~ variable cluster query: `label_values(cluster)` -> `label_values(up, cluster)`"},
+		{ChangeModified, `"CPU: usage" (timeseries)`, "query", "~ panel \"CPU: usage\" (timeseries): query A: `rate(cpu[1m])` -> `rate(cpu[5m])`"},
+		{ChangeAdded, `"Disk" (gauge)`, "panel", `+ panel "Disk" (gauge)`},
+		{ChangeRemoved, `"Memory" (timeseries)`, "panel", `- panel "Memory" (timeseries)`},
+	}
+
+	changes := DiffDashboards(old_dashboard, new_dashboard)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("expected change %d to be %+v, got %+v", i, expected[i], changes[i])
+		}
+	}
+
+	if changes := DiffDashboards(old_dashboard, old_dashboard); len(changes) != 0 {
+		t.Errorf("expected no changes between identical dashboards, got %v", changes)
+	}
+}
+
+func TestSummarizeChanges(t *testing.T) {
+
+	// Panel names with a colon in them are counted once, with all their query changes
+	cpu := `"CPU: usage" (timeseries)`
+	changes := []DashboardChange{
+		{ChangeModified, "", "title", "~ title: `Service` -> `Service overview`"},
+		{ChangeModified, "", "variable", "~ variable cluster settings changed"},
+		{ChangeModified, cpu, "query", "~ panel " + cpu + ": query A: `rate(cpu[1m])` -> `rate(cpu[5m])`"},
+		{ChangeModified, cpu, "query", "~ panel " + cpu + ": query B removed: `up`"},
+		{ChangeModified, cpu, "layout", "~ panel " + cpu + ": moved or resized"},
+		{ChangeModified, `"Memory" (timeseries)`, "thresholds", "~ panel \"Memory\" (timeseries): thresholds `[]` -> `[{}]`"},
+		{ChangeAdded, `"Disk" (gauge)`, "panel", `+ panel "Disk" (gauge)`},
+		{ChangeRemoved, `"Network" (timeseries)`, "panel", `- panel "Network" (timeseries)`},
+	}
+
+	expected := "1 panel(s) added, 1 panel(s) removed, 2 panel(s) changed, 2 query(s) changed, 1 variable(s) changed, dashboard settings changed"
+	if summary := SummarizeChanges(changes); summary != expected {
+		t.Errorf("expected %q, got %q", expected, summary)
+	}
+	if summary := SummarizeChanges(nil); summary != "" {
+		t.Errorf("expected no summary without changes, got %q", summary)
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+
+	testRepository(t)
+	_, server := testGrafana(t, "team")
+
+	writeTestFile(t, "dist/team/same.json", `{"uid": "same", "title": "Same"}`)
+	writeTestFile(t, "dist/team/edited.json", `{"uid": "edited", "title": "Edited"}`)
+	writeTestFile(t, "dist/team/new.json", `{"uid": "new", "title": "New"}`)
+
+	saveInGrafana(t, server, `{"dashboard": {"uid": "same", "title": "Same"}, "folderUid": "team", "overwrite": true}`)
+	saveInGrafana(t, server, `{"dashboard": {"uid": "edited", "title": "Edited in grafana"}, "folderUid": "team", "overwrite": true}`)
+	saveInGrafana(t, server, `{"dashboard": {"uid": "extra", "title": "Extra"}, "folderUid": "team", "overwrite": true}`)
+
+	plan, err := PlanSync([]DeployTarget{{FolderUID: "team", FolderTitle: "Team", Path: "dist/team"}}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unchanged dashboard needs nothing, and the one only in grafana is deleted
+	expected := []SyncAction{
+		{Action: "update", UID: "edited", Title: "Edited", FolderUID: "team"},
+		{Action: "create", UID: "new", Title: "New", FolderUID: "team"},
+		{Action: "delete", UID: "extra", Title: "Extra", FolderUID: "team"},
+	}
+	if len(plan) != len(expected) {
+		t.Fatalf("expected the plan %+v, got %+v", expected, plan)
+	}
+	for i := range expected {
+		if plan[i] != expected[i] {
+			t.Errorf("expected step %d to be %+v, got %+v", i, expected[i], plan[i])
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+
+	tests := []struct {
+		age      string
+		duration time.Duration
+		err      bool
+	}{
+		{age: "14d", duration: 14 * 24 * time.Hour},
+		{age: "0d", duration: 0},
+		{age: "36h", duration: 36 * time.Hour},
+		{age: "90m", duration: 90 * time.Minute},
+		{age: "d", err: true},
+		{age: "-1d", err: true},
+		{age: "-5m", err: true},
+		{age: "2w", err: true},
+	}
+
+	for _, test := range tests {
+		duration, err := ParseAge(test.age)
+		if (err != nil) != test.err || duration != test.duration {
+			t.Errorf("ParseAge(%q): expected %v (error %v), got %v (%v)", test.age, test.duration, test.err, duration, err)
+		}
+	}
+}
+
+func TestCleanupExpiredPreviews(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "expired")
+	if err := CreateGrafanaFolder("recent", "recent", "", server); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, "grafana-pipeline.yaml", "environments:\n  prod:\n    url: "+server+"\n")
+	t.Setenv("GRAFANA_TOKEN_PROD", "env-token")
+
+	state.Previews = map[string]map[string]PreviewFolder{"prod": {
+		"expired": {Branch: "feature/old", Deployed: time.Now().Add(-20 * 24 * time.Hour)},
+		"recent":  {Branch: "feature/new", Deployed: time.Now().Add(-24 * time.Hour)},
+	}}
+	if err := SaveState("grafana-state.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	CleanupCommand([]string{"--older-than", "14d"})
+
+	// Only the preview that wasn't deployed to within the age is deleted, and forgotten
+	if _, ok := mock.folders["expired"]; ok {
+		t.Error("expected the expired preview folder to be deleted")
+	}
+	if _, ok := mock.folders["recent"]; !ok {
+		t.Error("expected the recently deployed preview folder to be kept")
+	}
+	if _, ok := state.Previews["prod"]["expired"]; ok || len(state.Previews["prod"]) != 1 {
+		t.Errorf("expected only the recent preview to be left in the state, got %v", state.Previews["prod"])
+	}
+}
+
+func TestCleanupMergeRequestPreviews(t *testing.T) {
+
+	testRepository(t)
+	preview := FolderUID("featurex")
+	mock, server := testGrafana(t, preview)
+	if err := CreateGrafanaFolder("other", "other", "", server); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, "grafana-pipeline.yaml", "environments:\n  dev:\n    url: "+server+"\nroutes:\n  - environment: dev\n")
+	t.Setenv("GRAFANA_TOKEN_DEV", "env-token")
+	t.Setenv("CI_MERGE_REQUEST_IID", "7")
+	t.Setenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME", "feature/x")
+
+	// The merge request's own preview has fallen out of the state, another branch's is still recorded
+	state.Previews = map[string]map[string]PreviewFolder{"dev": {"other": {Branch: "feature/other", Deployed: time.Now().Add(-30 * 24 * time.Hour)}}}
+
+	CleanupCommand([]string{"--merge-request"})
+
+	if _, ok := mock.folders[preview]; ok {
+		t.Error("expected the merge request's preview folder to be deleted")
+	}
+	if _, ok := mock.folders["other"]; !ok {
+		t.Error("expected other branches' preview folders to be kept, however old")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+
+	values := map[string]string{"service": "checkout", "team": "payments"}
+
+	// Grafana's own ${variables} are left for grafana, and spacing inside the braces doesn't matter
+	expanded, err := ExpandTemplate(`{"title": "{{service}} overview", "tags": ["{{ team }}"], "expr": "up{job=\"{{service}}\", cluster=\"${cluster}\"}"}`, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"title": "checkout overview", "tags": ["payments"], "expr": "up{job=\"checkout\", cluster=\"${cluster}\"}"}`
+	if expanded != expected {
+		t.Errorf("expected %s, got %s", expected, expanded)
+	}
+
+	// Every parameter without a value is named once
+	_, err = ExpandTemplate(`{{service}} {{owner}} {{region}} {{owner}}`, values)
+	if err == nil || !strings.Contains(err.Error(), "No value for template parameters: owner, region,") {
+		t.Errorf("expected the parameters without values to be named, got %v", err)
+	}
+}
+
+func TestHardcodedDatasourcesFix(t *testing.T) {
+
+	testRepository(t)
+
+	var parsed_dashboard map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"panels": [
+			{"datasource": {"type": "loki", "uid": "P8E80F9AEF21F6940"}, "targets": [{"datasource": "Loki"}]},
+			{"datasource": {"type": "loki", "uid": "${datasource}"}},
+			{"datasource": "-- Mixed --", "targets": [{"datasource": {"uid": "grafana"}}]}
+		]
+	}`), &parsed_dashboard)
+
+	// Only literal references are reported, not variables or grafana's built in datasources
+	references := HardcodedDatasources(parsed_dashboard, true)
+	expected := []string{"/panels/0/datasource/uid", "/panels/0/targets/0/datasource"}
+	if strings.Join(references, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, references)
+	}
+
+	// They now point at a datasource variable of the type they used, which is added for them
+	fixed, _ := json.Marshal(parsed_dashboard)
+	for _, part := range []string{
+		`{"datasource":{"type":"loki","uid":"${datasource}"},"targets":[{"datasource":"${datasource}"}]}`,
+		`"templating":{"list":[{"label":"Data source","name":"datasource","query":"loki","type":"datasource"}]}`,
+	} {
+		if !strings.Contains(string(fixed), part) {
+			t.Errorf("expected the fixed dashboard to contain %s, got %s", part, fixed)
+		}
+	}
+	if references := HardcodedDatasources(parsed_dashboard, false); len(references) != 0 {
+		t.Errorf("expected nothing left to fix, got %v", references)
+	}
+}
+
+func TestEvaluateRego(t *testing.T) {
+
+	testRepository(t)
+	writeTestFile(t, "policies/panels.rego", `package grafana
+
+deny contains msg if {
+	some panel in input.panels
+	not panel.description
+	msg := sprintf("panel %q has no description", [panel.title])
+}
+
+warn contains msg if {
+	input.refresh == "5s"
+	msg := "refreshing every 5s puts a lot of load on the datasources"
+}
+`)
+
+	query, err := PrepareRego("policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed_dashboard map[string]interface{}
+	json.Unmarshal([]byte(`{"refresh": "5s", "panels": [{"title": "Latency", "description": "p99"}, {"title": "Errors"}]}`), &parsed_dashboard)
+
+	messages, err := EvaluateRego(query, parsed_dashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deny rules are errors and warn rules warnings
+	if strings.Join(messages["error"], ",") != `panel "Errors" has no description` {
+		t.Errorf("expected the panel without a description to be denied, got %v", messages["error"])
+	}
+	if len(messages["warn"]) != 1 {
+		t.Errorf("expected the refresh warning, got %v", messages["warn"])
+	}
+
+	// Without any policies there is nothing to evaluate
+	if query, err := PrepareRego("missing"); query != nil || err != nil {
+		t.Errorf("expected no query without policies, got %v %v", query, err)
+	}
+}
+
+func TestSearchDashboardsPages(t *testing.T) {
+
+	testRepository(t)
+	mock, server := testGrafana(t, "team")
+
+	// Exactly full pages need one more, empty, request to find the end
+	for _, count := range []int{PageSize - 1, 2 * PageSize, 2*PageSize + 1} {
+
+		mock.dashboards = map[string]MockDashboard{}
+		for i := 0; i < count; i++ {
+			uid := fmt.Sprintf("dashboard-%05d", i)
+			mock.dashboards[uid] = MockDashboard{Model: map[string]interface{}{"uid": uid, "title": uid}, FolderUID: "team"}
+		}
+
+		results, err := SearchDashboards(server, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := map[string]bool{}
+		for _, result := range results {
+			seen[result.UID] = true
+		}
+		if len(results) != count || len(seen) != count {
+			t.Errorf("expected all %d dashboards once, got %d results for %d dashboards", count, len(results), len(seen))
+		}
+	}
+}
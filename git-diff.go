@@ -1,64 +1,506 @@
+//go:build gitdiff
+
 // Go script for calculating the build diff between branches.
 // This script expects to run within a gitlab ci pod.
+// Git operations use go-git so no git binary is required in the runner image.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
 )
 
-// Helper function to fetch an upstream target branch
-func FetchBranch(target_branch string) {
+// A changed file and how it changed. Status is one of A (added), M (modified), D (deleted) or R (renamed).
+// OldPath is only set for renames.
+type FileChange struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldPath string `json:"old_path,omitempty"`
+}
+
+// The document written to git-diff.json for build.go to consume
+type DiffDocument struct {
+	Changes []FileChange `json:"changes"`
+}
+
+// Helper function to open the repository the pipeline is running in
+func OpenRepository() (*git.Repository, error) {
+
+	repo, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("opening repository: %w", err)
+	}
+
+	return repo, nil
+}
+
+// Helper function to fetch an upstream target branch, to the given depth unless it is zero
+func FetchBranch(repo *git.Repository, target_branch string, depth int) error {
 
 	fmt.Println("Fetching: " + target_branch)
 
-	cmd := exec.Command("git", "fetch", "origin", target_branch)
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
+	refspec := config.RefSpec("+refs/heads/" + target_branch + ":refs/remotes/origin/" + target_branch)
+	err := repo.Fetch(&git.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{refspec}, Depth: depth})
+
+	// Nothing new on the remote is not a failure
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetching origin/%s: %w", target_branch, err)
+	}
+
+	return nil
+}
+
+// Depths a shallow clone is deepened to in turn when the commit to diff against isn't in it
+var deepen_depths = []int{50, 200, 1000, 10000}
+
+// Helper function to make sure a revision is in the clone, deepening the branch history until it is.
+// GitLab clones shallowly by default, so the commit to diff against is often missing.
+func EnsureRevision(repo *git.Repository, branch string, revision string) error {
+
+	for attempt := 0; ; attempt++ {
+
+		hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+		if err == nil {
+			_, err = repo.CommitObject(*hash)
+		}
+		if err == nil {
+			return nil
+		}
+
+		// Anything but a missing object is a real problem that more history won't fix
+		if !errors.Is(err, plumbing.ErrObjectNotFound) && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return fmt.Errorf("resolving %s: %w", revision, err)
+		}
+		if attempt == len(deepen_depths) {
+			return fmt.Errorf("%s is not in the last %d commits of %s, is it on this branch?", revision, deepen_depths[attempt-1], branch)
+		}
+
+		depth := deepen_depths[attempt]
+		fmt.Printf("%s not found, deepening the clone to %d commits\n", revision, depth)
+
+		refspec := config.RefSpec("+refs/heads/" + branch + ":refs/remotes/origin/" + branch)
+		err = repo.Fetch(&git.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{refspec}, Depth: depth})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return fmt.Errorf("deepening origin/%s: %w", branch, err)
+		}
+	}
+}
+
+// Helper function to resolve a revision (branch, remote ref or sha) to its tree
+func ResolveTree(repo *git.Repository, revision string) (*object.Tree, error) {
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", revision, err)
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("loading commit %s: %w", hash, err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("loading tree for %s: %w", hash, err)
+	}
+
+	return tree, nil
+}
+
+// Helper function to find the commit a branch forked from the default branch at, fetching both first
+func MergeBase(repo *git.Repository, branch string, default_branch string) (string, error) {
+
+	// Fetched without a depth into a shallow clone, the default branch arrives as just its tip and go-git never
+	// deepens it afterwards, so a shallow clone is fetched to the first depth straight away
+	first_attempt := 0
+	depth := 0
+	if shallow, err := repo.Storer.Shallow(); err == nil && len(shallow) > 0 {
+		first_attempt = 1
+		depth = deepen_depths[0]
+	}
+
+	for _, fetch := range []string{branch, default_branch} {
+		if err := FetchBranch(repo, fetch, depth); err != nil {
+			return "", err
+		}
+	}
+
+	for attempt := first_attempt; ; attempt++ {
+
+		var commits []*object.Commit
+		for _, revision := range []string{branch, default_branch} {
+
+			hash, err := repo.ResolveRevision(plumbing.Revision("refs/remotes/origin/" + revision))
+			if err != nil {
+				return "", fmt.Errorf("resolving origin/%s: %w", revision, err)
+			}
+
+			commit, err := repo.CommitObject(*hash)
+			if err != nil {
+				return "", fmt.Errorf("loading commit %s: %w", hash, err)
+			}
+			commits = append(commits, commit)
+		}
+
+		// In a shallow clone the fork point can be older than the history fetched so far
+		bases, err := commits[0].MergeBase(commits[1])
+		if err != nil && !errors.Is(err, plumbing.ErrObjectNotFound) {
+			return "", fmt.Errorf("finding merge base of %s and %s: %w", branch, default_branch, err)
+		}
+		if err == nil && len(bases) > 0 {
+			return bases[0].Hash.String(), nil
+		}
+		if attempt == len(deepen_depths) {
+			return "", fmt.Errorf("%s and %s have no common history", branch, default_branch)
+		}
+
+		fmt.Printf("No merge base found yet, deepening the clone to %d commits\n", deepen_depths[attempt])
+		for _, deepen := range []string{branch, default_branch} {
+			if err := FetchBranch(repo, deepen, deepen_depths[attempt]); err != nil {
+				return "", err
+			}
+		}
 	}
 }
 
 // Helper function to calculate diffs between two refs
-func CalculateDiff(target_branch string, current_branch string, outfile *os.File) {
+// Files are reported as renamed when their similarity is at least rename_threshold percent.
+// With a merge_base branch the diff is three-dot, origin/<merge_base>...target_branch, like a merge request shows it,
+// so commits that only landed on merge_base, or a rebase onto it, don't show up as changes.
+func CalculateDiff(repo *git.Repository, target_branch string, current_branch string, merge_base string, rename_threshold uint) ([]FileChange, error) {
+
+	if merge_base != "" {
+		base, err := MergeBase(repo, target_branch, merge_base)
+		if err != nil {
+			return nil, err
+		}
+		current_branch = base
+	}
 
 	fmt.Println("Calculating diffs between:" + current_branch + " and: " + target_branch)
 
-	cmd := exec.Command("git", "diff", "--name-only", current_branch, "origin/"+target_branch)
+	from, err := ResolveTree(repo, current_branch)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := ResolveTree(repo, "refs/remotes/origin/"+target_branch)
+	if err != nil {
+		return nil, err
+	}
 
-	// Set output to git-diff file created earlier
-	cmd.Stdout = outfile
-	fmt.Println(cmd.String())
+	// A threshold of zero turns rename detection off entirely
+	options := &object.DiffTreeOptions{DetectRenames: rename_threshold > 0, RenameScore: rename_threshold}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
+	changes, err := object.DiffTreeWithOptions(context.Background(), from, to, options)
+	if err != nil {
+		return nil, fmt.Errorf("diffing %s and origin/%s: %w", current_branch, target_branch, err)
 	}
+
+	var file_changes []FileChange
+	for _, change := range changes {
+
+		action, err := change.Action()
+		if err != nil {
+			return nil, fmt.Errorf("classifying change to %s: %w", change.To.Name, err)
+		}
+
+		switch {
+		case action == merkletrie.Insert:
+			file_changes = append(file_changes, FileChange{Path: change.To.Name, Status: "A"})
+		case action == merkletrie.Delete:
+			// Deleted files only have a source side
+			file_changes = append(file_changes, FileChange{Path: change.From.Name, Status: "D"})
+		case change.From.Name != change.To.Name:
+			// Renames have both sides with different names
+			file_changes = append(file_changes, FileChange{Path: change.To.Name, Status: "R", OldPath: change.From.Name})
+		default:
+			file_changes = append(file_changes, FileChange{Path: change.To.Name, Status: "M"})
+		}
+	}
+
+	return file_changes, nil
 }
 
-func main() {
+// Helper function to list every tracked file in the repository, like git ls-files
+func ListFiles(repo *git.Repository) ([]FileChange, error) {
+
+	index, err := repo.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	// Every file is treated as newly added so that all of them get rendered
+	var file_changes []FileChange
+	for _, entry := range index.Entries {
+		file_changes = append(file_changes, FileChange{Path: entry.Name, Status: "A"})
+	}
+
+	return file_changes, nil
+}
+
+// Helper function to write the change list out as json
+func WriteChanges(outfile *os.File, changes []FileChange) error {
+
+	encoder := json.NewEncoder(outfile)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(DiffDocument{Changes: changes}); err != nil {
+		return fmt.Errorf("writing git diff file: %w", err)
+	}
+
+	return nil
+}
+
+// A single file change as reported by the gitlab merge request changes and compare apis
+type GitLabChange struct {
+	OldPath     string `json:"old_path"`
+	NewPath     string `json:"new_path"`
+	NewFile     bool   `json:"new_file"`
+	RenamedFile bool   `json:"renamed_file"`
+	DeletedFile bool   `json:"deleted_file"`
+}
+
+// Helper function to do an authenticated GET against the gitlab api using GITLAB_TOKEN
+func GitLabGET(endpoint string, result interface{}) error {
+
+	CI_API_V4_URL, ok := os.LookupEnv("CI_API_V4_URL")
+	if !ok {
+		return errors.New("CI_API_V4_URL env not set")
+	}
+
+	// Job tokens can't read merge request diffs or compare commits, so this uses the same token as build.go
+	GITLAB_TOKEN, ok := os.LookupEnv("GITLAB_TOKEN")
+	if !ok {
+		return errors.New("GITLAB_TOKEN env not set, --source gitlab needs a token with read_api")
+	}
+
+	request, err := http.NewRequest("GET", CI_API_V4_URL+endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("building gitlab request: %w", err)
+	}
+	request.Header.Add("PRIVATE-TOKEN", GITLAB_TOKEN)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("requesting %s: %w", endpoint, err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("reading gitlab response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("gitlab returned %s for %s: %s", response.Status, endpoint, body)
+	}
+
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("parsing gitlab response: %w", err)
+	}
 
-	CI_COMMIT_BRANCH, ok := os.LookupEnv("CI_COMMIT_BRANCH")
+	return nil
+}
+
+// Helper function to retrieve the change list from the gitlab api instead of a local git diff.
+// Merge request pipelines use the merge request diffs, otherwise the commit before sha is compared to the branch.
+func GitLabChanges(branch string, commit_before_sha string) ([]FileChange, error) {
+
+	CI_PROJECT_ID, ok := os.LookupEnv("CI_PROJECT_ID")
 	if !ok {
-		panic("CI_COMMIT_BRANCH env not set")
+		return nil, errors.New("CI_PROJECT_ID env not set")
+	}
+
+	var changes []GitLabChange
+
+	if CI_MERGE_REQUEST_IID, ok := os.LookupEnv("CI_MERGE_REQUEST_IID"); ok {
+
+		fmt.Println("Retrieving changes for merge request: " + CI_MERGE_REQUEST_IID)
+
+		// The diffs api pages through every file, where the deprecated changes api truncates large merge requests
+		for page := 1; ; page++ {
+
+			var diffs []GitLabChange
+			endpoint := "/projects/" + CI_PROJECT_ID + "/merge_requests/" + CI_MERGE_REQUEST_IID + "/diffs?per_page=100&page=" + strconv.Itoa(page)
+			if err := GitLabGET(endpoint, &diffs); err != nil {
+				return nil, err
+			}
+			changes = append(changes, diffs...)
+
+			if len(diffs) < 100 {
+				break
+			}
+		}
+
+	} else {
+
+		if commit_before_sha == "" {
+			return nil, errors.New("COMMIT_BEFORE_SHA env not set")
+		}
+
+		fmt.Println("Retrieving changes between:" + commit_before_sha + " and: " + branch)
+
+		var compare struct {
+			Diffs []GitLabChange `json:"diffs"`
+		}
+		query := "?from=" + url.QueryEscape(commit_before_sha) + "&to=" + url.QueryEscape(branch)
+		if err := GitLabGET("/projects/"+CI_PROJECT_ID+"/repository/compare"+query, &compare); err != nil {
+			return nil, err
+		}
+		changes = compare.Diffs
+	}
+
+	var file_changes []FileChange
+	for _, change := range changes {
+
+		switch {
+		case change.NewFile:
+			file_changes = append(file_changes, FileChange{Path: change.NewPath, Status: "A"})
+		case change.DeletedFile:
+			file_changes = append(file_changes, FileChange{Path: change.OldPath, Status: "D"})
+		case change.RenamedFile:
+			file_changes = append(file_changes, FileChange{Path: change.NewPath, Status: "R", OldPath: change.OldPath})
+		default:
+			file_changes = append(file_changes, FileChange{Path: change.NewPath, Status: "M"})
+		}
+	}
+
+	return file_changes, nil
+}
+
+// Helper function to return the repositories default branch, which gitlab sets in CI_DEFAULT_BRANCH
+func DefaultBranch() string {
+
+	default_branch := os.Getenv("CI_DEFAULT_BRANCH")
+	if default_branch == "" {
+		default_branch = "master"
+	}
+
+	return default_branch
+}
+
+// Helper function to pick the commit to diff the branch against.
+// Merge request pipelines diff against the commit the merge request branched from, so everything the merge request
+// changes is rendered rather than only the last push. Other pipelines use COMMIT_BEFORE_SHA, or gitlab's own before sha.
+func DiffBase() string {
+
+	for _, variable := range []string{"CI_MERGE_REQUEST_DIFF_BASE_SHA", "CI_MERGE_REQUEST_TARGET_BRANCH_SHA", "COMMIT_BEFORE_SHA", "CI_COMMIT_BEFORE_SHA"} {
+		if sha := os.Getenv(variable); sha != "" {
+			fmt.Println("Diffing against " + variable + ": " + sha)
+			return sha
+		}
+	}
+
+	return ""
+}
+
+// The before sha gitlab reports for the first push of a new branch
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+func main() {
+
+	// Command Line Flags
+	sourcePointer := flag.String("source", "git", "Where to read the change list from: git (local diff) or gitlab (merge request diffs/compare api, needs GITLAB_TOKEN).")
+	branchPointer := flag.String("branch", "", "Branch to diff instead of CI_COMMIT_BRANCH, for running outside gitlab ci.")
+	basePointer := flag.String("base", "", "Commit to diff the branch against instead of the merge request diff base or COMMIT_BEFORE_SHA, for running outside gitlab ci.")
+	mergeBasePointer := flag.String("merge-base", "", "Diff against where the branch forked from this branch (three-dot diff) instead of the base commit, e.g. master.")
+	renameThresholdPointer := flag.Uint("rename-threshold", 50, "Similarity percentage for a delete and add to count as a rename. Set to 0 to disable rename detection.")
+	flag.Parse()
+
+	if *sourcePointer != "git" && *sourcePointer != "gitlab" {
+		panic("Unknown change source: " + *sourcePointer)
+	}
+
+	if *renameThresholdPointer > 100 {
+		panic("Rename threshold must be between 0 and 100")
+	}
+
+	// Merge request pipelines don't set CI_COMMIT_BRANCH, the source branch is the one being built
+	CI_COMMIT_BRANCH := *branchPointer
+	for _, variable := range []string{"CI_COMMIT_BRANCH", "CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"} {
+		if CI_COMMIT_BRANCH == "" {
+			CI_COMMIT_BRANCH = os.Getenv(variable)
+		}
+	}
+	if CI_COMMIT_BRANCH == "" {
+		panic("CI_COMMIT_BRANCH env not set, use --branch when running locally")
+	}
+
+	// Flags take precedence over the pipeline variables
+	COMMIT_BEFORE_SHA := *basePointer
+	if COMMIT_BEFORE_SHA == "" {
+		COMMIT_BEFORE_SHA = DiffBase()
+	}
+
+	// The first push of a new branch has nothing before it, so diff against where it forked from the default branch
+	if COMMIT_BEFORE_SHA == ZeroSHA {
+
+		default_branch := DefaultBranch()
+		fmt.Println("First push of " + CI_COMMIT_BRANCH + ", diffing against its merge base with " + default_branch)
+
+		if *sourcePointer == "gitlab" {
+			// The compare api diffs from the merge base when given a branch
+			COMMIT_BEFORE_SHA = default_branch
+		} else {
+			repo, err := OpenRepository()
+			if err != nil {
+				log.Fatal(err)
+			}
+			COMMIT_BEFORE_SHA, err = MergeBase(repo, CI_COMMIT_BRANCH, default_branch)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
 	// Create git diff file. This file is in .gitignore so it won't be commited.
-	outfile, err := os.Create("git-diff")
+	outfile, err := os.Create("git-diff.json")
 	if err != nil {
-		panic("Failed to create git diff file")
-		log.Fatal(err)
+		log.Fatalf("Failed to create git diff file: %v", err)
 	}
 
-	// If current branch is master, then all dashboards are in the diff.
-	if CI_COMMIT_BRANCH == "master" {
+	var changes []FileChange
+
+	// If current branch is the default branch, then all dashboards are in the diff.
+	if CI_COMMIT_BRANCH == DefaultBranch() {
+
+		repo, err := OpenRepository()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// List all files in the repo (As this is the default branch)
+		changes, err = ListFiles(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	} else if *sourcePointer == "gitlab" {
 
-		// Git ls-files to list all files in the repo (As this is master)
-		cmd := exec.Command("git", "ls-files")
-		cmd.Stdout = outfile
+		// The compare api diffs from the merge base when given a branch
+		if *mergeBasePointer != "" {
+			COMMIT_BEFORE_SHA = *mergeBasePointer
+		}
 
-		// Run the command
-		if err := cmd.Run(); err != nil {
+		// The gitlab api copes with shallow clones, force pushes and squash merges
+		changes, err = GitLabChanges(CI_COMMIT_BRANCH, COMMIT_BEFORE_SHA)
+		if err != nil {
 			log.Fatal(err)
 		}
 
@@ -67,15 +509,36 @@ func main() {
 		// For all other branches we compare the current branch to commit_before_sha.
 		// This is essentially comparing to the previous latest commit present on a branch.
 		// Refer: https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
-		COMMIT_BEFORE_SHA, ok := os.LookupEnv("COMMIT_BEFORE_SHA")
-		if !ok {
-			panic("COMMIT_BEFORE_SHA env not set")
+		if COMMIT_BEFORE_SHA == "" && *mergeBasePointer == "" {
+			panic("COMMIT_BEFORE_SHA env not set, use --base when running locally")
+		}
+
+		repo, err := OpenRepository()
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		// Fetch information about the current branch
-		FetchBranch(CI_COMMIT_BRANCH)
+		if err := FetchBranch(repo, CI_COMMIT_BRANCH, 0); err != nil {
+			log.Fatal(err)
+		}
+
+		// A shallow clone may not reach back to the commit to diff against
+		if COMMIT_BEFORE_SHA != "" && *mergeBasePointer == "" {
+			if err := EnsureRevision(repo, CI_COMMIT_BRANCH, COMMIT_BEFORE_SHA); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		// Calculate diff and save to outfile
-		CalculateDiff(CI_COMMIT_BRANCH, COMMIT_BEFORE_SHA, outfile)
+		// Calculate diff
+		changes, err = CalculateDiff(repo, CI_COMMIT_BRANCH, COMMIT_BEFORE_SHA, *mergeBasePointer, *renameThresholdPointer)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Save the change list to outfile
+	if err := WriteChanges(outfile, changes); err != nil {
+		log.Fatal(err)
 	}
 }
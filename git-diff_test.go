@@ -0,0 +1,174 @@
+//go:build gitdiff
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Helper function to commit a file change to a repository, returning the commit hash
+func testCommit(t *testing.T, repo *git.Repository, file string, contents string) plumbing.Hash {
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := worktree.Filesystem.Root()
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(root, file)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, file), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(file); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := worktree.Commit("Update "+file, &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// Helper function to build an origin where feature forked from master, with commits on both since.
+// Returns the origin path and the fork point.
+func testOrigin(t *testing.T) (string, plumbing.Hash) {
+
+	origin := t.TempDir()
+	repo, err := git.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCommit(t, repo, "dashboards/team/latency.json", `{"title": "Latency"}`)
+	fork := testCommit(t, repo, "dashboards/team/errors.json", `{"title": "Errors"}`)
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, repo, "dashboards/team/latency.json", `{"title": "Latency by route"}`)
+	testCommit(t, repo, "dashboards/team/saturation.json", `{"title": "Saturation"}`)
+
+	if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("master")}); err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, repo, "dashboards/team/errors.json", `{"title": "Errors by code"}`)
+
+	return origin, fork
+}
+
+func TestMergeBase(t *testing.T) {
+
+	origin, fork := testOrigin(t)
+
+	tests := []struct {
+		name  string
+		clone func(t *testing.T, dir string) error
+	}{
+		{name: "full clone", clone: func(t *testing.T, dir string) error {
+			_, err := git.PlainClone(dir, false, &git.CloneOptions{URL: origin})
+			return err
+		}},
+
+		// Gitlab runners clone only the pipeline's branch, and only its last commits, with git itself
+		{name: "shallow clone", clone: func(t *testing.T, dir string) error {
+			if _, err := exec.LookPath("git"); err != nil {
+				t.Skip("git isn't installed")
+			}
+			return exec.Command("git", "clone", "--quiet", "--depth", "1", "--branch", "feature", "--single-branch", "file://"+origin, dir).Run()
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			if err := test.clone(t, dir); err != nil {
+				t.Fatal(err)
+			}
+			repo, err := git.PlainOpen(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			merge_base, err := MergeBase(repo, "feature", "master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merge_base != fork.String() {
+				t.Errorf("expected the merge base %s, got %s", fork, merge_base)
+			}
+
+			// Only the feature branch's changes since the fork are in the diff, not master's
+			changes, err := CalculateDiff(repo, "feature", "", "master", 50)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 2 {
+				t.Errorf("expected the two files changed on feature, got %v", changes)
+			}
+		})
+	}
+}
+
+func TestGitLabChangesPagesMergeRequestDiffs(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		if request.Header.Get("PRIVATE-TOKEN") != "gitlab-token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if request.URL.Path != "/projects/7/merge_requests/3/diffs" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// A full first page, then the rest
+		diffs := []GitLabChange{{OldPath: "dashboards/team/old.json", NewPath: "dashboards/team/new.json", RenamedFile: true}}
+		if request.URL.Query().Get("page") == "1" {
+			diffs = nil
+			for i := 0; i < 100; i++ {
+				path := "dashboards/team/" + strconv.Itoa(i) + ".json"
+				diffs = append(diffs, GitLabChange{OldPath: path, NewPath: path})
+			}
+		}
+		json.NewEncoder(writer).Encode(diffs)
+	}))
+	defer server.Close()
+
+	t.Setenv("CI_API_V4_URL", server.URL)
+	t.Setenv("CI_PROJECT_ID", "7")
+	t.Setenv("CI_MERGE_REQUEST_IID", "3")
+	t.Setenv("GITLAB_TOKEN", "gitlab-token")
+
+	changes, err := GitLabChanges("feature", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 101 {
+		t.Fatalf("expected the changes from both pages, got %d", len(changes))
+	}
+	if last := changes[100]; last.Status != "R" || last.OldPath != "dashboards/team/old.json" {
+		t.Errorf("expected the rename on the second page, got %+v", last)
+	}
+}